@@ -0,0 +1,62 @@
+package main
+
+import "strings"
+
+const esc = '\x1b'
+
+// stripANSI removes ANSI escape sequences like colors and cursor movements
+// from s: CSI sequences, OSC sequences ended by BEL or ST and the short
+// escapes.
+func stripANSI(s string) string {
+	i := strings.IndexByte(s, esc)
+	if i < 0 {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i >= 0 {
+		b.WriteString(s[:i])
+		s = s[i+ansiLen(s[i:]):]
+		i = strings.IndexByte(s, esc)
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// ansiLen returns the length of the escape sequence s starts with, an
+// unfinished one takes the rest of s.
+func ansiLen(s string) int {
+	if len(s) < 2 {
+		return len(s)
+	}
+	switch s[1] {
+	case '[':
+		// parameter and intermediate bytes up to the final byte
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(s)
+	case ']':
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == esc && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	}
+	// other escapes have intermediate bytes and a final byte, like ESC ( B
+	i := 1
+	for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+		i++
+	}
+	if i < len(s) && s[i] >= 0x30 && s[i] <= 0x7e {
+		return i + 1
+	}
+	// a lone ESC
+	return 1
+}
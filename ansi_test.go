@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func Test_stripANSI(t *testing.T) {
+	cases := map[string]string{
+		"plain msg":                                          "plain msg",
+		"\x1b[31mERROR\x1b[0m disk full":                     "ERROR disk full",
+		"\x1b[1;38;5;208mbold orange\x1b[m done\n":           "bold orange done\n",
+		"\x1b[2K\x1b[1Gprogress 50%":                         "progress 50%",
+		"\x1b]0;window title\x07build ok":                    "build ok",
+		"\x1b]8;;http://example.com\x1b\\link\x1b]8;;\x1b\\": "link",
+		"\x1b(Bcharset":                                      "charset",
+		"keypad\x1b= on":                                     "keypad on",
+		"cut off \x1b[38;5":                                  "cut off ",
+		"lone \x1b":                                          "lone ",
+	}
+	for in, want := range cases {
+		if got := stripANSI(in); got != want {
+			t.Errorf("got %q for %q but want %q", got, in, want)
+		}
+	}
+}
+
+func Test_processStripANSI(t *testing.T) {
+	input := &Input{
+		forward:   true,
+		stripANSI: true,
+		scanChan:  make(chan [][]byte, 1),
+		lineChan:  make(chan *LogLine, 1),
+	}
+	input.scanChan <- [][]byte{[]byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy \x1b[32mINFO\x1b[0m started\n")}
+	close(input.scanChan)
+	input.process()
+
+	if ll := <-input.lineChan; ll.Msg != "INFO started\n" {
+		t.Errorf("got msg %q", ll.Msg)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var bodyDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "fancy_body_dropped_total",
+	Help: "Total number of logs forwarded without their msg by no-body"})
+
+// bodyDropper forwards the logs of all or some programs with an empty or
+// cut msg, so they still count in their Loki streams but take little
+// storage.
+type bodyDropper struct {
+	all      bool
+	programs sourceList
+	// keep cuts the msg down to this many bytes instead of emptying it.
+	keep int
+}
+
+// newBodyDropper returns nil when neither all nor programs are set.
+func newBodyDropper(all bool, programs string, keep int) (*bodyDropper, error) {
+	l, err := newSourceList(programs)
+	if err != nil {
+		return nil, err
+	}
+	if !all && len(l) == 0 {
+		return nil, nil
+	}
+	return &bodyDropper{all: all, programs: l, keep: keep}, nil
+}
+
+func (d *bodyDropper) apply(ll *LogLine) {
+	if !d.all && !d.programs.match(ll.Program) {
+		return
+	}
+	if d.keep > 0 {
+		if ll.truncate(d.keep) == 0 {
+			return
+		}
+	} else {
+		ll.Msg = ""
+	}
+	bodyDropped.Inc()
+}
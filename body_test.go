@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_noBody(t *testing.T) {
+	cases := []struct {
+		programs string
+		keep     int
+		want     map[string]string
+	}{
+		{"nginx*", 0, map[string]string{"nginx-lb": "", "sshd": "a long message"}},
+		{"nginx*,sshd", 6, map[string]string{"nginx-lb": "a long…(truncated 8 bytes)", "sshd": "a long…(truncated 8 bytes)"}},
+	}
+	for _, c := range cases {
+		d, err := newBodyDropper(false, c.programs, c.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := &Input{forward: true, lineChan: make(chan *LogLine, 10), dropBody: d}
+		rec := &pushRecorder{}
+		l, srv := newTestLoki(t, rec, LokiConfig{})
+
+		now := time.Now()
+		var lines []*LogLine
+		for _, program := range []string{"nginx-lb", "sshd"} {
+			ll := testLogLine("a long message")
+			ll.Program = program
+			input.send(ll, &now)
+			lines = append(lines, <-input.lineChan)
+		}
+		push(l, lines...)
+		srv.Close()
+
+		if len(rec.body) != 1 {
+			t.Fatalf("got %d pushes but want 1", len(rec.body))
+		}
+		streams := decodePush(t, rec.body[0]).Streams
+		if len(streams) != 2 {
+			t.Fatalf("got %d streams but want one per program", len(streams))
+		}
+		for _, s := range streams {
+			for program, msg := range c.want {
+				if !strings.Contains(s.Labels, `program="`+program+`"`) {
+					continue
+				}
+				if len(s.Entries) != 1 || s.Entries[0].Line != msg {
+					t.Errorf("%s: got entries %v but want one with %q", program, s.Entries, msg)
+				}
+			}
+		}
+	}
+
+	if d, err := newBodyDropper(false, "", 0); d != nil || err != nil {
+		t.Errorf("got %v, %v without programs", d, err)
+	}
+	if _, err := newBodyDropper(true, "[", 0); err == nil {
+		t.Error("got no error for an invalid glob")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// checkLines parses every line of r like fancy would and writes the fields
+// or the parse error of each to w, followed by a summary. It reports
+// whether all lines parsed.
+func checkLines(w io.Writer, r io.Reader, parse parser) (bool, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	n, failed := 0, 0
+	for sc.Scan() {
+		raw := trimCR(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		n++
+		ll, err := parse(raw, false)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "line %d: error: %v\n", n, err)
+			continue
+		}
+		fmt.Fprintf(w, "line %d: ok %s\n", n, checkFields(ll))
+	}
+	if err := sc.Err(); err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w, "check: %d of %d lines parsed\n", n-failed, n)
+	return failed == 0, nil
+}
+
+// checkFields returns the parsed fields of ll as key=value pairs.
+func checkFields(ll *LogLine) string {
+	s := "time=" + ll.Timestamp.Format(time.RFC3339Nano) +
+		" severity=" + ll.Severity +
+		" hostname=" + ll.Hostname +
+		" program=" + ll.Program
+	if ll.StaticTag != "" {
+		s += " static_tag=" + ll.StaticTag
+	}
+	keys := make([]string, 0, len(ll.Labels))
+	for k := range ll.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += " " + k + "=" + strconv.Quote(ll.Labels[k])
+	}
+	return s + " msg=" + strconv.Quote(ll.Msg)
+}
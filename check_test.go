@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_checkLines(t *testing.T) {
+	good := "2019-10-29T16:21:22.230666+01:00 6 pad fancy first msg\r\n" +
+		"\n" +
+		"2019-10-29T16:21:22.230666+01:00 3 pad kernel oops\n"
+	var out bytes.Buffer
+	ok, err := checkLines(&out, strings.NewReader(good), parseLine)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v for good lines:\n%s", ok, err, out.String())
+	}
+	want := "line 1: ok time=2019-10-29T16:21:22.230666+01:00 severity=info hostname=pad program=fancy msg=\"first msg\"\n" +
+		"line 2: ok time=2019-10-29T16:21:22.230666+01:00 severity=error hostname=pad program=kernel msg=\"oops\"\n" +
+		"check: 2 of 2 lines parsed\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nbut want\n%s", out.String(), want)
+	}
+
+	bad := "2019-10-29T16:21:22.230666+01:00 6 pad fancy first msg\n" +
+		"2019-10-29T16:21:22.230666+01:00 9 pad fancy bad severity\n" +
+		"<14>Oct 29 16:21:22 pad fancy: rfc3164\n"
+	out.Reset()
+	ok, err = checkLines(&out, strings.NewReader(bad), parseLine)
+	if err != nil || ok {
+		t.Fatalf("got %v, %v for bad lines:\n%s", ok, err, out.String())
+	}
+	got := out.String()
+	for _, want := range []string{"line 1: ok ", "line 2: error: ", "line 3: error: ", "check: 1 of 3 lines parsed\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got\n%s\nbut want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	errCmdTimeout = fmt.Errorf("command timed out")
+	errCmdOutput  = fmt.Errorf("command output exceeded the size limit")
+	errCmdJSON    = fmt.Errorf("command output is no JSON object")
+	errCmdBusy    = fmt.Errorf("too many commands running")
+)
+
+var cmdErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_cmd_errors_total",
+	Help: "Total number of msgs cmd failed on by reason: timeout, output, start, exit, stderr, json or busy"},
+	[]string{"reason"})
+
+var cmdDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "fancy_cmd_duration_seconds",
+	Help:    "Duration of running cmd on a single msg",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14)})
+
+var cmdRunning = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "fancy_cmd_running",
+	Help: "Number of cmd processes running right now"})
+
+// maxStderr is how much of the stderr of cmd is kept for the logs.
+const maxStderr = 1024
+
+// cmdStartError is returned when cmd could not be started at all, which is
+// a matter of the configuration.
+type cmdStartError struct {
+	err error
+}
+
+func (e *cmdStartError) Error() string {
+	return fmt.Sprintf("command failed to start: %v", e.err)
+}
+
+// cmdExitError is returned when cmd exited nonzero.
+type cmdExitError struct {
+	code   int
+	stderr string
+}
+
+func (e *cmdExitError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("command exited with code %d", e.code)
+	}
+	return fmt.Sprintf("command exited with code %d: %s", e.code, e.stderr)
+}
+
+// cmdStderrError comes along with the output of a cmd which succeeded but
+// wrote to stderr.
+type cmdStderrError struct {
+	stderr string
+}
+
+func (e *cmdStderrError) Error() string {
+	return fmt.Sprintf("command wrote to stderr: %s", e.stderr)
+}
+
+// cmdErrorReason returns the reason label of a cmd error.
+func cmdErrorReason(err error) string {
+	switch err.(type) {
+	case *cmdStartError:
+		return "start"
+	case *cmdExitError:
+		return "exit"
+	case *cmdStderrError:
+		return "stderr"
+	}
+	switch err {
+	case errCmdTimeout:
+		return "timeout"
+	case errCmdOutput:
+		return "output"
+	case errCmdJSON:
+		return "json"
+	case errCmdBusy:
+		return "busy"
+	}
+	return "other"
+}
+
+// CmdConfig holds the settings of the external command.
+type CmdConfig struct {
+	Args []string
+	// Timeout kills the command when a single msg takes longer, 0 waits
+	// forever.
+	Timeout time.Duration
+	// MaxOutput is the maximum output in bytes for a single msg, 0 means
+	// no limit.
+	MaxOutput int
+	// Limit is shared by all commands, nil means no limit.
+	Limit *procLimit
+}
+
+// procLimit caps the number of processes the commands run at once, over
+// all workers and stages.
+type procLimit struct {
+	slots chan struct{}
+	drop  bool
+}
+
+// newProcLimit returns nil for a max of 0. With drop a command fails with
+// errCmdBusy instead of waiting for a free slot.
+func newProcLimit(max int, drop bool) *procLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &procLimit{slots: make(chan struct{}, max), drop: drop}
+}
+
+// acquire takes a slot for a process about to start.
+func (l *procLimit) acquire() error {
+	if l != nil && l.drop {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return errCmdBusy
+		}
+	} else if l != nil {
+		l.slots <- struct{}{}
+	}
+	cmdRunning.Inc()
+	return nil
+}
+
+// release frees the slot of a process which ended.
+func (l *procLimit) release() {
+	cmdRunning.Dec()
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// commander rewrites a log msg with an external command. run returns the
+// output along with a *cmdStderrError when the command succeeded but wrote
+// to stderr.
+type commander interface {
+	run(msg []byte) (string, error)
+	close()
+}
+
+// cmdStages splits cmd into the arguments of its stages, which are
+// separated by |.
+func cmdStages(cmd string) [][]string {
+	var stages [][]string
+	for _, stage := range strings.Split(cmd, "|") {
+		if args := strings.Fields(stage); len(args) > 0 {
+			stages = append(stages, args)
+		}
+	}
+	return stages
+}
+
+// newCmd returns the commander running cmd in mode spawn or pipe, nil for
+// an empty cmd. Every stage gets the limits of cfg.
+func newCmd(cmd, mode string, cfg CmdConfig) commander {
+	var stages cmdPipeline
+	for _, args := range cmdStages(cmd) {
+		cfg.Args = args
+		if mode == "pipe" {
+			stages = append(stages, newPipeCmd(cfg))
+		} else {
+			stages = append(stages, newSpawnCmd(cfg))
+		}
+	}
+	switch len(stages) {
+	case 0:
+		return nil
+	case 1:
+		return stages[0]
+	}
+	return stages
+}
+
+// cmdPipeline feeds the output of every stage to the next one. The first
+// error skips the rest, only a stderr warning lets the msg go on.
+type cmdPipeline []commander
+
+func (p cmdPipeline) run(msg []byte) (string, error) {
+	var out string
+	var warning error
+	for _, c := range p {
+		o, err := c.run(msg)
+		if _, ok := err.(*cmdStderrError); ok {
+			warning = err
+		} else if err != nil {
+			return "", err
+		}
+		out, msg = o, []byte(o)
+	}
+	return out, warning
+}
+
+func (p cmdPipeline) close() {
+	for _, c := range p {
+		c.close()
+	}
+}
+
+const maxPooledOutput = 64 * 1024
+
+// outputPool holds the buffers capturing the output of spawned commands.
+var outputPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// spawnCmd starts the command once per msg and uses its whole output.
+type spawnCmd struct {
+	CmdConfig
+}
+
+func newSpawnCmd(cfg CmdConfig) *spawnCmd {
+	return &spawnCmd{cfg}
+}
+
+func (s *spawnCmd) run(msg []byte) (string, error) {
+	// waiting for a slot doesn't count for the timeout
+	if err := s.Limit.acquire(); err != nil {
+		return "", err
+	}
+	defer s.Limit.release()
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	buf, errBuf := getOutput(), getOutput()
+	defer putOutput(buf)
+	defer putOutput(errBuf)
+	out := limitBuffer{buf: buf, max: s.MaxOutput}
+	c := exec.CommandContext(ctx, s.Args[0], s.Args[1:]...)
+	c.Stdin = bytes.NewReader(msg)
+	c.Stdout = &out
+	c.Stderr = &headBuffer{buf: errBuf, max: maxStderr}
+	if err := c.Start(); err != nil {
+		return "", &cmdStartError{err}
+	}
+	err := c.Wait()
+	switch {
+	case out.exceeded:
+		return "", errCmdOutput
+	case ctx.Err() == context.DeadlineExceeded:
+		return "", errCmdTimeout
+	case err != nil:
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() > 0 {
+			return "", &cmdExitError{ee.ExitCode(), stderrString(errBuf)}
+		}
+		return "", err
+	case errBuf.Len() > 0:
+		return buf.String(), &cmdStderrError{stderrString(errBuf)}
+	}
+	return buf.String(), nil
+}
+
+func getOutput() *bytes.Buffer {
+	return outputPool.Get().(*bytes.Buffer)
+}
+
+func putOutput(buf *bytes.Buffer) {
+	// don't let a single huge output stay around
+	if buf.Cap() <= maxPooledOutput {
+		buf.Reset()
+		outputPool.Put(buf)
+	}
+}
+
+// stderrString returns the stderr of cmd for the logs.
+func stderrString(buf *bytes.Buffer) string {
+	return string(bytes.TrimSpace(buf.Bytes()))
+}
+
+func (s *spawnCmd) close() {}
+
+// limitBuffer fails writes once it would hold more than max bytes. The
+// buffer is not embedded, so io.Copy can't bypass Write with ReadFrom.
+type limitBuffer struct {
+	buf      *bytes.Buffer
+	max      int
+	exceeded bool
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		b.exceeded = true
+		return 0, errCmdOutput
+	}
+	return b.buf.Write(p)
+}
+
+// headBuffer keeps the first max bytes written to it and drops the rest, so
+// a chatty stderr neither fails nor grows without bound.
+type headBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.buf.Len(); n < len(p) {
+		b.buf.Write(p[:n])
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// pipeCmd keeps a single command running and streams every msg through
+// it, one line in and one line out. The command is started on first use
+// and restarted when it dies.
+type pipeCmd struct {
+	CmdConfig
+	mu     sync.Mutex
+	c      *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *pipeStderr
+	// line is reused for the output of every msg
+	line []byte
+}
+
+func newPipeCmd(cfg CmdConfig) *pipeCmd {
+	return &pipeCmd{CmdConfig: cfg}
+}
+
+func (p *pipeCmd) run(msg []byte) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out, err := p.roundTrip(msg)
+	if err != nil && err != errCmdTimeout && err != errCmdOutput {
+		// the command may have crashed, give a fresh one a single try
+		p.stop()
+		out, err = p.roundTrip(msg)
+	}
+	if err != nil {
+		// the command's output can't be matched to the msgs anymore
+		if ee, ok := p.stop().(*exec.ExitError); ok && ee.ExitCode() > 0 && err != errCmdTimeout && err != errCmdOutput {
+			return "", &cmdExitError{ee.ExitCode(), p.stderr.String()}
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+func (p *pipeCmd) roundTrip(msg []byte) ([]byte, error) {
+	if p.c == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+	if p.Timeout > 0 {
+		proc := p.c.Process
+		kill := time.AfterFunc(p.Timeout, func() { proc.Kill() })
+		defer kill.Stop()
+		out, err := p.writeRead(msg)
+		if !kill.Stop() {
+			return nil, errCmdTimeout
+		}
+		return out, err
+	}
+	return p.writeRead(msg)
+}
+
+func (p *pipeCmd) writeRead(msg []byte) ([]byte, error) {
+	msg = bytes.TrimSuffix(msg, []byte("\n"))
+	if _, err := p.stdin.Write(append(msg[:len(msg):len(msg)], '\n')); err != nil {
+		return nil, err
+	}
+
+	line := p.line[:0]
+	for {
+		b, err := p.stdout.ReadSlice('\n')
+		if p.MaxOutput > 0 && len(line)+len(b) > p.MaxOutput {
+			return nil, errCmdOutput
+		}
+		line = append(line, b...)
+		if err != bufio.ErrBufferFull {
+			p.line = line
+			return line, err
+		}
+	}
+}
+
+func (p *pipeCmd) start() error {
+	c := exec.Command(p.Args[0], p.Args[1:]...)
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	c.Stderr = w
+	if err := p.Limit.acquire(); err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+	err = c.Start()
+	w.Close()
+	if err != nil {
+		p.Limit.release()
+		r.Close()
+		return &cmdStartError{err}
+	}
+	p.stderr = newPipeStderr(r)
+	p.c, p.stdin, p.stdout = c, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stop kills the command, if there is one, and returns how it ended.
+func (p *pipeCmd) stop() error {
+	if p.c == nil {
+		return nil
+	}
+	// a command that quits at the end of its stdin tells how it ended
+	p.stdin.Close()
+	kill := time.AfterFunc(quitWait, func() { p.c.Process.Kill() })
+	err := p.c.Wait()
+	kill.Stop()
+	p.Limit.release()
+	p.c = nil
+	return err
+}
+
+// pipeStderr collects the stderr of a pipeCmd. It is a pipe of its own
+// instead of a writer, so Wait doesn't hang on children of the command
+// which keep it open.
+type pipeStderr struct {
+	r    *os.File
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+func newPipeStderr(r *os.File) *pipeStderr {
+	e := &pipeStderr{r: r, done: make(chan struct{})}
+	go func() {
+		io.Copy(&headBuffer{buf: &e.buf, max: maxStderr}, r)
+		r.Close()
+		close(e.done)
+	}()
+	return e
+}
+
+// String returns the stderr of the command once it died, nothing when it
+// is still held open.
+func (e *pipeStderr) String() string {
+	select {
+	case <-e.done:
+		return stderrString(&e.buf)
+	case <-time.After(quitWait):
+		e.r.Close()
+		return ""
+	}
+}
+
+func (p *pipeCmd) close() {
+	p.mu.Lock()
+	p.stop()
+	p.mu.Unlock()
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_pipeCmd(t *testing.T) {
+	p := newPipeCmd(CmdConfig{Args: []string{"cat"}})
+	defer p.close()
+
+	for _, msg := range []string{"first\n", "second", "third\n"} {
+		out, err := p.run([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := msg
+		if want[len(want)-1] != '\n' {
+			want += "\n"
+		}
+		if string(out) != want {
+			t.Errorf("got %q but want %q", out, want)
+		}
+	}
+}
+
+func Test_pipeCmdRestart(t *testing.T) {
+	// head exits after every line, so each msg needs a fresh process
+	p := newPipeCmd(CmdConfig{Args: []string{"head", "-n", "1"}})
+	defer p.close()
+
+	for _, msg := range []string{"first\n", "second\n", "third\n"} {
+		out, err := p.run([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != msg {
+			t.Errorf("got %q but want %q", out, msg)
+		}
+	}
+}
+
+func Test_spawnCmd(t *testing.T) {
+	out, err := newSpawnCmd(CmdConfig{Args: []string{"tr", "a-z", "A-Z"}}).run([]byte("msg\n"))
+	if err != nil || string(out) != "MSG\n" {
+		t.Errorf("got %q,%v but want %q", out, err, "MSG\n")
+	}
+}
+
+func Test_cmdLimits(t *testing.T) {
+	flood := []string{"sh", "-c", "while read l; do head -c 100000 /dev/zero; echo; done"}
+	cases := []struct {
+		c    commander
+		want error
+	}{
+		{newSpawnCmd(CmdConfig{Args: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}), errCmdTimeout},
+		{newPipeCmd(CmdConfig{Args: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}), errCmdTimeout},
+		{newSpawnCmd(CmdConfig{Args: []string{"yes"}, MaxOutput: 1024}), errCmdOutput},
+		{newPipeCmd(CmdConfig{Args: flood, MaxOutput: 1024}), errCmdOutput},
+	}
+
+	for i, c := range cases {
+		start := time.Now()
+		if _, err := c.c.run([]byte("msg\n")); err != c.want {
+			t.Errorf("case %d: got %v but want %v", i, err, c.want)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("case %d: took %v", i, d)
+		}
+		c.c.close()
+	}
+}
+
+// exitCmd is a helper which writes oops to stderr and exits with code.
+func exitCmd(code int) []string {
+	return []string{"sh", "-c", fmt.Sprintf("read l; echo oops >&2; exit %d", code)}
+}
+
+func Test_cmdErrorClasses(t *testing.T) {
+	missing := CmdConfig{Args: []string{"/nonexistent/fancy-cmd"}}
+	for _, c := range []commander{newSpawnCmd(missing), newPipeCmd(missing)} {
+		if _, err := c.run([]byte("msg\n")); cmdErrorReason(err) != "start" {
+			t.Errorf("%T: got %v but want a start error", c, err)
+		}
+		c.close()
+	}
+
+	exit := CmdConfig{Args: exitCmd(3)}
+	for _, c := range []commander{newSpawnCmd(exit), newPipeCmd(exit)} {
+		_, err := c.run([]byte("msg\n"))
+		if e, ok := err.(*cmdExitError); !ok || e.code != 3 || e.stderr != "oops" {
+			t.Errorf("%T: got %v but want exit code 3 and stderr oops", c, err)
+		}
+		c.close()
+	}
+
+	warn := newSpawnCmd(CmdConfig{Args: []string{"sh", "-c", "cat; echo careful >&2"}})
+	out, err := warn.run([]byte("msg\n"))
+	if e, ok := err.(*cmdStderrError); !ok || e.stderr != "careful" || out != "msg\n" {
+		t.Errorf("got %q,%v but want the output and stderr careful", out, err)
+	}
+}
+
+func Test_rewriteCmdExit(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		input := &Input{
+			cmd:           newSpawnCmd(CmdConfig{Args: exitCmd(1)}),
+			cmdKeepOnExit: keep,
+			forward:       true,
+			scanChan:      make(chan [][]byte, 1),
+			lineChan:      make(chan *LogLine, 1),
+		}
+		before := testutil.ToFloat64(cmdErrors.WithLabelValues("exit"))
+		input.scanChan <- [][]byte{raw}
+		close(input.scanChan)
+		input.process()
+
+		if got := testutil.ToFloat64(cmdErrors.WithLabelValues("exit")) - before; got != 1 {
+			t.Errorf("keep %v: got %v exits but want 1", keep, got)
+		}
+		if !keep && len(input.lineChan) != 0 {
+			t.Errorf("got the line forwarded although cmd exited nonzero")
+		}
+		if keep {
+			if ll := <-input.lineChan; ll.Msg != string(raw[ll.MsgPos:]) {
+				t.Errorf("got msg %q but want the original", ll.Msg)
+			}
+		}
+	}
+}
+
+func Test_cmdInput(t *testing.T) {
+	ll, err := parseLine(raw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"msg", "raw", "json"} {
+		// cat echoes what it got on stdin
+		in := &Input{cmd: newSpawnCmd(CmdConfig{Args: []string{"cat"}}), cmdInput: mode}
+		got := *ll
+		if !in.rewrite(&got) {
+			t.Fatalf("%s: rewrite dropped the line", mode)
+		}
+		switch mode {
+		case "msg":
+			if got.Msg != string(raw[ll.MsgPos:]) {
+				t.Errorf("msg: got %q but want the msg", got.Msg)
+			}
+		case "raw":
+			if got.Msg != string(raw) {
+				t.Errorf("raw: got %q but want the whole line", got.Msg)
+			}
+		case "json":
+			var fields jsonLine
+			if err := json.Unmarshal([]byte(got.Msg), &fields); err != nil {
+				t.Fatalf("json: got %q: %v", got.Msg, err)
+			}
+			if fields.Host != "pad" || fields.Program != "fancy" || fields.Level != "info" ||
+				fields.Msg != strings.TrimSuffix(ll.Msg, "\n") || !fields.Ts.Equal(ll.Timestamp) {
+				t.Errorf("json: got %+v for %v", fields, ll)
+			}
+		}
+	}
+}
+
+func Test_cmdOutputJSON(t *testing.T) {
+	enrich := `echo '{"level":"ERR","msg":"enriched","labels":{"team":"db","job":"other"}}'`
+	for _, c := range []commander{
+		newSpawnCmd(CmdConfig{Args: []string{"sh", "-c", "read l; " + enrich}}),
+		newPipeCmd(CmdConfig{Args: []string{"sh", "-c", "while read l; do " + enrich + "; done"}}),
+	} {
+		in := &Input{cmd: c, cmdOutput: "json"}
+		ll, _ := parseLine(raw, false)
+		if !in.rewrite(ll) {
+			t.Fatalf("%T: rewrite dropped the line", c)
+		}
+		if ll.Severity != "error" || ll.Msg != "enriched" || ll.Hostname != "pad" {
+			t.Errorf("%T: got %v but want severity error and msg enriched", c, ll)
+		}
+		// fancy's own labels can't be overridden
+		if len(ll.Labels) != 1 || ll.Labels["team"] != "db" {
+			t.Errorf("%T: got labels %v but want team db", c, ll.Labels)
+		}
+		c.close()
+	}
+
+	in := &Input{cmd: newSpawnCmd(CmdConfig{Args: []string{"echo", "not json"}}), cmdOutput: "json"}
+	ll, _ := parseLine(raw, false)
+	before := testutil.ToFloat64(cmdErrors.WithLabelValues("json"))
+	if !in.rewrite(ll) || ll.Msg != string(raw[ll.MsgPos:]) {
+		t.Errorf("got msg %q but want the original", ll.Msg)
+	}
+	if got := testutil.ToFloat64(cmdErrors.WithLabelValues("json")) - before; got != 1 {
+		t.Errorf("got %v json errors but want 1", got)
+	}
+}
+
+// histogramSum returns the sample count and sum of the histogram name.
+func histogramSum(t *testing.T, name string) (uint64, float64) {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			h := mf.GetMetric()[0].GetHistogram()
+			return h.GetSampleCount(), h.GetSampleSum()
+		}
+	}
+	return 0, 0
+}
+
+func Test_cmdDuration(t *testing.T) {
+	in := &Input{cmd: newSpawnCmd(CmdConfig{Args: []string{"sh", "-c", "sleep 0.2; cat"}})}
+	ll, _ := parseLine(raw, false)
+	count, sum := histogramSum(t, "fancy_cmd_duration_seconds")
+	if !in.rewrite(ll) {
+		t.Fatal("rewrite dropped the line")
+	}
+	gotCount, gotSum := histogramSum(t, "fancy_cmd_duration_seconds")
+	if gotCount-count != 1 {
+		t.Errorf("got %d observations but want 1", gotCount-count)
+	}
+	if d := gotSum - sum; d < 0.2 || d > 2 {
+		t.Errorf("observed %vs but want about 0.2s", d)
+	}
+}
+
+func Test_cmdPipeline(t *testing.T) {
+	if got := cmdStages(" tr a-z A-Z |sed s/E/3/g| "); len(got) != 2 || len(got[0]) != 3 || got[1][0] != "sed" {
+		t.Errorf("got stages %q", got)
+	}
+	if newCmd(" | ", "spawn", CmdConfig{}) != nil {
+		t.Error("got a commander without any stage")
+	}
+
+	for _, mode := range []string{"spawn", "pipe"} {
+		// unbuffered, since pipe mode waits for every line
+		c := newCmd("sed -u s/msg/MSG/ | sed -u s/M/N/g", mode, CmdConfig{})
+		if _, ok := c.(cmdPipeline); !ok {
+			t.Fatalf("%s: got %T but want a pipeline", mode, c)
+		}
+		out, err := c.run([]byte("some msg\n"))
+		if err != nil || out != "some NSG\n" {
+			t.Errorf("%s: got %q,%v but want %q", mode, out, err, "some NSG\n")
+		}
+		c.close()
+	}
+
+	// the failing first stage stops the pipeline before the second one
+	dir, err := ioutil.TempDir("", "fancy-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "ran")
+	c := cmdPipeline{newSpawnCmd(CmdConfig{Args: exitCmd(2)}), newSpawnCmd(CmdConfig{Args: []string{"touch", marker}})}
+	if _, err := c.run([]byte("msg\n")); cmdErrorReason(err) != "exit" {
+		t.Errorf("got %v but want the exit of the first stage", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the second stage ran after the first one failed")
+	}
+}
+
+func Test_processCmdPassThrough(t *testing.T) {
+	input := &Input{
+		cmd:      newSpawnCmd(CmdConfig{Args: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}),
+		forward:  true,
+		scanChan: make(chan [][]byte, 1),
+		lineChan: make(chan *LogLine, 1),
+	}
+	before := testutil.ToFloat64(cmdErrors.WithLabelValues("timeout"))
+	input.scanChan <- [][]byte{raw}
+	close(input.scanChan)
+	input.process()
+
+	ll := <-input.lineChan
+	if want := string(raw[ll.MsgPos:]); ll.Msg != want {
+		t.Errorf("got msg %q but want the original %q", ll.Msg, want)
+	}
+	if got := testutil.ToFloat64(cmdErrors.WithLabelValues("timeout")) - before; got != 1 {
+		t.Errorf("got %v timeouts but want 1", got)
+	}
+}
+
+func Test_cmdWorkers(t *testing.T) {
+	input := &Input{
+		cmd:      newSpawnCmd(CmdConfig{Args: []string{"tr", "a-z", "A-Z"}}),
+		forward:  true,
+		scanChan: make(chan [][]byte, 10),
+		lineChan: make(chan *LogLine, 100),
+	}
+	input.startCmdWorkers(4)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		input.process()
+		wg.Done()
+	}()
+	for i := 0; i < 10; i++ {
+		input.scanChan <- [][]byte{raw}
+	}
+	close(input.scanChan)
+	scanDone := make(chan struct{})
+	close(scanDone)
+	input.shutdown(scanDone, &wg, nil)
+
+	if len(input.lineChan) != 10 {
+		t.Fatalf("got %d lines but want 10", len(input.lineChan))
+	}
+	if ll := <-input.lineChan; ll.Msg != strings.ToUpper(string(raw[ll.MsgPos:])) {
+		t.Errorf("got msg %q", ll.Msg)
+	}
+}
+
+// benchmarkSlowCmd pushes lines through a command which takes 50ms per msg.
+func benchmarkSlowCmd(b *testing.B, workers int) {
+	input := &Input{
+		cmd:      newSpawnCmd(CmdConfig{Args: []string{"sh", "-c", "sleep 0.05; cat"}}),
+		forward:  true,
+		scanChan: make(chan [][]byte, 10),
+		lineChan: make(chan *LogLine, b.N),
+	}
+	input.startCmdWorkers(workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			input.process()
+			wg.Done()
+		}()
+	}
+	for i := 0; i < b.N; i++ {
+		input.scanChan <- [][]byte{raw}
+	}
+	close(input.scanChan)
+	wg.Wait()
+	close(input.cmdChan)
+	input.cmdWorkers.Wait()
+}
+
+func Benchmark_slowCmd8Workers(b *testing.B) {
+	benchmarkSlowCmd(b, 8)
+}
+
+func Benchmark_slowCmd32Workers(b *testing.B) {
+	benchmarkSlowCmd(b, 32)
+}
+
+func benchmarkCmd(b *testing.B, c commander) {
+	defer c.close()
+	b.ReportAllocs()
+	msg := []byte("{\"key1\":\"val1\"}\n")
+	for i := 0; i < b.N; i++ {
+		if _, err := c.run(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_cmdSpawn(b *testing.B) {
+	benchmarkCmd(b, newSpawnCmd(CmdConfig{Args: []string{"cat"}}))
+}
+
+func Benchmark_cmdPipe(b *testing.B) {
+	benchmarkCmd(b, newPipeCmd(CmdConfig{Args: []string{"cat"}}))
+}
+
+func benchmarkRewrite(b *testing.B, c commander) {
+	defer c.close()
+	in := &Input{cmd: c}
+	raw := []byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy {\"key1\":\"val1\"}\n")
+	ll, err := parseLine(raw, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !in.rewrite(ll) {
+			b.Fatal("rewrite dropped the line")
+		}
+	}
+}
+
+func Benchmark_rewriteSpawn(b *testing.B) {
+	benchmarkRewrite(b, newSpawnCmd(CmdConfig{Args: []string{"cat"}}))
+}
+
+func Benchmark_rewritePipe(b *testing.B) {
+	benchmarkRewrite(b, newPipeCmd(CmdConfig{Args: []string{"cat"}}))
+}
+
+func Test_cmdMaxConcurrent(t *testing.T) {
+	limit := newProcLimit(2, false)
+	in := &Input{cmd: cmdPipeline{
+		newSpawnCmd(CmdConfig{Args: []string{"sh", "-c", "sleep 0.05; cat"}, Limit: limit}),
+		newSpawnCmd(CmdConfig{Args: []string{"cat"}, Limit: limit}),
+	}}
+
+	stop := make(chan struct{})
+	peak := make(chan float64)
+	go func() {
+		max := 0.0
+		for {
+			select {
+			case <-stop:
+				peak <- max
+				return
+			default:
+			}
+			if n := testutil.ToFloat64(cmdRunning); n > max {
+				max = n
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				ll, _ := parseLine(raw, false)
+				if !in.rewrite(ll) {
+					t.Error("rewrite dropped a line while blocking")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if max := <-peak; max > 2 || max < 1 {
+		t.Errorf("got a peak of %v running commands but want at most 2", max)
+	}
+	if n := testutil.ToFloat64(cmdRunning); n != 0 {
+		t.Errorf("got %v commands running after all of them ended", n)
+	}
+
+	// a full limit which drops fails at once
+	limit = newProcLimit(1, true)
+	slow := newSpawnCmd(CmdConfig{Args: []string{"sh", "-c", "sleep 0.2; cat"}, Limit: limit})
+	done := make(chan struct{})
+	go func() {
+		slow.run([]byte("msg"))
+		close(done)
+	}()
+	for testutil.ToFloat64(cmdRunning) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	busy := testutil.ToFloat64(cmdErrors.WithLabelValues("busy"))
+	in = &Input{cmd: newSpawnCmd(CmdConfig{Args: []string{"cat"}, Limit: limit})}
+	ll, _ := parseLine(raw, false)
+	if in.rewrite(ll) {
+		t.Error("got the line kept but want it dropped while busy")
+	}
+	if n := testutil.ToFloat64(cmdErrors.WithLabelValues("busy")) - busy; n != 1 {
+		t.Errorf("got %v busy errors but want 1", n)
+	}
+	<-done
+
+	// pipe mode holds a slot while its process lives
+	limit = newProcLimit(1, true)
+	p := newPipeCmd(CmdConfig{Args: []string{"cat"}, Limit: limit})
+	if _, err := p.run([]byte("msg\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSpawnCmd(CmdConfig{Args: []string{"cat"}, Limit: limit}).run([]byte("msg")); err != errCmdBusy {
+		t.Errorf("got %v but want errCmdBusy next to a running pipe", err)
+	}
+	p.close()
+	if len(limit.slots) != 0 {
+		t.Error("the slot of the pipe command was not released")
+	}
+}
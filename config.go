@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the values of a -config file. Keys mirror the names of the
+// command-line flags, e.g.
+//
+//	loki-url: http://lokihost:3100
+//	loki-batch-wait: 2
+//
+// The programs section overrides some settings for the logs of programs
+// matching a glob, see programSettings:
+//
+//	programs:
+//	  nginx-*:
+//	    rate-limit: 100
+//	  sshd:
+//	    min-severity: warning
+type Config struct {
+	Values   map[string]string
+	Programs map[string]map[string]string
+}
+
+// cliOnlyFlags can only be given on the command line.
+var cliOnlyFlags = map[string]bool{
+	"config":  true,
+	"version": true,
+}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(b)
+}
+
+func parseConfig(b []byte) (*Config, error) {
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	c := &Config{Values: make(map[string]string, len(raw))}
+	for k, v := range raw {
+		if k == "programs" {
+			var err error
+			if c.Programs, err = parsePrograms(v); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			return nil, fmt.Errorf("config: %q takes a single value, not a list", k)
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("config: unexpected section %q", k)
+		case nil:
+			c.Values[k] = ""
+		default:
+			c.Values[k] = fmt.Sprint(v)
+		}
+	}
+	return c, nil
+}
+
+// parsePrograms reads the programs section, a map of globs to settings.
+func parsePrograms(v interface{}) (map[string]map[string]string, error) {
+	sections, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config: programs takes a map of programs to settings")
+	}
+	programs := make(map[string]map[string]string, len(sections))
+	for glob, v := range sections {
+		settings, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config: programs: %v takes a map of settings", glob)
+		}
+		s := make(map[string]string, len(settings))
+		for k, v := range settings {
+			switch v := v.(type) {
+			case []interface{}, map[interface{}]interface{}:
+				return nil, fmt.Errorf("config: programs: %v: %v takes a single value", glob, k)
+			case nil:
+				s[fmt.Sprint(k)] = ""
+			default:
+				s[fmt.Sprint(k)] = fmt.Sprint(v)
+			}
+		}
+		programs[fmt.Sprint(glob)] = s
+	}
+	return programs, nil
+}
+
+// apply sets every flag from the config which was not given explicitly on
+// the command line, so flags always take precedence over the file.
+func (c *Config) apply(fs *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, v := range c.Values {
+		if fs.Lookup(name) == nil || cliOnlyFlags[name] {
+			return fmt.Errorf("config: unknown setting %q", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("config: invalid value %q for %s: %v", v, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func Test_configPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+	lokiURL := fs.String("loki-url", "http://localhost:3100", "")
+	batchWait := fs.Int("loki-batch-wait", 4, "")
+	promOnly := fs.Bool("prom-only", false, "")
+
+	if err := fs.Parse([]string{"-loki-url", "http://flag:3100"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseConfig([]byte("loki-url: http://file:3100\nloki-batch-wait: 2\nprom-only: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if *lokiURL != "http://flag:3100" {
+		t.Errorf("got loki-url %q but want the flag value", *lokiURL)
+	}
+	if *batchWait != 2 {
+		t.Errorf("got loki-batch-wait %d but want the file value 2", *batchWait)
+	}
+	if !*promOnly {
+		t.Errorf("got prom-only false but want the file value true")
+	}
+}
+
+func Test_configErrors(t *testing.T) {
+	cases := []string{
+		"unknown-flag: 1\n",
+		"loki-batch-wait: soon\n",
+		"loki-url: [\n",
+		"loki-url: [http://a:3100, http://b:3100]\n",
+		"config: other.yml\n",
+		"version: true\n",
+	}
+
+	for _, in := range cases {
+		fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+		fs.String("loki-url", "", "")
+		fs.Int("loki-batch-wait", 4, "")
+		fs.String("config", "", "")
+		fs.Bool("version", false, "")
+
+		c, err := parseConfig([]byte(in))
+		if err == nil {
+			err = c.apply(fs)
+		}
+		if err == nil {
+			t.Errorf("got no error for %q", in)
+		}
+	}
+}
+
+func Test_configPrograms(t *testing.T) {
+	c, err := parseConfig([]byte("loki-url: http://file:3100\nprograms:\n  \"nginx-*\":\n    rate-limit: 100\n  sshd:\n    min-severity: warning\n    redact: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Values["loki-url"] != "http://file:3100" || len(c.Values) != 1 {
+		t.Errorf("got values %v", c.Values)
+	}
+	if c.Programs["nginx-*"]["rate-limit"] != "100" || c.Programs["sshd"]["min-severity"] != "warning" || c.Programs["sshd"]["redact"] != "true" {
+		t.Errorf("got programs %v", c.Programs)
+	}
+
+	for _, in := range []string{
+		"programs: nginx\n",
+		"programs:\n  nginx: 1\n",
+		"programs:\n  nginx:\n    match: [a, b]\n",
+	} {
+		if _, err := parseConfig([]byte(in)); err == nil {
+			t.Errorf("got no error for %q", in)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dedupCollapsed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "fancy_dedup_collapsed_total",
+	Help: "Total number of repeated logs collapsed into a repeat count"})
+
+// deduper collapses identical consecutive msgs of a host and program like
+// syslog's "last message repeated N times". The first msg is forwarded
+// right away, repeats within window only count up until the window elapses
+// or a different msg arrives.
+type deduper struct {
+	window  time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+type dedupKey struct {
+	host    string
+	program string
+}
+
+type dedupEntry struct {
+	msg   string
+	start time.Time
+	last  *LogLine
+	count int
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{
+		window:  window,
+		now:     time.Now,
+		entries: map[dedupKey]*dedupEntry{},
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// add reports whether ll should be forwarded, together with the repeat
+// summary of the previous msg if ll ended a run of repeats.
+func (d *deduper) add(ll *LogLine) (summary *LogLine, forward bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := dedupKey{ll.Hostname, ll.Program}
+	e, ok := d.entries[key]
+	now := d.now()
+	if ok && e.msg == ll.Msg && now.Sub(e.start) < d.window {
+		e.count++
+		e.last = ll
+		dedupCollapsed.Inc()
+		return nil, false
+	}
+	if ok {
+		summary = e.summary()
+	}
+	d.entries[key] = &dedupEntry{msg: ll.Msg, start: now}
+	return summary, true
+}
+
+// expire removes the entries older than window and returns their summaries.
+// A zero time expires all of them.
+func (d *deduper) expire(now time.Time) []*LogLine {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var out []*LogLine
+	for key, e := range d.entries {
+		if !now.IsZero() && now.Sub(e.start) < d.window {
+			continue
+		}
+		if s := e.summary(); s != nil {
+			out = append(out, s)
+		}
+		delete(d.entries, key)
+	}
+	return out
+}
+
+// run hands summaries of expired entries to send until stop is called.
+func (d *deduper) run(send func(*LogLine)) {
+	defer close(d.done)
+	ticker := time.NewTicker(d.window / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, ll := range d.expire(now) {
+				send(ll)
+			}
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// stop ends run and returns the summaries of all remaining entries.
+func (d *deduper) stop() []*LogLine {
+	close(d.quit)
+	<-d.done
+	return d.expire(time.Time{})
+}
+
+// summary returns the repeat count line or nil if there were no repeats.
+func (e *dedupEntry) summary() *LogLine {
+	if e.count == 0 {
+		return nil
+	}
+	ll := *e.last
+	// the batch holding Raw is gone by now
+	ll.Raw = nil
+	ll.Msg = fmt.Sprintf("last message repeated %d times\n", e.count)
+	return &ll
+}
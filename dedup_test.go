@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_dedupDistinctLine(t *testing.T) {
+	d := newDeduper(5 * time.Second)
+	for i := 0; i < 3; i++ {
+		summary, forward := d.add(testLogLine("retry\n"))
+		if summary != nil || forward != (i == 0) {
+			t.Fatalf("line %d: got %v,%v", i, summary, forward)
+		}
+	}
+	// another host doesn't end the run
+	other := testLogLine("retry\n")
+	other.Hostname = "other"
+	if summary, forward := d.add(other); summary != nil || !forward {
+		t.Errorf("got %v,%v for a line of another host", summary, forward)
+	}
+
+	summary, forward := d.add(testLogLine("done\n"))
+	if !forward || summary == nil || summary.Msg != "last message repeated 2 times\n" || summary.Hostname != "pad" {
+		t.Errorf("got %v,%v but want a summary of 2 repeats", summary, forward)
+	}
+}
+
+func Test_dedupWindow(t *testing.T) {
+	now := time.Unix(1572362482, 0)
+	d := newDeduper(5 * time.Second)
+	d.now = func() time.Time { return now }
+
+	d.add(testLogLine("retry\n"))
+	d.add(testLogLine("retry\n"))
+	if got := d.expire(now.Add(time.Second)); len(got) != 0 {
+		t.Errorf("got %d summaries within the window", len(got))
+	}
+	got := d.expire(now.Add(5 * time.Second))
+	if len(got) != 1 || got[0].Msg != "last message repeated 1 times\n" {
+		t.Fatalf("got %v but want a summary of 1 repeat", got)
+	}
+
+	// the window elapsed, so the same msg is forwarded again
+	now = now.Add(6 * time.Second)
+	if summary, forward := d.add(testLogLine("retry\n")); summary != nil || !forward {
+		t.Errorf("got %v,%v after the window", summary, forward)
+	}
+}
+
+func Test_dedupStop(t *testing.T) {
+	d := newDeduper(time.Hour)
+	var sent []*LogLine
+	go d.run(func(ll *LogLine) { sent = append(sent, ll) })
+	d.add(testLogLine("retry\n"))
+	d.add(testLogLine("retry\n"))
+	d.add(testLogLine("retry\n"))
+
+	got := d.stop()
+	if len(sent) != 0 || len(got) != 1 || got[0].Msg != "last message repeated 2 times\n" {
+		t.Errorf("got %v and sent %v but want one summary of 2 repeats", got, sent)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dryRunStats counts the parse results of a -dry-run.
+type dryRunStats struct {
+	mu         sync.Mutex
+	parsed     int
+	errors     int
+	severities map[string]int
+}
+
+func newDryRunStats() *dryRunStats {
+	return &dryRunStats{severities: map[string]int{}}
+}
+
+func (s *dryRunStats) add(ll *LogLine, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.parsed++
+	s.severities[ll.Severity]++
+}
+
+// summary returns the counts with the severities ordered from most to
+// least severe.
+func (s *dryRunStats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.severities))
+	for name := range s.severities {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return severityRank(names[i]) < severityRank(names[j])
+	})
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s=%d", name, s.severities[name])
+	}
+	return fmt.Sprintf("dry-run: %d lines parsed, %d parse errors, severities: %s",
+		s.parsed, s.errors, strings.Join(counts, " "))
+}
+
+// severityRank orders unknown severities after the syslog ones.
+func severityRank(severity string) int {
+	if level, ok := severityLevels[severity]; ok {
+		return level
+	}
+	return len(severityLevels)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// countingCmd counts its runs and keeps the msgs.
+type countingCmd struct {
+	sync.Mutex
+	runs int
+}
+
+func (c *countingCmd) run(msg []byte) (string, error) {
+	c.Lock()
+	c.runs++
+	c.Unlock()
+	return string(msg), nil
+}
+
+func (c *countingCmd) close() {}
+
+func Test_dryRun(t *testing.T) {
+	// like in main there are no sinks, so forward stays false
+	cmd := &countingCmd{}
+	input := &Input{
+		cmd:      cmd,
+		stats:    newDryRunStats(),
+		lineChan: make(chan *LogLine, 10),
+		scanChan: make(chan [][]byte, 10),
+	}
+	var cache Cache
+	for _, line := range []string{
+		"2019-10-29T16:21:22.230666+01:00 6 pad fancy first msg\n",
+		"2019-10-29T16:21:22.230666+01:00 3 pad kernel oops\n",
+		"2019-10-29T16:21:22.230666+01:00 6 pad fancy second msg\n",
+		"2019-10-29T16:21:22.230666+01:00 9 pad fancy bad severity\n",
+		"2019-10-29T16:21:22.230666+01:00 6 pad\n",
+	} {
+		batchScan(input.scanChan, &cache, []byte(line))
+	}
+	cache.flush(input.scanChan)
+	close(input.scanChan)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			input.process()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if len(input.lineChan) != 0 || cmd.runs != 0 {
+		t.Errorf("got %d logs sent and %d cmd runs in dry-run", len(input.lineChan), cmd.runs)
+	}
+	want := "dry-run: 3 lines parsed, 2 parse errors, severities: error=1 info=2"
+	if got := input.stats.summary(); got != want {
+		t.Errorf("got summary %q but want %q", got, want)
+	}
+}
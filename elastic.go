@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	bulkPath        = "/_bulk"
+	contentTypeBulk = "application/x-ndjson"
+)
+
+// ESConfig holds the settings of the Elasticsearch/OpenSearch client.
+type ESConfig struct {
+	URL string
+	// Index is the index name template, {program}, {hostname} and {level}
+	// are replaced by the log fields, everything else in braces is taken
+	// as date pattern like {yyyy.MM.dd}.
+	Index     string
+	BatchSize int
+	BatchWait int
+}
+
+// ESClient sends logs with the bulk API to Elasticsearch or OpenSearch.
+type ESClient struct {
+	url       string
+	index     string
+	batchWait time.Duration
+	batchSize int
+	batch     bytes.Buffer
+}
+
+func NewESClient(cfg ESConfig) (*ESClient, error) {
+	if _, err := http.NewRequest("POST", cfg.URL, nil); err != nil {
+		return nil, err
+	}
+	return &ESClient{
+		url:       strings.TrimSuffix(cfg.URL, "/") + bulkPath,
+		index:     cfg.Index,
+		batchSize: cfg.BatchSize,
+		batchWait: time.Duration(cfg.BatchWait) * time.Second,
+	}, nil
+}
+
+// Consume batches lines until the channel is closed. A call to Flush
+// afterwards sends the last batch.
+func (e *ESClient) Consume(lines <-chan *LogLine) {
+	var (
+		maxWait = time.NewTimer(e.batchWait)
+		batch   = &e.batch
+	)
+
+	enc := json.NewEncoder(batch)
+	for {
+		select {
+		case ll, ok := <-lines:
+			if !ok {
+				return
+			}
+			mark := batch.Len()
+			err := enc.Encode(map[string]map[string]string{"index": {"_index": indexName(e.index, ll)}})
+			if err == nil {
+				err = enc.Encode(newJSONLine(ll))
+			}
+			if err != nil {
+				batch.Truncate(mark)
+				logErrorf("es encode: %v", err)
+				continue
+			}
+
+			if batch.Len() > e.batchSize {
+				if err := e.sendBatch(batch.Bytes()); err != nil {
+					logErrorf("es send size batch: %v", err)
+				}
+				batch.Reset()
+				maxWait.Reset(e.batchWait)
+			}
+
+		case <-maxWait.C:
+			if batch.Len() > 0 {
+				if err := e.sendBatch(batch.Bytes()); err != nil {
+					logErrorf("es send time batch: %v", err)
+				}
+				batch.Reset()
+			}
+			maxWait.Reset(e.batchWait)
+		}
+	}
+}
+
+// Flush sends the pending batch.
+func (e *ESClient) Flush() {
+	if e.batch.Len() > 0 {
+		if err := e.sendBatch(e.batch.Bytes()); err != nil {
+			logErrorf("es flush: %v", err)
+		}
+	}
+	e.batch.Reset()
+}
+
+func (e *ESClient) sendBatch(buf []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentTypeBulk)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+		line := ""
+		if scanner.Scan() {
+			line = scanner.Text()
+		}
+		return fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &result); err == nil && result.Errors {
+		return fmt.Errorf("bulk request had item errors: %.*s", maxErrMsgLen, body)
+	}
+	return nil
+}
+
+var dateReplacer = strings.NewReplacer(
+	"yyyy", "2006",
+	"yy", "06",
+	"MM", "01",
+	"dd", "02",
+	"HH", "15",
+)
+
+// indexName renders the index template for a log line. Index names must
+// be lowercase.
+func indexName(tmpl string, ll *LogLine) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		end := strings.IndexByte(tmpl, '}')
+		if start == -1 || end < start {
+			b.WriteString(tmpl)
+			break
+		}
+		b.WriteString(tmpl[:start])
+		switch key := tmpl[start+1 : end]; key {
+		case "program":
+			b.WriteString(ll.Program)
+		case "hostname":
+			b.WriteString(ll.Hostname)
+		case "level":
+			b.WriteString(ll.Severity)
+		default:
+			b.WriteString(ll.Timestamp.UTC().Format(dateReplacer.Replace(key)))
+		}
+		tmpl = tmpl[end+1:]
+	}
+	return strings.ToLower(b.String())
+}
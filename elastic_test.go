@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_esBulk(t *testing.T) {
+	rec := &pushRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.ServeHTTP(httptest.NewRecorder(), r)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer srv.Close()
+
+	e, err := NewESClient(ESConfig{
+		URL:       srv.URL,
+		Index:     "fancy-{program}-{yyyy.MM.dd}",
+		BatchSize: 1024 * 1024,
+		BatchWait: 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll := testLogLine("second")
+	ll.Program = "Kernel"
+	consume(e, testLogLine("first\n"), ll)
+
+	if len(rec.reqs) != 1 {
+		t.Fatalf("got %d requests but want 1", len(rec.reqs))
+	}
+	if r := rec.reqs[0]; r.URL.Path != bulkPath || r.Header.Get("Content-Type") != contentTypeBulk {
+		t.Errorf("got %s with %v", r.URL.Path, r.Header)
+	}
+	want := `{"index":{"_index":"fancy-fancy-2019.10.29"}}` + "\n" +
+		`{"host":"pad","program":"fancy","level":"info","msg":"first","ts":"` + ll.Timestamp.Format(time.RFC3339Nano) + `"}` + "\n" +
+		`{"index":{"_index":"fancy-kernel-2019.10.29"}}` + "\n" +
+		`{"host":"pad","program":"Kernel","level":"info","msg":"second","ts":"` + ll.Timestamp.Format(time.RFC3339Nano) + `"}` + "\n"
+	if got := string(rec.body[0]); got != want {
+		t.Errorf("got %s but want %s", got, want)
+	}
+}
+
+func Test_esBulkItemErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":true,"items":[]}`))
+	}))
+	defer srv.Close()
+
+	e, err := NewESClient(ESConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.sendBatch([]byte("{}\n")); err == nil {
+		t.Error("got no error for a bulk response with item errors")
+	}
+}
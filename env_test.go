@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func Test_envPrecedence(t *testing.T) {
+	env := map[string]string{
+		"FANCY_LOKI_URL":        "http://env:3100",
+		"FANCY_LOKI_CHAN_SIZE":  "500",
+		"FANCY_LOKI_BATCH_WAIT": "3",
+		"FANCY_PROM_ONLY":       "true",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+	lokiURL := fs.String("loki-url", "http://localhost:3100", "")
+	chanSize := fs.Int("loki-chan-size", 10000, "")
+	batchWait := fs.Int("loki-batch-wait", 4, "")
+	batchSize := fs.Int("loki-batch-size", 1024, "")
+	promOnly := fs.Bool("prom-only", false, "")
+	if err := fs.Parse([]string{"-loki-url", "http://flag:3100"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyEnv(fs, os.LookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseConfig([]byte("loki-batch-wait: 2\nloki-batch-size: 2048\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if *lokiURL != "http://flag:3100" {
+		t.Errorf("got loki-url %q but want the flag value", *lokiURL)
+	}
+	if *chanSize != 500 || !*promOnly {
+		t.Errorf("got loki-chan-size %d and prom-only %v but want the env values", *chanSize, *promOnly)
+	}
+	if *batchWait != 3 {
+		t.Errorf("got loki-batch-wait %d but want the env value over the file", *batchWait)
+	}
+	if *batchSize != 2048 {
+		t.Errorf("got loki-batch-size %d but want the file value", *batchSize)
+	}
+}
+
+func Test_envInvalid(t *testing.T) {
+	fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+	fs.Int("loki-chan-size", 10000, "")
+	lookup := func(name string) (string, bool) {
+		return "many", name == "FANCY_LOKI_CHAN_SIZE"
+	}
+	if err := applyEnv(fs, lookup); err == nil {
+		t.Error("got no error for an invalid env value")
+	}
+}
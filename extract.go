@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+var extractDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_extract_dropped_total",
+	Help: "Total number of extracted label values dropped because the label had extract-max-values distinct values"},
+	[]string{"label"})
+
+var errExtractGroups = errors.New("no named capture group")
+
+// extractor turns the named capture groups of a regular expression
+// matching the msg into Loki labels. Once a label had maxValues distinct
+// values new ones are dropped, so a bad expression cannot flood Loki with
+// streams.
+type extractor struct {
+	re    *regexp.Regexp
+	names []string
+	limit *valueLimit
+}
+
+// valueLimit counts the distinct values of extracted labels.
+type valueLimit struct {
+	maxValues int
+
+	mu     sync.Mutex
+	values map[string]map[string]bool
+}
+
+func newValueLimit(maxValues int) *valueLimit {
+	return &valueLimit{maxValues: maxValues, values: map[string]map[string]bool{}}
+}
+
+func newExtractor(expr string, maxValues int) (*extractor, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	e := &extractor{re: re, names: re.SubexpNames(), limit: newValueLimit(maxValues)}
+	named := false
+	for _, name := range e.names[1:] {
+		if name == "" {
+			continue
+		}
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") || reservedLabel(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		named = true
+	}
+	if !named {
+		return nil, errExtractGroups
+	}
+	return e, nil
+}
+
+// apply adds the labels extracted from the msg of ll, empty groups are
+// left out.
+func (e *extractor) apply(ll *LogLine) {
+	msg := ll.Raw[ll.MsgPos:]
+	m := e.re.FindSubmatchIndex(msg)
+	if m == nil {
+		return
+	}
+	for i, name := range e.names {
+		if i == 0 || name == "" || m[2*i] == m[2*i+1] {
+			continue
+		}
+		value := string(msg[m[2*i]:m[2*i+1]])
+		if !e.limit.allow(name, value) {
+			extractDropped.WithLabelValues(name).Inc()
+			continue
+		}
+		if ll.Labels == nil {
+			ll.Labels = map[string]string{}
+		}
+		ll.Labels[name] = value
+	}
+}
+
+// allow reports whether value fits into the maxValues of label.
+func (v *valueLimit) allow(label, value string) bool {
+	if v.maxValues == 0 {
+		return true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	seen := v.values[label]
+	if seen == nil {
+		seen = map[string]bool{}
+		v.values[label] = seen
+	}
+	if seen[value] {
+		return true
+	}
+	if len(seen) >= v.maxValues {
+		return false
+	}
+	seen[value] = true
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const accessLog = `2019-10-29T16:21:22.230666+01:00 6 web nginx 10.0.0.1 - - [29/Oct/2019:16:21:22 +0100] "%s /index.html HTTP/1.1" %d 612` + "\n"
+
+const accessRe = `"(?P<method>[A-Z]+) [^"]*" (?P<status>\d{3})(?P<empty>x?)`
+
+func Test_extract(t *testing.T) {
+	e, err := newExtractor(accessRe, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := parseLine([]byte(fmt.Sprintf(accessLog, "POST", 404)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.apply(ll)
+	if len(ll.Labels) != 2 || ll.Labels["method"] != "POST" || ll.Labels["status"] != "404" {
+		t.Errorf("got labels %v but want method POST and status 404", ll.Labels)
+	}
+
+	ll, _ = parseLine([]byte("2019-10-29T16:21:22.230666+01:00 6 web nginx no access log\n"), false)
+	e.apply(ll)
+	if ll.Labels != nil {
+		t.Errorf("got labels %v for a msg which does not match", ll.Labels)
+	}
+}
+
+func Test_extractMaxValues(t *testing.T) {
+	e, err := newExtractor(accessRe, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(extractDropped.WithLabelValues("status"))
+	var got []string
+	for _, status := range []int{200, 404, 500, 200} {
+		ll, _ := parseLine([]byte(fmt.Sprintf(accessLog, "GET", status)), false)
+		e.apply(ll)
+		got = append(got, ll.Labels["status"])
+		if ll.Labels["method"] != "GET" {
+			t.Errorf("got method %q but want GET", ll.Labels["method"])
+		}
+	}
+	if got[0] != "200" || got[1] != "404" || got[2] != "" || got[3] != "200" {
+		t.Errorf("got statuses %q but want 500 to be dropped", got)
+	}
+	if d := testutil.ToFloat64(extractDropped.WithLabelValues("status")) - before; d != 1 {
+		t.Errorf("got %v dropped values but want 1", d)
+	}
+}
+
+func Test_newExtractor(t *testing.T) {
+	for _, expr := range []string{`(\d+)`, `(?P<level>\w+)`, `(?P<__name>\w+)`, `(`} {
+		if _, err := newExtractor(expr, 0); err == nil {
+			t.Errorf("got no error for %q", expr)
+		}
+	}
+}
+
+func Test_processExtract(t *testing.T) {
+	e, _ := newExtractor(accessRe, 0)
+	input := &Input{
+		forward:  true,
+		extract:  e,
+		scanChan: make(chan [][]byte, 1),
+		lineChan: make(chan *LogLine, 1),
+	}
+	input.scanChan <- [][]byte{[]byte(fmt.Sprintf(accessLog, "GET", 200))}
+	close(input.scanChan)
+	input.process()
+
+	ll := <-input.lineChan
+	if ll.Labels["method"] != "GET" || ll.Labels["status"] != "200" {
+		t.Errorf("got labels %v but want method GET and status 200", ll.Labels)
+	}
+}
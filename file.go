@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+// FileConfig holds the settings of the file sink.
+type FileConfig struct {
+	Path string
+	// Template renders a log line, lines are written as JSON when empty.
+	Template string
+	// MaxSize rotates the file once it would grow beyond these bytes,
+	// keeping MaxBackups old files as Path.1, Path.2 and so on.
+	MaxSize    int64
+	MaxBackups int
+}
+
+// FileSink writes log lines to a local file with size based rotation.
+type FileSink struct {
+	path       string
+	tmpl       *template.Template
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	w          *bufio.Writer
+	size       int64
+	buf        bytes.Buffer
+}
+
+func NewFileSink(cfg FileConfig) (*FileSink, error) {
+	fw := &FileSink{
+		path:       cfg.Path,
+		maxSize:    cfg.MaxSize,
+		maxBackups: cfg.MaxBackups,
+	}
+	if cfg.Template != "" {
+		tmpl, err := template.New("file").Funcs(templateFuncs).Parse(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		fw.tmpl = tmpl
+	}
+	if err := fw.open(); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (fw *FileSink) open() error {
+	f, err := os.OpenFile(fw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fw.f = f
+	fw.size = fi.Size()
+	if fw.w == nil {
+		fw.w = bufio.NewWriterSize(f, 64*1024)
+	} else {
+		fw.w.Reset(f)
+	}
+	return nil
+}
+
+// Consume writes lines until the channel is closed.
+func (fw *FileSink) Consume(lines <-chan *LogLine) {
+	for ll := range lines {
+		if err := fw.write(ll); err != nil {
+			logErrorf("file write: %v", err)
+		}
+		if len(lines) == 0 {
+			fw.Flush()
+		}
+	}
+}
+
+// Flush writes buffered lines to the file.
+func (fw *FileSink) Flush() {
+	if err := fw.w.Flush(); err != nil {
+		logErrorf("file flush: %v", err)
+	}
+}
+
+func (fw *FileSink) write(ll *LogLine) error {
+	fw.buf.Reset()
+	var err error
+	if fw.tmpl != nil {
+		if err = fw.tmpl.Execute(&fw.buf, ll); err == nil {
+			fw.buf.WriteByte('\n')
+		}
+	} else {
+		err = json.NewEncoder(&fw.buf).Encode(newJSONLine(ll))
+	}
+	if err != nil {
+		return err
+	}
+
+	if fw.maxSize > 0 && fw.size > 0 && fw.size+int64(fw.buf.Len()) > fw.maxSize {
+		if err := fw.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fw.w.Write(fw.buf.Bytes())
+	fw.size += int64(n)
+	return err
+}
+
+// rotate shifts Path.N to Path.N+1, dropping the oldest one, and starts a
+// new file at Path.
+func (fw *FileSink) rotate() error {
+	if err := fw.w.Flush(); err != nil {
+		return err
+	}
+	if err := fw.f.Close(); err != nil {
+		return err
+	}
+
+	if fw.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", fw.path, fw.maxBackups))
+		for i := fw.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", fw.path, i), fmt.Sprintf("%s.%d", fw.path, i+1))
+		}
+		if err := os.Rename(fw.path, fw.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(fw.path); err != nil {
+		return err
+	}
+	return fw.open()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_fileSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fancy.log")
+	f, err := NewFileSink(FileConfig{
+		Path:       path,
+		Template:   "{{.Program}} {{.Msg}}",
+		MaxSize:    50,
+		MaxBackups: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every line has 20 bytes, so 2 lines fit into a file
+	var lines []*LogLine
+	for _, msg := range []string{"0", "1", "2", "3", "4", "5", "6", "7"} {
+		lines = append(lines, testLogLine("message number "+msg))
+	}
+	consume(f, lines...)
+
+	want := map[string]string{
+		path:        "fancy message number 6\nfancy message number 7\n",
+		path + ".1": "fancy message number 4\nfancy message number 5\n",
+		path + ".2": "fancy message number 2\nfancy message number 3\n",
+	}
+	for p, w := range want {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != w {
+			t.Errorf("got %q in %s but want %q", b, p, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got a third backup file but want at most 2")
+	}
+}
+
+func Test_fileSinkJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fancy.log")
+	f, err := NewFileSink(FileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consume(f, testLogLine("msg\n"))
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), `{"host":"pad","program":"fancy","level":"info","msg":"msg","ts":`) {
+		t.Errorf("got %s", b)
+	}
+}
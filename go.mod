@@ -8,5 +8,7 @@ require (
 	github.com/prometheus/client_golang v1.4.1
 	github.com/prometheus/common v0.9.1
 	github.com/prometheus/procfs v0.0.9 // indirect
+	github.com/segmentio/kafka-go v0.3.10
 	golang.org/x/sys v0.0.0-20200212091648-12a6c2dcc1e4 // indirect
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipMagic starts every gzip member.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipReader decompresses gzip input, also several concatenated members
+// like those of zcat. With detect it only does so when the input starts with
+// the gzip magic bytes and passes other input through. The first read makes
+// the decision, so wrapping a pipe doesn't block before the scan starts.
+type gunzipReader struct {
+	r      *bufio.Reader
+	detect bool
+	zr     io.Reader
+	err    error
+}
+
+func newGunzipReader(r io.Reader, detect bool) *gunzipReader {
+	return &gunzipReader{r: bufio.NewReader(r), detect: detect}
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	if g.zr == nil {
+		magic, _ := g.r.Peek(len(gzipMagic))
+		if g.detect && !bytes.Equal(magic, gzipMagic) {
+			g.zr = g.r
+		} else if zr, err := gzip.NewReader(g.r); err != nil {
+			g.err = fmt.Errorf("gzip input: %v", err)
+			return 0, g.err
+		} else {
+			g.zr = zr
+		}
+	}
+	n, err := g.zr.Read(p)
+	if _, ok := g.zr.(*gzip.Reader); ok && err != nil && err != io.EOF {
+		// a broken stream doesn't recover
+		g.err = fmt.Errorf("gzip input: %v", err)
+		return n, g.err
+	}
+	return n, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_scanGzip(t *testing.T) {
+	plain, err := ioutil.ReadFile("testdata/fancy.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := openInput("testdata/fancy.log.gz", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := scanLines(newGunzipReader(f, true))
+	if got := strings.Join(lines, ""); got != string(plain) {
+		t.Fatalf("got %q but want the lines of fancy.log", got)
+	}
+	for _, l := range lines {
+		if _, err := parseLine([]byte(l), false); err != nil {
+			t.Errorf("%q: %v", l, err)
+		}
+	}
+}
+
+func Test_gunzipReader(t *testing.T) {
+	// concatenated members like those of cat a.gz b.gz
+	var buf bytes.Buffer
+	for _, s := range []string{"first\n", "second\n"} {
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+	}
+	if got, err := ioutil.ReadAll(newGunzipReader(&buf, true)); err != nil || string(got) != "first\nsecond\n" {
+		t.Errorf("got %q, %v but want both members", got, err)
+	}
+
+	in := "2019-10-29T16:21:22.230666+01:00 6 pad fancy plain\n"
+	if got, err := ioutil.ReadAll(newGunzipReader(strings.NewReader(in), true)); err != nil || string(got) != in {
+		t.Errorf("got %q, %v but want plain input passed through", got, err)
+	}
+	if got, err := ioutil.ReadAll(newGunzipReader(strings.NewReader(""), true)); err != nil || len(got) != 0 {
+		t.Errorf("got %q, %v for empty input", got, err)
+	}
+	if _, err := ioutil.ReadAll(newGunzipReader(strings.NewReader(in), false)); err == nil || !strings.Contains(err.Error(), "gzip input") {
+		t.Errorf("got %v but want an error for plain input with input-gzip", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthState backs the /healthz and /readyz endpoints.
+type healthState struct {
+	// maxDropping is how long logs may be dropped without a break before
+	// fancy counts as unhealthy.
+	maxDropping time.Duration
+	now         func() time.Time
+
+	mu         sync.Mutex
+	scanning   bool
+	workers    int
+	dropStart  time.Time
+	lastDrop   time.Time
+	pushFailed bool
+}
+
+var health = newHealthState(time.Minute)
+
+func newHealthState(maxDropping time.Duration) *healthState {
+	return &healthState{maxDropping: maxDropping, now: time.Now}
+}
+
+func (h *healthState) setScanning(scanning bool) {
+	h.mu.Lock()
+	h.scanning = scanning
+	h.mu.Unlock()
+}
+
+func (h *healthState) addWorkers(n int) {
+	h.mu.Lock()
+	h.workers += n
+	h.mu.Unlock()
+}
+
+// dropped records a log dropped because the buffered channel was full.
+// Drops less than a second apart count as one streak.
+func (h *healthState) dropped() {
+	h.mu.Lock()
+	now := h.now()
+	if now.Sub(h.lastDrop) > time.Second {
+		h.dropStart = now
+	}
+	h.lastDrop = now
+	h.mu.Unlock()
+}
+
+// pushed records the result of the last Loki push.
+func (h *healthState) pushed(err error) {
+	h.mu.Lock()
+	h.pushFailed = err != nil
+	h.mu.Unlock()
+}
+
+func (h *healthState) live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.scanning {
+		return fmt.Errorf("scanner is not running")
+	}
+	if h.workers < 1 {
+		return fmt.Errorf("no process workers are running")
+	}
+	now := h.now()
+	if now.Sub(h.lastDrop) <= time.Second && now.Sub(h.dropStart) > h.maxDropping {
+		return fmt.Errorf("dropping logs since %v", h.dropStart)
+	}
+	return nil
+}
+
+func (h *healthState) ready() error {
+	if err := h.live(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pushFailed {
+		return fmt.Errorf("last Loki push failed")
+	}
+	return nil
+}
+
+func (h *healthState) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, h.live())
+}
+
+func (h *healthState) readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, h.ready())
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_healthHandlers(t *testing.T) {
+	now := time.Unix(1572362482, 0)
+	h := newHealthState(time.Minute)
+	h.now = func() time.Time { return now }
+
+	check := func(state string, wantLive, wantReady int) {
+		t.Helper()
+		for _, c := range []struct {
+			handler http.HandlerFunc
+			want    int
+		}{{h.healthz, wantLive}, {h.readyz, wantReady}} {
+			rec := httptest.NewRecorder()
+			c.handler(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != c.want {
+				t.Errorf("%s: got status %d but want %d", state, rec.Code, c.want)
+			}
+		}
+	}
+
+	check("not started", 503, 503)
+
+	h.setScanning(true)
+	h.addWorkers(8)
+	check("healthy", 200, 200)
+
+	h.pushed(fmt.Errorf("server returned HTTP status 500"))
+	check("push failed", 200, 503)
+	h.pushed(nil)
+	check("push recovered", 200, 200)
+
+	// a short overflow is fine, dropping for longer than a minute is not
+	for i := 0; i < 30; i++ {
+		h.dropped()
+		now = now.Add(500 * time.Millisecond)
+	}
+	check("dropping 15s", 200, 200)
+	for i := 0; i < 100; i++ {
+		h.dropped()
+		now = now.Add(500 * time.Millisecond)
+	}
+	check("dropping 65s", 503, 503)
+	now = now.Add(2 * time.Second)
+	check("stopped dropping", 200, 200)
+
+	h.addWorkers(-8)
+	check("no workers", 503, 503)
+}
+
+func Test_pprofMux(t *testing.T) {
+	srv := httptest.NewServer(pprofMux())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("goroutine")) {
+		t.Errorf("got %d %q for the pprof index", resp.StatusCode, body)
+	}
+
+	// the profiles stay off the metrics endpoint
+	metrics := httptest.NewServer(metricsMux())
+	defer metrics.Close()
+	resp, err = http.Get(metrics.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d for pprof on the metrics endpoint but want 404", resp.StatusCode)
+	}
+}
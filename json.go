@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var jsonParseErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "fancy_json_parse_errors_total",
+	Help: "Total number of malformed JSON logs passed through as raw"})
+
+// jsonParser maps the top-level keys of JSON logs onto LogLine fields. The
+// remaining keys are kept as message body.
+type jsonParser struct {
+	levelKey   string
+	programKey string
+	hostKey    string
+	timeKey    string
+	labelKeys  []string
+}
+
+func (p *jsonParser) parse(raw []byte, promOnly bool) (*LogLine, error) {
+	ll := &LogLine{
+		Raw:       raw,
+		Timestamp: time.Now(),
+		Severity:  "info",
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		jsonParseErrors.Inc()
+		ll.Msg = sanitizeMsg(string(raw))
+		return ll, nil
+	}
+
+	if v, ok := fields[p.levelKey]; ok {
+		ll.Severity = normalizeSeverity(jsonString(v))
+		delete(fields, p.levelKey)
+	}
+	if v, ok := fields[p.programKey]; ok {
+		ll.Program = jsonString(v)
+		delete(fields, p.programKey)
+	}
+	if v, ok := fields[p.hostKey]; ok {
+		ll.Hostname = jsonString(v)
+		delete(fields, p.hostKey)
+	}
+	if v, ok := fields[p.timeKey]; ok && !promOnly {
+		ll.Timestamp = parseTimestamp(jsonString(v))
+		delete(fields, p.timeKey)
+	}
+	for _, k := range p.labelKeys {
+		// a reserved label name stays in the msg
+		if v, ok := fields[k]; ok && !reservedLabel(labelName(k)) {
+			if ll.Labels == nil {
+				ll.Labels = map[string]string{}
+			}
+			ll.Labels[labelName(k)] = jsonString(v)
+			delete(fields, k)
+		}
+	}
+
+	if !promOnly {
+		msg, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		ll.Msg = string(msg)
+	}
+	return ll, nil
+}
+
+// jsonString returns strings as they are and everything else JSON encoded.
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// normalizeSeverity maps common level spellings onto the syslog names.
+func normalizeSeverity(s string) string {
+	s = strings.ToLower(s)
+	switch s {
+	case "emerg", "panic":
+		return "emergency"
+	case "crit", "fatal":
+		return "critical"
+	case "err":
+		return "error"
+	case "warn":
+		return "warning"
+	case "trace":
+		return "debug"
+	}
+	return s
+}
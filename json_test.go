@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_jsonParser(t *testing.T) {
+	p := &jsonParser{
+		levelKey:   "level",
+		programKey: "service",
+		hostKey:    "host",
+		timeKey:    "time",
+		labelKeys:  []string{"env", "k8s.pod", "job"},
+	}
+
+	cases := []struct {
+		input string
+		want  LogLine
+	}{
+		{
+			input: `{"level":"WARN","service":"api","host":"pad","env":"prod","msg":"slow request"}` + "\n",
+			want: LogLine{
+				Severity: "warning",
+				Program:  "api",
+				Hostname: "pad",
+				Msg:      `{"msg":"slow request"}`,
+				Labels:   map[string]string{"env": "prod"},
+			},
+		},
+		{
+			input: `{"level":"error","service":"api","k8s.pod":"api-1","req":{"path":"/","status":500},"tags":["a","b"]}`,
+			want: LogLine{
+				Severity: "error",
+				Program:  "api",
+				Msg:      `{"req":{"path":"/","status":500},"tags":["a","b"]}`,
+				Labels:   map[string]string{"k8s_pod": "api-1"},
+			},
+		},
+		{
+			input: `{"job":"cron","env":"dev"}`,
+			want: LogLine{
+				Severity: "info",
+				Msg:      `{"job":"cron"}`,
+				Labels:   map[string]string{"env": "dev"},
+			},
+		},
+		{
+			input: `{"msg":"no level"}`,
+			want: LogLine{
+				Severity: "info",
+				Msg:      `{"msg":"no level"}`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		got, err := p.parse([]byte(c.input), false)
+		if err != nil {
+			t.Errorf("%q: got error %v", c.input, err)
+			continue
+		}
+		if got.Severity != c.want.Severity || got.Hostname != c.want.Hostname ||
+			got.Program != c.want.Program || got.Msg != c.want.Msg ||
+			!reflect.DeepEqual(got.Labels, c.want.Labels) {
+			t.Errorf("%q: got %+v but want %+v", c.input, got, c.want)
+		}
+	}
+}
+
+func Test_jsonParserMalformed(t *testing.T) {
+	p := &jsonParser{levelKey: "level"}
+	before := testutil.ToFloat64(jsonParseErrors)
+
+	got, err := p.parse([]byte(`{"level":"info",`), false)
+	if err != nil || got.Msg != `{"level":"info",` {
+		t.Errorf("got %+v,%v but want the raw line passed through", got, err)
+	}
+	if n := testutil.ToFloat64(jsonParseErrors) - before; n != 1 {
+		t.Errorf("got %v parse errors but want 1", n)
+	}
+}
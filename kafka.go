@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaMessage is a single record handed to a Producer.
+type KafkaMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// Producer writes messages to a Kafka topic. It is an interface so tests
+// can replace the real client.
+type Producer interface {
+	Produce(ctx context.Context, msgs []KafkaMessage) error
+	Close() error
+}
+
+// KafkaConfig holds the settings of the Kafka sink.
+type KafkaConfig struct {
+	BatchSize int
+	BatchWait int
+}
+
+// KafkaSink produces every log line as JSON, keyed by hostname so the
+// lines of one host stay in order on the same partition.
+type KafkaSink struct {
+	producer  Producer
+	batchWait time.Duration
+	batchSize int
+	batch     []KafkaMessage
+	pending   int
+}
+
+func NewKafkaSink(p Producer, cfg KafkaConfig) *KafkaSink {
+	return &KafkaSink{
+		producer:  p,
+		batchSize: cfg.BatchSize,
+		batchWait: time.Duration(cfg.BatchWait) * time.Second,
+	}
+}
+
+// Consume batches lines until the channel is closed. A call to Flush
+// afterwards sends the last batch.
+func (k *KafkaSink) Consume(lines <-chan *LogLine) {
+	maxWait := time.NewTimer(k.batchWait)
+	for {
+		select {
+		case ll, ok := <-lines:
+			if !ok {
+				return
+			}
+			value, err := json.Marshal(newJSONLine(ll))
+			if err != nil {
+				logErrorf("kafka encode: %v", err)
+				continue
+			}
+
+			if k.pending+len(value) > k.batchSize && len(k.batch) > 0 {
+				if err := k.sendBatch(k.batch); err != nil {
+					logErrorf("kafka send size batch: %v", err)
+				}
+				k.pending = 0
+				k.batch = nil
+				maxWait.Reset(k.batchWait)
+			}
+
+			k.pending += len(value)
+			k.batch = append(k.batch, KafkaMessage{Key: []byte(ll.Hostname), Value: value})
+
+		case <-maxWait.C:
+			if len(k.batch) > 0 {
+				if err := k.sendBatch(k.batch); err != nil {
+					logErrorf("kafka send time batch: %v", err)
+				}
+				k.pending = 0
+				k.batch = nil
+			}
+			maxWait.Reset(k.batchWait)
+		}
+	}
+}
+
+// Flush sends the pending batch and closes the producer.
+func (k *KafkaSink) Flush() {
+	if len(k.batch) > 0 {
+		if err := k.sendBatch(k.batch); err != nil {
+			logErrorf("kafka flush: %v", err)
+		}
+	}
+	k.pending = 0
+	k.batch = nil
+	if err := k.producer.Close(); err != nil {
+		logErrorf("kafka close: %v", err)
+	}
+}
+
+func (k *KafkaSink) sendBatch(batch []KafkaMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return k.producer.Produce(ctx, batch)
+}
+
+// kafkaProducer is the Producer backed by kafka-go.
+type kafkaProducer struct {
+	w *kafka.Writer
+}
+
+func newKafkaProducer(brokers []string, topic string) Producer {
+	return &kafkaProducer{
+		w: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:      brokers,
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+		}),
+	}
+}
+
+func (p *kafkaProducer) Produce(ctx context.Context, msgs []KafkaMessage) error {
+	km := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		km = append(km, kafka.Message{Key: m.Key, Value: m.Value})
+	}
+	return p.w.WriteMessages(ctx, km...)
+}
+
+func (p *kafkaProducer) Close() error {
+	return p.w.Close()
+}
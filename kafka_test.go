@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type fakeProducer struct {
+	sync.Mutex
+	batches [][]KafkaMessage
+	closed  bool
+}
+
+func (f *fakeProducer) Produce(ctx context.Context, msgs []KafkaMessage) error {
+	f.Lock()
+	f.batches = append(f.batches, msgs)
+	f.Unlock()
+	return nil
+}
+
+func (f *fakeProducer) Close() error {
+	f.closed = true
+	return nil
+}
+
+func Test_kafkaSink(t *testing.T) {
+	p := &fakeProducer{}
+	// every JSON line is more than 100 bytes, so each batch holds one line
+	k := NewKafkaSink(p, KafkaConfig{BatchSize: 100, BatchWait: 60})
+
+	var lines []*LogLine
+	for _, host := range []string{"a", "b", "a"} {
+		ll := testLogLine("msg")
+		ll.Hostname = host
+		lines = append(lines, ll)
+	}
+	consume(k, lines...)
+
+	if !p.closed {
+		t.Error("producer was not closed")
+	}
+	var keys []string
+	for _, b := range p.batches {
+		if len(b) != 1 {
+			t.Errorf("got batch of %d messages but want 1", len(b))
+		}
+		for _, m := range b {
+			keys = append(keys, string(m.Key))
+		}
+	}
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "a" {
+		t.Errorf("got keys %v but want [a b a]", keys)
+	}
+}
+
+func Test_kafkaSinkBatch(t *testing.T) {
+	p := &fakeProducer{}
+	k := NewKafkaSink(p, KafkaConfig{BatchSize: 1024 * 1024, BatchWait: 60})
+	var lines []*LogLine
+	for i := 0; i < 5; i++ {
+		lines = append(lines, testLogLine("msg"))
+	}
+	consume(k, lines...)
+
+	if len(p.batches) != 1 || len(p.batches[0]) != 5 {
+		t.Errorf("got batches %v but want one batch of 5", p.batches)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var syslogReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_syslog_received_total",
+	Help: "Number of syslog messages received by syslog-listen"}, []string{"transport"})
+
+const (
+	// maxFrame bounds a syslog message received over the network.
+	maxFrame = 1024 * 1024
+	// maxCountDigits is the longest octet count, enough for maxFrame.
+	maxCountDigits = 7
+	// udpFlushWait is how long a partial batch of datagrams waits for more.
+	udpFlushWait = 10 * time.Millisecond
+)
+
+// syslogListener receives syslog over TCP and UDP on the same address.
+type syslogListener struct {
+	tcp net.Listener
+	udp net.PacketConn
+}
+
+// listenSyslog binds addr for TCP and UDP. UDP takes the port TCP got, so
+// a port of 0 works too.
+func listenSyslog(addr string) (*syslogListener, error) {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	return &syslogListener{tcp: tcp, udp: udp}, nil
+}
+
+// serveSyslog takes the place of scan. It hands the messages received by l
+// over to process until stop is called and then closes scanChan.
+func (in *Input) serveSyslog(l *syslogListener) {
+	defer close(in.scanChan)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		conns  = map[net.Conn]struct{}{}
+		closed bool
+	)
+	wg.Add(2)
+	go func() {
+		in.receiveUDP(l.udp)
+		wg.Done()
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := l.tcp.Accept()
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logWarnf("syslog accept: %v", err)
+				time.Sleep(quitWait)
+				continue
+			}
+			mu.Lock()
+			if err != nil || closed {
+				if err == nil {
+					c.Close()
+				} else if !closed {
+					logErrorf("syslog accept: %v", err)
+				}
+				mu.Unlock()
+				return
+			}
+			conns[c] = struct{}{}
+			wg.Add(1)
+			mu.Unlock()
+			go func() {
+				in.receiveTCP(c)
+				mu.Lock()
+				delete(conns, c)
+				mu.Unlock()
+				c.Close()
+				wg.Done()
+			}()
+		}
+	}()
+
+	<-in.quit
+	mu.Lock()
+	closed = true
+	l.tcp.Close()
+	l.udp.Close()
+	for c := range conns {
+		c.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+}
+
+// receiveTCP reads the messages of one connection. Like read it doesn't
+// hold back a partial batch while the connection sits idle.
+func (in *Input) receiveTCP(c net.Conn) {
+	var cache Cache
+	size := in.readBuffer
+	if size == 0 {
+		size = defaultReadBuffer
+	}
+	r := bufio.NewReaderSize(c, size)
+	var frame []byte
+	for {
+		if r.Buffered() == 0 {
+			cache.flush(in.scanChan)
+		}
+		var err error
+		frame, err = readFrame(r, frame[:0])
+		in.receive(&cache, frame, "tcp")
+		if err != nil {
+			cache.flush(in.scanChan)
+			select {
+			case <-in.quit:
+			default:
+				if err != io.EOF {
+					logWarnf("syslog connection from %s: %v", c.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// receiveUDP reads one message per datagram until c is closed.
+func (in *Input) receiveUDP(c net.PacketConn) {
+	var cache Cache
+	buf := make([]byte, 64*1024)
+	for {
+		deadline := time.Time{}
+		if len(cache.buf) > 0 {
+			deadline = time.Now().Add(udpFlushWait)
+		}
+		c.SetReadDeadline(deadline)
+		n, _, err := c.ReadFrom(buf)
+		in.receive(&cache, buf[:n], "udp")
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			cache.flush(in.scanChan)
+			continue
+		}
+		if err != nil {
+			cache.flush(in.scanChan)
+			return
+		}
+	}
+}
+
+// receive hands msg over to process like read does with a line of stdin,
+// so it ends with a single newline.
+func (in *Input) receive(cache *Cache, msg []byte, transport string) {
+	msg = bytes.TrimRight(msg, "\r\n")
+	if len(msg) == 0 {
+		return
+	}
+	if in.maxRead > 0 && len(msg) > in.maxRead {
+		msg = msg[:in.maxRead]
+		oversizedLines.Inc()
+	}
+	msg = append(msg, '\n')
+	batchScan(in.scanChan, cache, msg)
+	in.counts.scan(len(msg))
+	syslogReceived.WithLabelValues(transport).Inc()
+}
+
+// readFrame appends the next message of r to buf. A message starting with
+// up to maxCountDigits digits and a space is octet counted like "LEN MSG"
+// after RFC 6587, any other ends at a newline, also one starting with a
+// timestamp.
+func readFrame(r *bufio.Reader, buf []byte) ([]byte, error) {
+	if _, err := r.Peek(1); err != nil {
+		return buf, err
+	}
+	if n, head := octetCount(r); head > 0 {
+		r.Discard(head)
+		start := len(buf)
+		buf = append(buf, make([]byte, n)...)
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			return buf[:start], err
+		}
+		return buf, nil
+	}
+	start, skip := len(buf), false
+	for {
+		line, err := r.ReadSlice('\n')
+		if !skip {
+			if free := maxFrame - (len(buf) - start); len(line) > free {
+				// keep the head and skip the rest of the message
+				line, skip = line[:free], true
+				oversizedLines.Inc()
+			}
+			buf = append(buf, line...)
+		}
+		if err != bufio.ErrBufferFull {
+			return buf, err
+		}
+	}
+}
+
+// octetCount returns the length of an octet counted message at the start
+// of r and the size of its "LEN " head, a head of 0 when r doesn't start
+// with one. It only waits for more input while the digits go on.
+func octetCount(r *bufio.Reader) (int, int) {
+	for i := 0; i <= maxCountDigits; i++ {
+		b, err := r.Peek(i + 1)
+		if err != nil {
+			return 0, 0
+		}
+		switch c := b[i]; {
+		case c == ' ' && i > 0:
+			n, err := strconv.Atoi(string(b[:i]))
+			if err != nil || n > maxFrame {
+				return 0, 0
+			}
+			return n, i + 1
+		case c < '0' || c > '9' || i == 0 && c == '0':
+			return 0, 0
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_syslogListen(t *testing.T) {
+	l, err := listenSyslog("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := &Input{
+		forward:  true,
+		parse:    parseRFC5424,
+		lineChan: make(chan *LogLine, 10),
+		scanChan: make(chan [][]byte, 10),
+		quit:     make(chan struct{}),
+	}
+	served := make(chan struct{})
+	go func() {
+		input.serveSyslog(l)
+		close(served)
+	}()
+	go input.process()
+
+	msg := func(app, text string) string {
+		return "<165>1 2003-10-11T22:14:15.003Z host " + app + " - - - " + text
+	}
+	c, err := net.Dial("tcp", l.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// octet counted frames may hold a newline, newline framed ones end there
+	counted := msg("counted", "first\nsecond")
+	fmt.Fprintf(c, "%d %s", len(counted), counted)
+	fmt.Fprintf(c, "%s\r\n", msg("newline", "third"))
+	// digits which aren't an octet count are newline framed
+	fmt.Fprintf(c, "%s\n", msg("digits", "1234567890 x"))
+	u, err := net.Dial("udp", l.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(u, msg("udp", "fourth"))
+
+	got := map[string]string{}
+	for len(got) < 4 {
+		select {
+		case ll := <-input.lineChan:
+			got[ll.Program] = ll.Msg
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %v but want messages of 4 programs", got)
+		}
+	}
+	want := map[string]string{
+		"counted": "first\nsecond\n",
+		"newline": "third\n",
+		"digits":  "1234567890 x\n",
+		"udp":     "fourth\n",
+	}
+	for program, m := range want {
+		if got[program] != m {
+			t.Errorf("%s: got msg %q but want %q", program, got[program], m)
+		}
+	}
+
+	input.stop()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("serveSyslog didn't return after stop with an open connection")
+	}
+	c.Close()
+	u.Close()
+}
+
+func Test_syslogListenFancy(t *testing.T) {
+	l, err := listenSyslog("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 10),
+		scanChan: make(chan [][]byte, 10),
+		quit:     make(chan struct{}),
+	}
+	served := make(chan struct{})
+	go func() {
+		input.serveSyslog(l)
+		close(served)
+	}()
+	go input.process()
+
+	// the lines of the fancy format start with the digits of a timestamp
+	c, err := net.Dial("tcp", l.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(c, "2019-10-29T16:21:22.230666+01:00 6 pad fancy line %d\n", i)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case ll := <-input.lineChan:
+			if want := fmt.Sprintf("line %d\n", i); ll.Msg != want {
+				t.Errorf("got msg %q but want %q", ll.Msg, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d of 3 lines", i)
+		}
+	}
+
+	input.stop()
+	<-served
+}
+
+func Test_readFrame(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{"5 hello3 abc", []string{"hello", "abc"}},
+		{"<1>a\n<2>b", []string{"<1>a\n", "<2>b"}},
+		{"3 a b<3>c\n", []string{"a b", "<3>c\n"}},
+		{"5 abc", []string{}},
+		{"2019-10-29T16:21:22.230666+01:00 6 pad fancy a\n12b c\n", []string{"2019-10-29T16:21:22.230666+01:00 6 pad fancy a\n", "12b c\n"}},
+		{"12345678 a\n0 b\n42\n", []string{"12345678 a\n", "0 b\n", "42\n"}},
+		{"9999999 a\n", []string{"9999999 a\n"}},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.input))
+		got := []string{}
+		for {
+			frame, err := readFrame(r, nil)
+			if len(frame) > 0 {
+				got = append(got, string(frame))
+			}
+			if err != nil {
+				break
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%q: got frames %q but want %q", c.input, got, c.want)
+		}
+	}
+}
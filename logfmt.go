@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// logfmtExtractor turns the values of some keys of a logfmt msg into Loki
+// labels and leaves the msg as it is. It shares extract-max-values with
+// extractor.
+type logfmtExtractor struct {
+	// labels maps the keys to their label names
+	labels map[string]string
+	limit  *valueLimit
+}
+
+// newLogfmtExtractor takes the comma separated keys of s. Characters not
+// allowed in label names become _, like user.id becomes user_id.
+func newLogfmtExtractor(s string, maxValues int) (*logfmtExtractor, error) {
+	e := &logfmtExtractor{labels: map[string]string{}, limit: newValueLimit(maxValues)}
+	for _, key := range splitList(s) {
+		name := labelName(key)
+		if strings.HasPrefix(name, "__") || reservedLabel(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		e.labels[key] = name
+	}
+	return e, nil
+}
+
+// apply adds the labels found in the msg of ll, empty values are left out.
+func (e *logfmtExtractor) apply(ll *LogLine) {
+	parseLogfmt(ll.Raw[ll.MsgPos:], func(key, value []byte) {
+		name, ok := e.labels[string(key)]
+		if !ok || len(value) == 0 {
+			return
+		}
+		v := logfmtValue(value)
+		if v == "" {
+			return
+		}
+		if !e.limit.allow(name, v) {
+			extractDropped.WithLabelValues(name).Inc()
+			return
+		}
+		if ll.Labels == nil {
+			ll.Labels = map[string]string{}
+		}
+		ll.Labels[name] = v
+	})
+}
+
+// parseLogfmt calls fn with every key and raw value of a logfmt msg like
+// level=info msg="request done" took=3ms. A quoted value keeps its quotes,
+// logfmtValue removes them, and a key without = has a nil value.
+func parseLogfmt(msg []byte, fn func(key, value []byte)) {
+	for i := 0; i < len(msg); {
+		if msg[i] <= ' ' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(msg) && msg[i] > ' ' && msg[i] != '=' {
+			i++
+		}
+		key := msg[start:i]
+		if i == len(msg) || msg[i] != '=' {
+			fn(key, nil)
+			continue
+		}
+		i++
+		start = i
+		if i < len(msg) && msg[i] == '"' {
+			for i++; i < len(msg) && msg[i] != '"'; i++ {
+				if msg[i] == '\\' {
+					i++
+				}
+			}
+			// take the closing quote
+			i++
+			if i > len(msg) {
+				i = len(msg)
+			}
+		} else {
+			for i < len(msg) && msg[i] > ' ' {
+				i++
+			}
+		}
+		if len(key) > 0 {
+			fn(key, msg[start:i])
+		}
+	}
+}
+
+// logfmtValue unquotes a raw value of parseLogfmt.
+func logfmtValue(raw []byte) string {
+	if len(raw) > 0 && raw[0] == '"' {
+		if s, err := strconv.Unquote(string(raw)); err == nil {
+			return s
+		}
+		// keep what an unterminated or broken quote holds
+		return strings.TrimSuffix(string(raw[1:]), `"`)
+	}
+	return string(raw)
+}
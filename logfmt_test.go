@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const logfmtLine = `level=info msg="request done" user.id=42 path="/a b\"c" took=3ms empty="" debug`
+
+func Test_parseLogfmt(t *testing.T) {
+	var got []string
+	parseLogfmt([]byte(logfmtLine+"\n"), func(key, value []byte) {
+		got = append(got, fmt.Sprintf("%s=%q", key, logfmtValue(value)))
+	})
+	want := []string{`level="info"`, `msg="request done"`, `user.id="42"`, `path="/a b\"c"`, `took="3ms"`, `empty=""`, `debug=""`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got pairs %v but want %v", got, want)
+	}
+
+	// broken quotes keep what they hold, pairs without key are skipped
+	broken := map[string]string{
+		`a="open`: `[a=open]`,
+		`a="x\`:   `[a=x\]`,
+		`=b c=`:   `[c=]`,
+		`"q"=1`:   `["q"=1]`,
+	}
+	for msg, want := range broken {
+		got = got[:0]
+		parseLogfmt([]byte(msg), func(key, value []byte) {
+			got = append(got, fmt.Sprintf("%s=%s", key, logfmtValue(value)))
+		})
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: got pairs %v but want %s", msg, got, want)
+		}
+	}
+}
+
+func Test_logfmtExtract(t *testing.T) {
+	e, err := newLogfmtExtractor("msg,user.id,empty,missing", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := parseLine([]byte("2019-10-29T16:21:22.230666+01:00 6 web api "+logfmtLine+"\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.apply(ll)
+	if len(ll.Labels) != 2 || ll.Labels["msg"] != "request done" || ll.Labels["user_id"] != "42" {
+		t.Errorf("got labels %v but want msg and user_id", ll.Labels)
+	}
+	if ll.Msg != logfmtLine+"\n" {
+		t.Errorf("got msg %q but want it untouched", ll.Msg)
+	}
+
+	if _, err := newLogfmtExtractor("level", 0); err == nil {
+		t.Error("got no error for the reserved label level")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger writes fancy's own diagnostic messages, as text or as JSON
+// objects with level, ts and msg. Messages below level are dropped.
+type logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	json  bool
+	level int
+}
+
+// logLevels maps the log-level names to their order.
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+var logs = &logger{out: os.Stderr, level: logLevels["info"]}
+
+type logEntry struct {
+	Level string `json:"level"`
+	TS    string `json:"ts"`
+	Msg   string `json:"msg"`
+}
+
+// printf writes a message with level to w.
+func (l *logger) printf(w io.Writer, level, format string, args ...interface{}) {
+	if logLevels[level] < l.level {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	var line []byte
+	if l.json {
+		line, _ = json.Marshal(logEntry{Level: level, TS: now.Format(time.RFC3339Nano), Msg: msg})
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%v %s: %s\n", now, strings.ToUpper(level), msg))
+	}
+
+	l.mu.Lock()
+	w.Write(line)
+	l.mu.Unlock()
+}
+
+func logDebugf(format string, args ...interface{}) {
+	logs.printf(logs.out, "debug", format, args...)
+}
+
+func logInfof(format string, args ...interface{}) {
+	logs.printf(logs.out, "info", format, args...)
+}
+
+func logWarnf(format string, args ...interface{}) {
+	logs.printf(logs.out, "warn", format, args...)
+}
+
+func logErrorf(format string, args ...interface{}) {
+	logs.printf(logs.out, "error", format, args...)
+}
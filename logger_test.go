@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_loggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &logger{out: &buf, json: true}
+	l.printf(&buf, "error", "send size batch: %v", "server returned HTTP status 500")
+	l.printf(&buf, "info", "received %v, shutting down", "terminated")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines but want 2: %q", len(lines), buf.String())
+	}
+	want := []logEntry{
+		{Level: "error", Msg: "send size batch: server returned HTTP status 500"},
+		{Level: "info", Msg: "received terminated, shutting down"},
+	}
+	for i, line := range lines {
+		var got logEntry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d is no JSON object: %v: %s", i, err, line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, got.TS); err != nil {
+			t.Errorf("line %d: invalid ts: %v", i, err)
+		}
+		got.TS = ""
+		if got != want[i] {
+			t.Errorf("line %d: got %+v but want %+v", i, got, want[i])
+		}
+	}
+}
+
+func Test_loggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := &logger{out: &buf}
+	l.printf(&buf, "error", "loki flush: %v", "timeout")
+
+	got := buf.String()
+	if !strings.HasSuffix(got, " ERROR: loki flush: timeout\n") {
+		t.Errorf("got %q but want the text format", got)
+	}
+}
+
+func Test_loggerLevel(t *testing.T) {
+	for _, c := range []struct {
+		level string
+		want  []string
+	}{
+		{"debug", []string{"debug", "info", "warn", "error"}},
+		{"info", []string{"info", "warn", "error"}},
+		{"warn", []string{"warn", "error"}},
+		{"error", []string{"error"}},
+	} {
+		var buf bytes.Buffer
+		l := &logger{out: &buf, json: true, level: logLevels[c.level]}
+		for _, level := range []string{"debug", "info", "warn", "error"} {
+			l.printf(&buf, level, "%s msg", level)
+		}
+
+		var got []string
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var e logEntry
+			if err := dec.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, e.Level)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("log-level %s: got %v but want %v", c.level, got, c.want)
+		}
+	}
+}
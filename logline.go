@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"strconv"
 	"time"
+	"unicode/utf8"
 )
 
 type LogLine struct {
@@ -13,7 +15,17 @@ type LogLine struct {
 	Program   string
 	MsgPos    int
 	Msg       string
-	Raw       []byte
+	// Raw belongs to the scanned batch and is only valid while process
+	// handles it, the sinks get nil.
+	Raw []byte
+	// Labels holds additional Loki labels, e.g. RFC5424 structured data.
+	Labels map[string]string
+	// Head is the part of the raw line in front of the msg, only kept for
+	// the passthrough output.
+	Head string
+	// Ingested is when a worker took the line from the scan, zero for
+	// lines fancy made up itself like dedup summaries.
+	Ingested time.Time
 }
 
 func (l *LogLine) String() string {
@@ -23,9 +35,31 @@ func (l *LogLine) String() string {
 	return setSeverity(l.Severity) + " " + l.Hostname + " " + l.Program + " " + l.Msg
 }
 
-func (l *LogLine) Valid() bool {
-	prefix := []byte(setSeverity(l.Severity) + " " + l.Hostname + " " + l.Program + " ")
-	return bytes.HasPrefix(l.Raw[33:], prefix)
+// Valid reports whether the parsed fields match the fancy template with
+// sep between them.
+func (l *LogLine) Valid(sep []byte) bool {
+	s := string(sep)
+	prefix := []byte(setSeverity(l.Severity) + s + l.Hostname + s + l.Program + s)
+	return bytes.HasPrefix(l.Raw[32+len(sep):], prefix)
+}
+
+// truncate cuts the msg of l down to max bytes plus a marker and returns
+// the number of bytes cut off. Raw is cut as well, so cmd and extract don't
+// see the rest either.
+func (l *LogLine) truncate(max int) int {
+	if len(l.Raw) > l.MsgPos+max {
+		l.Raw = l.Raw[:l.MsgPos+max]
+	}
+	if len(l.Msg) <= max {
+		return 0
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(l.Msg[n]) {
+		n--
+	}
+	cut := len(l.Msg) - n
+	l.Msg = l.Msg[:n] + "…(truncated " + strconv.Itoa(cut) + " bytes)"
+	return cut
 }
 
 func setSeverity(in string) (out string) {
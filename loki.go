@@ -3,165 +3,722 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/golang/snappy"
 	"github.com/negbie/fancy/logproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 )
 
 const (
-	contentType  = "application/x-protobuf"
-	postPath     = "/api/prom/push"
-	postPathOne  = "/loki/api/v1/push"
-	jobName      = model.LabelValue("fancy")
-	maxErrMsgLen = 1024
+	contentType     = "application/x-protobuf"
+	contentTypeJSON = "application/json"
+	postPath        = "/api/prom/push"
+	postPathOne     = "/loki/api/v1/push"
+	readyPath       = "/ready"
+	jobName         = model.LabelValue("fancy")
+	maxErrMsgLen    = 1024
 )
 
+var (
+	lokiRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_loki_retries_total",
+		Help: "Total number of retried Loki pushes"})
+	lokiFailedBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_loki_failed_batches_total",
+		Help: "Total number of batches dropped after all Loki push attempts failed"})
+	lokiTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_loki_timeouts_total",
+		Help: "Total number of Loki pushes which took longer than loki-timeout"})
+	lokiPushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fancy_loki_push_duration_seconds",
+		Help:    "Duration of a single Loki push by HTTP status class",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12)},
+		[]string{"status"})
+	lokiStaleLines = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_loki_stale_lines_total",
+		Help: "Total number of lines dropped because they were older than loki-max-line-age when their batch was sent"})
+	pipelineLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fancy_pipeline_latency_seconds",
+		Help:    "Time from the scan of a line until its batch was pushed to Loki",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16)})
+	lokiBatchBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fancy_loki_batch_bytes",
+		Help:    "Size of the encoded batches sent to Loki",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8)})
+	lokiSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_loki_sent_bytes_total",
+		Help: "Total bytes of the push requests sent to Loki, retries included, compressed as sent and uncompressed"},
+		[]string{"encoding"})
+)
+
+var errLokiAuth = fmt.Errorf("Loki bearer token and basic auth are mutually exclusive")
+
 type entry struct {
 	labels model.LabelSet
 	*logproto.Entry
 }
 
+type stream struct {
+	labels model.LabelSet
+	*logproto.Stream
+}
+
+// LokiConfig holds the settings of the Loki client.
+type LokiConfig struct {
+	URL       string
+	BatchSize int
+	BatchWait int
+	// BatchJitter moves every BatchWait by a random part of up to this
+	// fraction of it either way, so instances started together don't push
+	// at the same time.
+	BatchJitter float64
+	// BatchCount sends a batch once it holds this many lines, 0 means no
+	// limit.
+	BatchCount int
+	// AdaptiveWait sends a batch before BatchWait once no line arrived for
+	// a few of the average gaps between the lines, so a burst doesn't wait
+	// for the next one while slow traffic is still batched.
+	AdaptiveWait bool
+	// Compress sends gzip compressed JSON instead of snappy compressed
+	// protobuf, Loki only honours Content-Encoding for JSON payloads.
+	Compress bool
+	// Tenant is sent as X-Scope-OrgID for multi-tenant Loki setups.
+	Tenant string
+	// Username and Password enable basic auth, BearerToken enables token
+	// auth. Only one of both can be used.
+	Username    string
+	Password    string
+	BearerToken string
+	// MaxRetries is the number of extra attempts for pushes failing with a
+	// network error, 429 or 5xx. Backoff starts at MinBackoff and doubles up
+	// to MaxBackoff.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BufferLines holds up to this many lines of batches which failed
+	// with a retryable error and sends them again once Loki is back. The
+	// oldest batches are evicted first, 0 disables the buffer.
+	BufferLines int
+	// SpoolDir holds the batches on disk instead, so they survive a
+	// restart, up to SpoolMaxBytes.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	// MaxLineAge drops lines which are older than this when they arrive or
+	// when their batch is sent instead of pushing them, 0 keeps all of them.
+	MaxLineAge time.Duration
+	// Timeout cancels a single push taking longer, it defaults to 5s.
+	Timeout time.Duration
+	// Labels are added to every stream.
+	Labels map[string]string
+	// TLS configures the connection to an https URL.
+	TLS TLSConfig
+	// Pool tunes the reuse of the connections to Loki.
+	Pool PoolConfig
+	// StreamLabels are the fields of a log which become stream labels, any
+	// of hostname, program, level and static_tag. The other fields are put
+	// in front of the line as key=value. Nil means all of them.
+	StreamLabels []string
+}
+
+var streamLabelNames = scanLabelNames
+
 type Loki struct {
 	entry
 	lokiURL   string
 	batchWait time.Duration
+	jitter    float64
+	rnd       *rand.Rand
 	batchSize int
-	lineChan  chan *LogLine
+	batchMax  int
+	compress  bool
+	tenant    string
+	username  string
+	password  string
+	token     string
+	retries   int
+	minWait   time.Duration
+	maxWait   time.Duration
+	timeout   time.Duration
+	maxAge    time.Duration
+	client    *http.Client
+	labels    atomic.Value // model.LabelSet of the static labels
+	inLabels  map[string]bool
+	batch     map[model.Fingerprint]*stream
+	sent      map[model.Fingerprint]sentStream
+	buffer    batchQueue
+	pending   int
+	count     int
+	adaptive  bool
+	gap       time.Duration // average gap between lines
+	last      time.Time     // arrival of the last line
+	started   time.Time     // arrival of the first line of the batch
+	wait      time.Duration // batchWait of the batch with its jitter
+	deadline  time.Time     // when the timer of the batch fires
+	ingested  []time.Time   // ingest times of the batch in arrival order
 }
 
-func NewLoki(lineChan chan *LogLine, URL string, batchSize, batchWait int) (*Loki, error) {
+func NewLoki(cfg LokiConfig) (*Loki, error) {
 	l := &Loki{
-		lokiURL:   URL,
-		batchSize: batchSize,
-		batchWait: time.Duration(batchWait) * time.Second,
-		lineChan:  lineChan,
+		lokiURL:   cfg.URL,
+		batchSize: cfg.BatchSize,
+		batchWait: time.Duration(cfg.BatchWait) * time.Second,
+		jitter:    cfg.BatchJitter,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		batchMax:  cfg.BatchCount,
+		adaptive:  cfg.AdaptiveWait,
+		compress:  cfg.Compress,
+		tenant:    cfg.Tenant,
+		username:  cfg.Username,
+		password:  cfg.Password,
+		token:     cfg.BearerToken,
+		retries:   cfg.MaxRetries,
+		minWait:   cfg.MinBackoff,
+		maxWait:   cfg.MaxBackoff,
+		timeout:   cfg.Timeout,
+		maxAge:    cfg.MaxLineAge,
+		inLabels:  map[string]bool{},
+		batch:     map[model.Fingerprint]*stream{},
+		sent:      map[model.Fingerprint]sentStream{},
 	}
+	l.gap = l.batchWait
+	if cfg.StreamLabels == nil {
+		cfg.StreamLabels = streamLabelNames
+	}
+	for _, name := range cfg.StreamLabels {
+		l.inLabels[name] = true
+	}
+	l.setLabels(cfg.Labels)
 
-	u, err := url.Parse(l.lokiURL)
+	if l.minWait <= 0 {
+		l.minWait = 500 * time.Millisecond
+	}
+	if l.maxWait <= 0 {
+		l.maxWait = 30 * time.Second
+	}
+	switch {
+	case cfg.SpoolDir != "":
+		ext := ".pb"
+		if l.compress {
+			ext = ".json.gz"
+		}
+		spool, err := newDiskSpool(cfg.SpoolDir, ext, cfg.SpoolMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		l.buffer = spool
+	case cfg.BufferLines > 0:
+		l.buffer = newLokiBuffer(cfg.BufferLines)
+	}
+	if l.timeout <= 0 {
+		l.timeout = 5 * time.Second
+	}
+
+	if l.token != "" && (l.username != "" || l.password != "") {
+		return nil, errLokiAuth
+	}
+
+	client, err := newHTTPClient(cfg.TLS)
 	if err != nil {
 		return nil, err
 	}
-	if !strings.Contains(u.Path, postPath) {
-		u.Path = postPath
-		q := u.Query()
-		u.RawQuery = q.Encode()
-		l.lokiURL = u.String()
+	client = poolClient(client, cfg.Pool)
+	// a sidecar Loki or push proxy may listen on a unix socket
+	if socket, u, ok := unixSocketURL(l.lokiURL); ok {
+		client, l.lokiURL = unixClient(client, socket), u
+	}
+	l.client = client
+
+	if l.lokiURL, err = pushURL(l.lokiURL); err != nil {
+		return nil, err
 	}
-	l.lokiURL = strings.Replace(l.lokiURL, postPath, postPathOne, -1)
 	return l, nil
 }
 
-func (l *Loki) Run() {
-	var (
-		curPktTime  time.Time
-		lastPktTime time.Time
-		maxWait     = time.NewTimer(l.batchWait)
-		batch       = map[model.Fingerprint]*logproto.Stream{}
-		batchSize   = 0
-	)
+// pushURL returns the URL to push to. A URL whose path ends in /push is
+// used as it is, apart from the legacy push path which is replaced, the
+// push path is appended to any other.
+func pushURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(u.Path, postPath):
+		u.Path = strings.TrimSuffix(u.Path, postPath) + postPathOne
+	case !strings.HasSuffix(u.Path, "/push"):
+		u.Path = strings.TrimSuffix(u.Path, "/") + postPathOne
+	}
+	return u.String(), nil
+}
 
-	defer func() {
-		if len(batch) > 0 {
-			if err := l.sendBatch(batch); err != nil {
-				fmt.Fprintf(os.Stderr, "%v ERROR: loki flush: %v\n", time.Now(), err)
-			}
-		}
-	}()
+// Consume batches lines until the channel is closed. A call to Flush
+// afterwards sends the last batch.
+func (l *Loki) Consume(lines <-chan *LogLine) {
+	maxWait := time.NewTimer(l.flushWait())
 
 	for {
 		select {
-		case ll, ok := <-l.lineChan:
+		case ll, ok := <-lines:
 			if !ok {
 				return
 			}
-			curPktTime = ll.Timestamp
-			// guard against entry out of order errors
-			if lastPktTime.After(curPktTime) {
-				curPktTime = time.Now()
+			if l.maxAge > 0 && time.Since(ll.Timestamp) > l.maxAge {
+				lokiStaleLines.Inc()
+				continue
 			}
-			lastPktTime = curPktTime
-
-			tsNano := curPktTime.UnixNano()
-			ts := &timestamp.Timestamp{
-				Seconds: tsNano / int64(time.Second),
-				Nanos:   int32(tsNano % int64(time.Second)),
-			}
-
-			l.entry = entry{model.LabelSet{}, &logproto.Entry{Timestamp: ts}}
+			l.entry = entry{l.labels.Load().(model.LabelSet).Clone(), &logproto.Entry{}}
 			l.entry.labels["job"] = jobName
-			l.entry.labels["level"] = model.LabelValue(ll.Severity)
-			l.entry.labels["hostname"] = model.LabelValue(ll.Hostname)
-			l.entry.labels["program"] = model.LabelValue(ll.Program)
-			if len(ll.StaticTag) > 0 && ll.StaticTag != " " {
-				l.entry.labels["static_tag"] = model.LabelValue(ll.StaticTag)
+			var prefix strings.Builder
+			for _, name := range streamLabelNames {
+				v, _ := scanLabelValue(name, ll)
+				if v == "" || v == " " {
+					continue
+				}
+				if l.inLabels[name] {
+					l.entry.labels[model.LabelName(name)] = model.LabelValue(v)
+				} else {
+					fmt.Fprintf(&prefix, "%s=%s ", name, v)
+				}
 			}
-			l.entry.Entry.Line = ll.Msg
-
-			if batchSize+len(l.entry.Line) > l.batchSize {
-				if err := l.sendBatch(batch); err != nil {
-					fmt.Fprintf(os.Stderr, "%v ERROR: send size batch: %v\n", lastPktTime, err)
+			for k, v := range ll.Labels {
+				// a parsed label doesn't override the ones fancy sets
+				if reservedLabel(k) {
+					continue
 				}
-				batchSize = 0
-				batch = map[model.Fingerprint]*logproto.Stream{}
-				maxWait.Reset(l.batchWait)
+				l.entry.labels[model.LabelName(k)] = model.LabelValue(v)
 			}
+			l.entry.Entry.Line = prefix.String() + ll.Msg
 
-			batchSize += len(l.entry.Line)
+			if l.pending+len(l.entry.Line) > l.batchSize {
+				l.sendPending("size")
+				maxWait.Reset(l.flushWait())
+			}
+
+			l.pending += len(l.entry.Line)
 			fp := l.entry.labels.FastFingerprint()
-			stream, ok := batch[fp]
+			// sendPending sorts a batch, but Loki rejects an entry
+			// older than one it already got for the stream
+			tsNano := ll.Timestamp.UnixNano()
+			if sent := l.sent[fp].nanos; tsNano < sent {
+				tsNano = sent
+			}
+			l.Entry.Timestamp = &timestamp.Timestamp{
+				Seconds: tsNano / int64(time.Second),
+				Nanos:   int32(tsNano % int64(time.Second)),
+			}
+			s, ok := l.batch[fp]
 			if !ok {
-				stream = &logproto.Stream{
-					Labels: l.entry.labels.String(),
+				s = &stream{
+					labels: l.entry.labels,
+					Stream: &logproto.Stream{
+						Labels: l.entry.labels.String(),
+					},
 				}
-				batch[fp] = stream
+				l.batch[fp] = s
+			}
+			s.Entries = append(s.Entries, l.Entry)
+			l.count++
+			if !ll.Ingested.IsZero() {
+				l.ingested = append(l.ingested, ll.Ingested)
+			}
+			if l.adaptive {
+				l.arrive(maxWait, time.Now())
+			}
+
+			if l.batchMax > 0 && l.count >= l.batchMax {
+				l.sendPending("count")
+				maxWait.Reset(l.flushWait())
 			}
-			stream.Entries = append(stream.Entries, l.Entry)
 
 		case <-maxWait.C:
-			if len(batch) > 0 {
-				if err := l.sendBatch(batch); err != nil {
-					fmt.Fprintf(os.Stderr, "%v ERROR: send time batch: %v\n", lastPktTime, err)
+			if l.adaptive && len(l.batch) > 0 {
+				// the lines kept coming since the timer was set
+				if wait := l.idleWait(); time.Until(wait) > 0 {
+					l.deadline = wait
+					maxWait.Reset(time.Until(wait))
+					continue
 				}
-				batchSize = 0
-				batch = map[model.Fingerprint]*logproto.Stream{}
 			}
-			maxWait.Reset(l.batchWait)
+			if len(l.batch) > 0 {
+				l.sendPending("time")
+			} else if l.buffer != nil {
+				l.replay()
+			}
+			maxWait.Reset(l.flushWait())
 		}
 	}
 }
 
-func (l *Loki) sendBatch(batch map[model.Fingerprint]*logproto.Stream) error {
-	buf, err := encodeBatch(batch)
+// flushWait returns the time until the next batch is sent, batchWait with
+// its jitter. Only Consume may call it.
+func (l *Loki) flushWait() time.Duration {
+	if l.jitter <= 0 {
+		return l.batchWait
+	}
+	d := (2*l.rnd.Float64() - 1) * l.jitter * float64(l.batchWait)
+	return l.batchWait + time.Duration(d)
+}
+
+const (
+	// idleGaps is the number of average gaps between lines the adaptive
+	// flush waits for the next line.
+	idleGaps = 4
+	// minIdle keeps the adaptive flush from sending every line of a fast
+	// stream on its own.
+	minIdle = 10 * time.Millisecond
+)
+
+// arrive updates the average gap between lines with a line arriving at now
+// and moves the timer of the batch forward when the lines come faster.
+func (l *Loki) arrive(t *time.Timer, now time.Time) {
+	gap := now.Sub(l.last)
+	if gap > l.batchWait {
+		gap = l.batchWait
+	}
+	l.gap = (4*l.gap + gap) / 5
+	l.last = now
+	if l.count == 1 {
+		l.started = now
+		l.wait = l.flushWait()
+		l.deadline = now.Add(l.wait)
+	}
+	if wait := l.idleWait(); wait.Before(l.deadline) {
+		l.deadline = wait
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(wait.Sub(now))
+	}
+}
+
+// idleWait returns when to send the batch if no other line arrives: a few
+// average gaps after the last line but no later than batchWait with its
+// jitter after the first.
+func (l *Loki) idleWait() time.Time {
+	idle := idleGaps * l.gap
+	if idle < minIdle {
+		idle = minIdle
+	}
+	wait := l.last.Add(idle)
+	if max := l.started.Add(l.wait); max.Before(wait) {
+		return max
+	}
+	return wait
+}
+
+// setLabels replaces the static labels added to every stream, lines
+// consumed from then on get the new ones.
+func (l *Loki) setLabels(labels map[string]string) {
+	set := make(model.LabelSet, len(labels))
+	for k, v := range labels {
+		set[model.LabelName(k)] = model.LabelValue(v)
+	}
+	l.labels.Store(set)
+}
+
+// Flush sends the pending batch and, if Loki is back, the buffered ones.
+func (l *Loki) Flush() {
+	if len(l.batch) > 0 {
+		l.sendPending("flush")
+	} else if l.buffer != nil {
+		l.replay()
+	}
+}
+
+// sendPending sends the pending batch and starts a new one, trigger names
+// the size, count or time threshold which was hit.
+func (l *Loki) sendPending(trigger string) {
+	if l.maxAge > 0 {
+		l.dropStale(time.Now().Add(-l.maxAge).UnixNano())
+	}
+	l.sortBatch(time.Now())
+	if len(l.batch) > 0 {
+		if err := l.sendBatch(l.batch); err != nil {
+			logErrorf("send %s batch: %v", trigger, err)
+		}
+	}
+	l.pending = 0
+	l.count = 0
+	l.ingested = l.ingested[:0]
+	l.batch = map[model.Fingerprint]*stream{}
+}
+
+// observeLatency records the time since the ingest of the lines of the
+// pushed batch. Stale lines dropped from it waited the longest, so the
+// oldest ingest times go with them.
+func (l *Loki) observeLatency(batch map[model.Fingerprint]*stream, now time.Time) {
+	ingested := l.ingested
+	if n := batchLines(batch); n < len(ingested) {
+		ingested = ingested[len(ingested)-n:]
+	}
+	for _, t := range ingested {
+		pipelineLatency.Observe(now.Sub(t).Seconds())
+	}
+}
+
+// dropStale removes the entries older than min from the batch, Loki would
+// reject them anyway once they are older than its max age.
+func (l *Loki) dropStale(min int64) {
+	for fp, s := range l.batch {
+		kept := s.Entries[:0]
+		for _, e := range s.Entries {
+			if entryNanos(e) >= min {
+				kept = append(kept, e)
+			}
+		}
+		if n := len(s.Entries) - len(kept); n > 0 {
+			lokiStaleLines.Add(float64(n))
+		}
+		if s.Entries = kept; len(kept) == 0 {
+			delete(l.batch, fp)
+		}
+	}
+}
+
+// sortBatch orders the entries of every stream by time, since the workers
+// hand over the lines of a stream in any order, and remembers the newest.
+// Streams which got no line for sentWindow are forgotten.
+func (l *Loki) sortBatch(now time.Time) {
+	for fp, s := range l.batch {
+		sort.SliceStable(s.Entries, func(i, j int) bool {
+			return entryNanos(s.Entries[i]) < entryNanos(s.Entries[j])
+		})
+		if n := len(s.Entries); n > 0 {
+			l.sent[fp] = sentStream{nanos: entryNanos(s.Entries[n-1]), at: now}
+		}
+	}
+	window := sentWindow
+	if l.maxAge > 0 && l.maxAge < window {
+		window = l.maxAge
+	}
+	for fp, s := range l.sent {
+		if now.Sub(s.at) > window {
+			delete(l.sent, fp)
+		}
+	}
+}
+
+// sentWindow is how long the newest timestamp of a stream is kept without
+// new lines, like the out of order window of Loki. loki-max-line-age
+// shortens it, since older lines are dropped anyway.
+const sentWindow = time.Hour
+
+// sentStream is the newest timestamp sent for a stream in ns and when.
+type sentStream struct {
+	nanos int64
+	at    time.Time
+}
+
+func entryNanos(e *logproto.Entry) int64 {
+	return e.Timestamp.Seconds*int64(time.Second) + int64(e.Timestamp.Nanos)
+}
+
+func (l *Loki) sendBatch(batch map[model.Fingerprint]*stream) error {
+	var (
+		buf []byte
+		err error
+	)
+	if l.compress {
+		buf, err = encodeJSONBatch(batch)
+	} else {
+		buf, err = encodeBatch(batch)
+	}
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	lokiBatchBytes.Observe(float64(len(buf)))
+
+	if l.buffer != nil {
+		if err := l.replay(); err != nil {
+			// keep the order of the batches while Loki is down
+			l.buffer.add(buf, batchLines(batch))
+			logWarnf("%v, holding the batch back", err)
+			return nil
+		}
+	}
+	status, err := l.push(buf)
+	if err == nil {
+		logDebugf("pushed %d streams in %d bytes to Loki", len(batch), len(buf))
+		l.observeLatency(batch, time.Now())
+		return nil
+	}
+	if l.buffer != nil && retryable(status) {
+		l.buffer.add(buf, batchLines(batch))
+		return err
+	}
+	lokiFailedBatches.Inc()
+	return err
+}
+
+// push sends buf and retries it on failure. It returns the status of the
+// last attempt.
+func (l *Loki) push(buf []byte) (int, error) {
+	for attempt := 0; ; attempt++ {
+		status, retryAfter, err := l.sendOnce(buf)
+		if err == nil {
+			health.pushed(nil)
+			return status, nil
+		}
+		if attempt >= l.retries || !retryable(status) {
+			health.pushed(err)
+			return status, err
+		}
+
+		wait := l.backoff(attempt)
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		lokiRetries.Inc()
+		logWarnf("%v, retry in %v", err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// replay sends the buffered batches oldest first. It stops at the first
+// one which fails with a retryable error, others are dropped.
+func (l *Loki) replay() error {
+	for {
+		buf, ok := l.buffer.first()
+		if !ok {
+			return nil
+		}
+		status, _, err := l.sendOnce(buf)
+		if err != nil && retryable(status) {
+			health.pushed(err)
+			return err
+		}
+		if err != nil {
+			lokiFailedBatches.Inc()
+			logErrorf("drop buffered batch: %v", err)
+		} else {
+			health.pushed(nil)
+		}
+		l.buffer.remove()
+	}
+}
+
+func (l *Loki) sendOnce(buf []byte) (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
 	defer cancel()
+	start := time.Now()
+	lokiSentBytes.WithLabelValues("compressed").Add(float64(len(buf)))
+	lokiSentBytes.WithLabelValues("uncompressed").Add(float64(decodedLen(buf, l.compress)))
+	status, retryAfter, err := l.send(ctx, buf)
+	if ctx.Err() == context.DeadlineExceeded {
+		lokiTimeouts.Inc()
+	}
+	lokiPushDuration.WithLabelValues(statusClass(status)).Observe(time.Since(start).Seconds())
+	return status, retryAfter, err
+}
 
-	_, err = l.send(ctx, buf)
+// authorize sets the tenant and credentials of req.
+func (l *Loki) authorize(req *http.Request) {
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	if l.token != "" {
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	} else if l.username != "" || l.password != "" {
+		req.SetBasicAuth(l.username, l.password)
+	}
+}
+
+// ready asks the /ready endpoint next to the push path whether Loki is
+// able to take pushes.
+func (l *Loki) ready() error {
+	u, err := url.Parse(l.lokiURL)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, postPathOne) + readyPath
+	u.RawQuery = ""
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	l.authorize(req)
+	resp, err := l.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP status %s", u, resp.Status)
+	}
 	return nil
 }
 
-func encodeBatch(batch map[model.Fingerprint]*logproto.Stream) ([]byte, error) {
+// statusClass returns 2xx, 4xx and so on, or error when there was no
+// response at all.
+func statusClass(status int) string {
+	if status < 0 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// retryable reports whether a push which failed with this status code
+// should be tried again. Network errors are signaled by -1.
+func retryable(status int) bool {
+	return status == -1 || status == http.StatusTooManyRequests || status/100 == 5
+}
+
+// backoff returns the exponential backoff with jitter for the given attempt.
+func (l *Loki) backoff(attempt int) time.Duration {
+	d := l.minWait
+	for i := 0; i < attempt && d < l.maxWait; i++ {
+		d *= 2
+	}
+	if d > l.maxWait {
+		d = l.maxWait
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func encodeBatch(batch map[model.Fingerprint]*stream) ([]byte, error) {
 	req := logproto.PushRequest{
 		Streams: make([]*logproto.Stream, 0, len(batch)),
 	}
 	for _, stream := range batch {
-		req.Streams = append(req.Streams, stream)
+		req.Streams = append(req.Streams, stream.Stream)
 	}
 	buf, err := proto.Marshal(&req)
 	if err != nil {
@@ -171,17 +728,84 @@ func encodeBatch(batch map[model.Fingerprint]*logproto.Stream) ([]byte, error) {
 	return buf, nil
 }
 
-func (l *Loki) send(ctx context.Context, buf []byte) (int, error) {
+// decodedLen returns the size of an encoded batch before its compression.
+func decodedLen(buf []byte, gzipped bool) int {
+	if gzipped {
+		// the gzip trailer holds the size modulo 2^32
+		if len(buf) < 4 {
+			return 0
+		}
+		return int(binary.LittleEndian.Uint32(buf[len(buf)-4:]))
+	}
+	n, err := snappy.DecodedLen(buf)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+type jsonStream struct {
+	Stream model.LabelSet `json:"stream"`
+	Values [][2]string    `json:"values"`
+}
+
+type jsonPushRequest struct {
+	Streams []jsonStream `json:"streams"`
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// encodeJSONBatch builds a gzip compressed push request in the JSON format
+// of the Loki v1 push API.
+func encodeJSONBatch(batch map[model.Fingerprint]*stream) ([]byte, error) {
+	req := jsonPushRequest{
+		Streams: make([]jsonStream, 0, len(batch)),
+	}
+	for _, stream := range batch {
+		js := jsonStream{
+			Stream: stream.labels,
+			Values: make([][2]string, 0, len(stream.Entries)),
+		}
+		for _, e := range stream.Entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(entryNanos(e), 10), e.Line})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+
+	var buf bytes.Buffer
+	gz := gzipPool.Get().(*gzip.Writer)
+	defer gzipPool.Put(gz)
+	gz.Reset(&buf)
+	if err := json.NewEncoder(gz).Encode(&req); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (l *Loki) send(ctx context.Context, buf []byte) (int, time.Duration, error) {
 	req, err := http.NewRequest("POST", l.lokiURL, bytes.NewReader(buf))
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", contentType)
+	if l.compress {
+		req.Header.Set("Content-Type", contentTypeJSON)
+		req.Header.Set("Content-Encoding", "gzip")
+	} else {
+		req.Header.Set("Content-Type", contentType)
+	}
+	l.authorize(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := l.client.Do(req)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	defer resp.Body.Close()
 
@@ -193,5 +817,5 @@ func (l *Loki) send(ctx context.Context, buf []byte) (int, error) {
 		}
 		err = fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
 	}
-	return resp.StatusCode, err
+	return resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")), err
 }
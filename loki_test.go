@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/snappy"
+	"github.com/negbie/fancy/logproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type pushRecorder struct {
+	sync.Mutex
+	reqs []*http.Request
+	body [][]byte
+}
+
+func (p *pushRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	p.Lock()
+	p.reqs = append(p.reqs, r)
+	p.body = append(p.body, b)
+	p.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *pushRecorder) entries(t *testing.T) []*logproto.Entry {
+	p.Lock()
+	defer p.Unlock()
+	var entries []*logproto.Entry
+	for _, b := range p.body {
+		for _, s := range decodePush(t, b).Streams {
+			entries = append(entries, s.Entries...)
+		}
+	}
+	return entries
+}
+
+func decodePush(t *testing.T, b []byte) *logproto.PushRequest {
+	t.Helper()
+	buf, err := snappy.Decode(nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req logproto.PushRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		t.Fatal(err)
+	}
+	return &req
+}
+
+func newTestLoki(t *testing.T, h http.Handler, cfg LokiConfig) (*Loki, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	cfg.URL = srv.URL
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 1024 * 1024
+	}
+	if cfg.BatchWait == 0 {
+		cfg.BatchWait = 60
+	}
+	l, err := NewLoki(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, srv
+}
+
+func testLogLine(msg string) *LogLine {
+	return &LogLine{
+		Timestamp: time.Unix(1572362482, 230666000),
+		Severity:  "info",
+		Hostname:  "pad",
+		Program:   "fancy",
+		Msg:       msg,
+	}
+}
+
+// push runs l until all lines are sent and the last batch is flushed.
+func push(l *Loki, lines ...*LogLine) {
+	consume(l, lines...)
+}
+
+func Test_shutdownFlushesLoki(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 100),
+		scanChan: make(chan [][]byte, 10),
+		quit:     make(chan struct{}),
+	}
+	sinkDone := runSinks(input.lineChan, map[string]Sink{"loki": l}, 100, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			input.process()
+			wg.Done()
+		}()
+	}
+
+	// stdin stays open and idle like under rsyslog omprog
+	r, w := io.Pipe()
+	defer w.Close()
+	scanDone := make(chan struct{})
+	go func() {
+		var stderr bytes.Buffer
+		input.scan(&stderr, r)
+		close(scanDone)
+	}()
+
+	w.Write(testLines(5).Bytes())
+	input.stop()
+
+	done := make(chan struct{})
+	go func() {
+		input.shutdown(scanDone, &wg, sinkDone)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	if got := len(rec.entries(t)); got != 5 {
+		t.Errorf("got %d pushed entries but want 5", got)
+	}
+}
+
+func Test_metricsWhileForwarding(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+	metrics := httptest.NewServer(metricsMux())
+	defer metrics.Close()
+
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 100),
+		scanChan: make(chan [][]byte, 10),
+		quit:     make(chan struct{}),
+	}
+	sinkDone := runSinks(input.lineChan, map[string]Sink{"loki": l}, 100, false)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		input.process()
+		wg.Done()
+	}()
+	scanDone := make(chan struct{})
+	input.scan(ioutil.Discard, strings.NewReader("2019-10-29T16:21:22.230666+01:00 6 pad scrape msg\n"))
+	close(scanDone)
+	input.shutdown(scanDone, &wg, sinkDone)
+
+	resp, err := http.Get(metrics.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `fancy_input_scan_total{hostname="pad",level="info",program="scrape",static_tag=""} 1`
+	if !strings.Contains(string(body), want) {
+		t.Errorf("got metrics without %s", want)
+	}
+	if got := len(rec.entries(t)); got != 1 {
+		t.Errorf("got %d pushed entries but want 1", got)
+	}
+}
+
+func Test_lokiCompress(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{Compress: true})
+	defer srv.Close()
+
+	push(l, testLogLine("first"), testLogLine("second"))
+
+	if len(rec.reqs) != 1 {
+		t.Fatalf("got %d requests but want 1", len(rec.reqs))
+	}
+	h := rec.reqs[0].Header
+	if h.Get("Content-Encoding") != "gzip" || h.Get("Content-Type") != contentTypeJSON {
+		t.Errorf("got headers %v", h)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(rec.body[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"streams":[{"stream":{"hostname":"pad","job":"fancy","level":"info","program":"fancy"},` +
+		`"values":[["1572362482230666000","first"],["1572362482230666000","second"]]}]}` + "\n"
+	if string(b) != want {
+		t.Errorf("got %s but want %s", b, want)
+	}
+}
+
+func Test_lokiSentBytes(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		rec := &pushRecorder{}
+		failed := false
+		// the first attempt fails, so the body is sent twice
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !failed {
+				failed = true
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			rec.ServeHTTP(w, r)
+		})
+		l, srv := newTestLoki(t, h, LokiConfig{Compress: compress, MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+		compressed := testutil.ToFloat64(lokiSentBytes.WithLabelValues("compressed"))
+		uncompressed := testutil.ToFloat64(lokiSentBytes.WithLabelValues("uncompressed"))
+
+		push(l, testLogLine("first"), testLogLine(strings.Repeat("second ", 100)))
+		srv.Close()
+
+		if len(rec.body) != 1 {
+			t.Fatalf("compress %v: got %d pushes but want 1", compress, len(rec.body))
+		}
+		body := rec.body[0]
+		var decoded []byte
+		if compress {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			var err error
+			if decoded, err = snappy.Decode(nil, body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := testutil.ToFloat64(lokiSentBytes.WithLabelValues("compressed")) - compressed; n != float64(2*len(body)) {
+			t.Errorf("compress %v: got %v compressed bytes but want twice the body of %d bytes", compress, n, len(body))
+		}
+		if n := testutil.ToFloat64(lokiSentBytes.WithLabelValues("uncompressed")) - uncompressed; n != float64(2*len(decoded)) {
+			t.Errorf("compress %v: got %v uncompressed bytes but want twice the %d bytes of the decoded body", compress, n, len(decoded))
+		}
+		if len(decoded) <= len(body) {
+			t.Errorf("compress %v: got a body of %d bytes for %d uncompressed ones", compress, len(body), len(decoded))
+		}
+	}
+}
+
+func Test_lokiBatchJitter(t *testing.T) {
+	l, err := NewLoki(LokiConfig{URL: "http://loki:3100", BatchSize: 1024, BatchWait: 10, BatchJitter: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := l.flushWait()
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("got flush interval %v but want 9s to 11s", d)
+		}
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	// the intervals spread over the whole range
+	if min > 9500*time.Millisecond || max < 10500*time.Millisecond {
+		t.Errorf("got flush intervals from %v to %v but want them to vary", min, max)
+	}
+
+	if l, err = NewLoki(LokiConfig{URL: "http://loki:3100", BatchSize: 1024, BatchWait: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if d := l.flushWait(); d != 10*time.Second {
+		t.Errorf("got flush interval %v without jitter but want 10s", d)
+	}
+
+	// the adaptive wait caps a batch at its jittered batch-wait too
+	cfg := LokiConfig{URL: "http://loki:3100", BatchSize: 1024, BatchWait: 10, BatchJitter: 0.1, AdaptiveWait: true}
+	if l, err = NewLoki(cfg); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	waits := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		// the first line of a batch after a quiet spell
+		now := time.Now()
+		l.count, l.gap, l.last = 1, l.batchWait, time.Time{}
+		l.arrive(timer, now)
+		d := l.deadline.Sub(now)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("got adaptive deadline after %v but want 9s to 11s", d)
+		}
+		waits[d] = true
+	}
+	if len(waits) < 2 {
+		t.Errorf("got adaptive deadlines after %v but want them to vary", waits)
+	}
+}
+
+func Test_lokiProto(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+
+	push(l, testLogLine("first"), testLogLine("second"))
+
+	if len(rec.reqs) != 1 {
+		t.Fatalf("got %d requests but want 1", len(rec.reqs))
+	}
+	h := rec.reqs[0].Header
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Type") != contentType {
+		t.Errorf("got headers %v", h)
+	}
+
+	req := decodePush(t, rec.body[0])
+	if len(req.Streams) != 1 {
+		t.Fatalf("got %d streams but want 1", len(req.Streams))
+	}
+	s := req.Streams[0]
+	if want := `{hostname="pad", job="fancy", level="info", program="fancy"}`; s.Labels != want {
+		t.Errorf("got labels %s but want %s", s.Labels, want)
+	}
+	if len(s.Entries) != 2 || s.Entries[0].Line != "first" || s.Entries[1].Line != "second" {
+		t.Fatalf("got entries %v but want first and second", s.Entries)
+	}
+	if ts := s.Entries[0].Timestamp; ts.Seconds != 1572362482 || ts.Nanos != 230666000 {
+		t.Errorf("got timestamp %v but want 1572362482.230666", ts)
+	}
+}
+
+func Test_lokiSentPruned(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+
+	var lines []*LogLine
+	for i := 0; i < 50; i++ {
+		ll := testLogLine("churn")
+		ll.Hostname = fmt.Sprintf("host%d", i)
+		lines = append(lines, ll)
+	}
+	push(l, lines...)
+	if len(l.sent) != 50 {
+		t.Fatalf("got %d streams remembered but want 50", len(l.sent))
+	}
+
+	// all but host0 went quiet longer than the window
+	for fp, s := range l.sent {
+		s.at = s.at.Add(-sentWindow - time.Minute)
+		l.sent[fp] = s
+	}
+	late := testLogLine("late")
+	late.Hostname = "host0"
+	late.Timestamp = late.Timestamp.Add(-time.Second)
+	push(l, late)
+	if len(l.sent) != 1 {
+		t.Errorf("got %d streams remembered but want only host0", len(l.sent))
+	}
+	// host0 is remembered before it is pruned, so its late line is clamped
+	e := decodePush(t, rec.body[1]).Streams[0].Entries[0]
+	if want := testLogLine("").Timestamp.UnixNano(); entryNanos(e) != want {
+		t.Errorf("got timestamp %d but want %d of the line sent before", entryNanos(e), want)
+	}
+}
+
+func Test_lokiStreamOrder(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+
+	base := time.Unix(1572362482, 0)
+	var lines []*LogLine
+	for _, sec := range []int{5, 1, 4, 2, 3} {
+		for _, host := range []string{"a", "b"} {
+			ll := testLogLine(fmt.Sprintf("%s %d", host, sec))
+			ll.Hostname = host
+			ll.Timestamp = base.Add(time.Duration(sec) * time.Second)
+			lines = append(lines, ll)
+		}
+	}
+	push(l, lines...)
+	// older than what Loki already got for the stream
+	late := testLogLine("a late")
+	late.Hostname = "a"
+	late.Timestamp = base
+	push(l, late)
+
+	if len(rec.body) != 2 {
+		t.Fatalf("got %d pushes but want 2", len(rec.body))
+	}
+	for _, s := range decodePush(t, rec.body[0]).Streams {
+		var got []string
+		for i, e := range s.Entries {
+			got = append(got, e.Line)
+			if i > 0 && entryNanos(e) < entryNanos(s.Entries[i-1]) {
+				t.Errorf("stream %s is out of order: %q", s.Labels, got)
+			}
+		}
+		if len(got) != 5 || !strings.HasSuffix(got[0], " 1") || !strings.HasSuffix(got[4], " 5") {
+			t.Errorf("got %q in stream %s but want 1 to 5", got, s.Labels)
+		}
+	}
+	e := decodePush(t, rec.body[1]).Streams[0].Entries[0]
+	if want := base.Add(5 * time.Second).UnixNano(); entryNanos(e) != want {
+		t.Errorf("got the late entry at %d but want it moved to %d", entryNanos(e), want)
+	}
+}
+
+func Test_lokiReady(t *testing.T) {
+	var mu sync.Mutex
+	status, paths := http.StatusOK, []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path+" "+r.Header.Get("X-Scope-OrgID"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	l, err := NewLoki(LokiConfig{URL: srv.URL, Tenant: "team-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ready(); err != nil {
+		t.Errorf("got %v for a ready Loki", err)
+	}
+	if len(paths) != 1 || paths[0] != "/ready team-a" {
+		t.Errorf("got requests %q but want /ready with the tenant", paths)
+	}
+
+	// the ready path sits next to a prefixed push path
+	prefixed, err := NewLoki(LokiConfig{URL: srv.URL + "/prefix" + postPathOne})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prefixed.ready(); err != nil || paths[1] != "/prefix/ready " {
+		t.Errorf("got %v and requests %q but want /prefix/ready", err, paths)
+	}
+
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	if err := l.ready(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v but want the 503", err)
+	}
+	srv.Close()
+	if err := l.ready(); err == nil {
+		t.Error("got no error for an unreachable Loki")
+	}
+}
+
+func Test_lokiPushURL(t *testing.T) {
+	cases := []struct{ url, want string }{
+		{"http://loki:3100", "http://loki:3100/loki/api/v1/push"},
+		{"http://loki:3100/", "http://loki:3100/loki/api/v1/push"},
+		{"http://gw/loki-a", "http://gw/loki-a/loki/api/v1/push"},
+		{"http://loki:3100/loki/api/v1/push", "http://loki:3100/loki/api/v1/push"},
+		{"http://gw/custom/push", "http://gw/custom/push"},
+		{"http://loki:3100/api/prom/push", "http://loki:3100/loki/api/v1/push"},
+		{"http://gw/a?tenant=x", "http://gw/a/loki/api/v1/push?tenant=x"},
+	}
+	for _, c := range cases {
+		l, err := NewLoki(LokiConfig{URL: c.url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.lokiURL != c.want {
+			t.Errorf("%s: got %s but want %s", c.url, l.lokiURL, c.want)
+		}
+	}
+}
+
+func Test_lokiUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "loki.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &pushRecorder{}
+	srv := httptest.NewUnstartedServer(rec)
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	l, err := NewLoki(LokiConfig{URL: "unix://" + socket + "?tenant=a", BatchSize: 1024, BatchWait: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.lokiURL != "http://localhost/loki/api/v1/push?tenant=a" {
+		t.Errorf("got push URL %s", l.lokiURL)
+	}
+	push(l, testLogLine("msg"))
+	if len(rec.reqs) != 1 || rec.reqs[0].URL.Path != postPathOne {
+		t.Fatalf("got %d pushes but want one to %s over the socket", len(rec.reqs), postPathOne)
+	}
+	if got := rec.entries(t); len(got) != 1 || got[0].Line != "msg" {
+		t.Errorf("got entries %v", got)
+	}
+}
+
+func Test_lokiPool(t *testing.T) {
+	pool := PoolConfig{MaxIdleConns: 50, MaxIdleConnsPerHost: 20, IdleConnTimeout: time.Minute}
+	for _, url := range []string{"http://loki:3100", "unix:///run/loki.sock"} {
+		l, err := NewLoki(LokiConfig{URL: url, BatchSize: 1024, BatchWait: 1, Pool: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, ok := l.client.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("%s: got transport %T", url, l.client.Transport)
+		}
+		if tr.MaxIdleConns != 50 || tr.MaxIdleConnsPerHost != 20 || tr.IdleConnTimeout != time.Minute {
+			t.Errorf("%s: got %d idle conns, %d per host and idle timeout %v", url, tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+		}
+	}
+
+	// the unset knobs keep the defaults, which stay untouched
+	l, err := NewLoki(LokiConfig{URL: "http://loki:3100", BatchSize: 1024, BatchWait: 1, Pool: PoolConfig{MaxIdleConnsPerHost: 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := http.DefaultTransport.(*http.Transport)
+	tr := l.client.Transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 8 || tr.MaxIdleConns != def.MaxIdleConns || tr.IdleConnTimeout != def.IdleConnTimeout {
+		t.Errorf("got %d idle conns, %d per host and idle timeout %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+	if def.MaxIdleConnsPerHost != 0 {
+		t.Errorf("http.DefaultTransport was changed to %d idle conns per host", def.MaxIdleConnsPerHost)
+	}
+
+	if l, err = NewLoki(LokiConfig{URL: "http://loki:3100", BatchSize: 1024, BatchWait: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if l.client != http.DefaultClient {
+		t.Error("got an own client without pool settings")
+	}
+}
+
+func Test_newLokiErrors(t *testing.T) {
+	cases := []LokiConfig{
+		{URL: "http://%zz"},
+		{URL: "http://loki", BearerToken: "t", Username: "u"},
+		{URL: "http://loki", TLS: TLSConfig{CAFile: "testdata/missing.pem"}},
+		{URL: "http://loki", SpoolDir: "/dev/null/spool", SpoolMaxBytes: 1},
+	}
+	for i, cfg := range cases {
+		// no half set up client may end up as a sink
+		if l, err := NewLoki(cfg); err == nil || l != nil {
+			t.Errorf("case %d: got %v,%v but want only an error", i, l, err)
+		}
+	}
+}
+
+// Test_mainLokiError runs main in a child process, which must exit with an
+// error instead of forwarding to a broken Loki client.
+func Test_mainLokiError(t *testing.T) {
+	if args := os.Getenv("FANCY_TEST_MAIN"); args != "" {
+		os.Args = strings.Fields(args)
+		main()
+		return
+	}
+	c := exec.Command(os.Args[0], "-test.run=^Test_mainLokiError$")
+	c.Env = append(os.Environ(), "FANCY_TEST_MAIN=fancy -no-metrics -loki-url http://127.0.0.1:1 -loki-ca-file testdata/missing.pem")
+	c.Stdin = strings.NewReader(string(raw))
+	out, err := c.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+		t.Errorf("got %v but want exit code 1", err)
+	}
+	if bytes.Contains(out, []byte("panic")) || !bytes.Contains(out, []byte("missing.pem")) {
+		t.Errorf("got output %s", out)
+	}
+}
+
+func Test_lokiTenant(t *testing.T) {
+	for _, tenant := range []string{"", "team-a"} {
+		rec := &pushRecorder{}
+		l, srv := newTestLoki(t, rec, LokiConfig{Tenant: tenant})
+		push(l, testLogLine("msg"))
+		srv.Close()
+
+		if len(rec.reqs) != 1 {
+			t.Fatalf("got %d requests but want 1", len(rec.reqs))
+		}
+		got, ok := rec.reqs[0].Header["X-Scope-Orgid"]
+		if tenant == "" && ok {
+			t.Errorf("got X-Scope-OrgID %v but want none", got)
+		}
+		if tenant != "" && rec.reqs[0].Header.Get("X-Scope-OrgID") != tenant {
+			t.Errorf("got X-Scope-OrgID %v but want %q", got, tenant)
+		}
+	}
+}
+
+func Test_lokiAuth(t *testing.T) {
+	cases := []struct {
+		cfg  LokiConfig
+		want string
+	}{
+		{LokiConfig{}, ""},
+		{LokiConfig{Username: "user", Password: "secret"}, "Basic dXNlcjpzZWNyZXQ="},
+		{LokiConfig{BearerToken: "token"}, "Bearer token"},
+	}
+
+	for _, c := range cases {
+		rec := &pushRecorder{}
+		l, srv := newTestLoki(t, rec, c.cfg)
+		push(l, testLogLine("msg"))
+		srv.Close()
+
+		if got := rec.reqs[0].Header.Get("Authorization"); got != c.want {
+			t.Errorf("got Authorization %q but want %q", got, c.want)
+		}
+	}
+
+	_, err := NewLoki(LokiConfig{URL: "http://localhost:3100", Username: "user", BearerToken: "token"})
+	if err != errLokiAuth {
+		t.Errorf("got %v but want %v", err, errLokiAuth)
+	}
+}
+
+// failingHandler answers the first fails requests with status.
+type failingHandler struct {
+	pushRecorder
+	fails  int
+	status int
+}
+
+func (f *failingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	fail := f.fails > 0
+	f.fails--
+	f.Unlock()
+	if fail {
+		w.WriteHeader(f.status)
+		return
+	}
+	f.pushRecorder.ServeHTTP(w, r)
+}
+
+func Test_lokiRetry(t *testing.T) {
+	cases := []struct {
+		fails, status int
+		pushed        int
+		retries       float64
+		failed        float64
+	}{
+		{2, http.StatusServiceUnavailable, 1, 2, 0},
+		{5, http.StatusInternalServerError, 0, 3, 1},
+		{1, http.StatusTooManyRequests, 1, 1, 0},
+		{1, http.StatusBadRequest, 0, 0, 1},
+	}
+
+	for _, c := range cases {
+		h := &failingHandler{fails: c.fails, status: c.status}
+		l, srv := newTestLoki(t, h, LokiConfig{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+		retries, failed := testutil.ToFloat64(lokiRetries), testutil.ToFloat64(lokiFailedBatches)
+		push(l, testLogLine("msg"))
+		srv.Close()
+
+		if len(h.reqs) != c.pushed {
+			t.Errorf("%d x %d: got %d pushes but want %d", c.fails, c.status, len(h.reqs), c.pushed)
+		}
+		if got := testutil.ToFloat64(lokiRetries) - retries; got != c.retries {
+			t.Errorf("%d x %d: got %v retries but want %v", c.fails, c.status, got, c.retries)
+		}
+		if got := testutil.ToFloat64(lokiFailedBatches) - failed; got != c.failed {
+			t.Errorf("%d x %d: got %v failed batches but want %v", c.fails, c.status, got, c.failed)
+		}
+	}
+}
+
+// slowHandler stalls the first stalls requests for a second.
+type slowHandler struct {
+	pushRecorder
+	stalls int
+}
+
+func (h *slowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	stall := h.stalls > 0
+	h.stalls--
+	h.Unlock()
+	if stall {
+		time.Sleep(time.Second)
+		return
+	}
+	h.pushRecorder.ServeHTTP(w, r)
+}
+
+func Test_lokiTimeout(t *testing.T) {
+	h := &slowHandler{stalls: 1}
+	l, srv := newTestLoki(t, h, LokiConfig{Timeout: 50 * time.Millisecond, MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer srv.Close()
+	timeouts, retries := testutil.ToFloat64(lokiTimeouts), testutil.ToFloat64(lokiRetries)
+
+	done := make(chan struct{})
+	go func() {
+		push(l, testLogLine("msg"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push did not time out")
+	}
+
+	if got := len(h.entries(t)); got != 1 {
+		t.Errorf("got %d entries but want the retried one", got)
+	}
+	if got := testutil.ToFloat64(lokiTimeouts) - timeouts; got != 1 {
+		t.Errorf("got %v timeouts but want 1", got)
+	}
+	if got := testutil.ToFloat64(lokiRetries) - retries; got != 1 {
+		t.Errorf("got %v retries but want 1", got)
+	}
+}
+
+// batchLens returns the number of entries of every recorded push.
+func (p *pushRecorder) batchLens(t *testing.T) []int {
+	p.Lock()
+	defer p.Unlock()
+	var lens []int
+	for _, b := range p.body {
+		n := 0
+		for _, s := range decodePush(t, b).Streams {
+			n += len(s.Entries)
+		}
+		lens = append(lens, n)
+	}
+	return lens
+}
+
+func Test_lokiBatchTriggers(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  LokiConfig
+	}{
+		// every line is 5 bytes
+		{"size", LokiConfig{BatchSize: 10}},
+		{"count", LokiConfig{BatchCount: 2}},
+	}
+	for _, c := range cases {
+		rec := &pushRecorder{}
+		l, srv := newTestLoki(t, rec, c.cfg)
+		push(l, testLogLine("msg 1"), testLogLine("msg 2"), testLogLine("msg 3"), testLogLine("msg 4"), testLogLine("msg 5"))
+		srv.Close()
+
+		if got := fmt.Sprint(rec.batchLens(t)); got != "[2 2 1]" {
+			t.Errorf("%s: got batches of %s entries but want [2 2 1]", c.name, got)
+		}
+	}
+}
+
+func Test_lokiBatchWait(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{BatchWait: 1, BatchCount: 100})
+	defer srv.Close()
+
+	lines := make(chan *LogLine, 1)
+	done := make(chan struct{})
+	go func() {
+		l.Consume(lines)
+		close(done)
+	}()
+	lines <- testLogLine("msg")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(rec.batchLens(t)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(lines)
+	<-done
+	if got := fmt.Sprint(rec.batchLens(t)); got != "[1]" {
+		t.Errorf("got batches of %s entries but want [1] after batch-wait", got)
+	}
+}
+
+func Test_lokiMaxLineAge(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{MaxLineAge: time.Hour})
+	defer srv.Close()
+
+	line := func(msg string, age time.Duration) *LogLine {
+		ll := testLogLine(msg)
+		ll.Timestamp = time.Now().Add(-age)
+		return ll
+	}
+	before := testutil.ToFloat64(lokiStaleLines)
+	push(l, line("fresh", 0), line("aged", 2*time.Hour), line("recent", 59*time.Minute))
+	// a batch of stale lines only isn't pushed at all
+	push(l, line("aged", 3*time.Hour))
+
+	// lines which age while their batch waits are dropped when it is sent
+	l.batch[0] = &stream{Stream: &logproto.Stream{Entries: []*logproto.Entry{
+		{Timestamp: &timestamp.Timestamp{Seconds: time.Now().Add(-61 * time.Minute).Unix()}, Line: "waited"},
+	}}}
+	l.Flush()
+
+	var got []string
+	for _, e := range rec.entries(t) {
+		got = append(got, e.Line)
+	}
+	if len(rec.body) != 1 || fmt.Sprint(got) != "[recent fresh]" {
+		t.Errorf("got %d pushes of %q but want one of [recent fresh]", len(rec.body), got)
+	}
+	if n := testutil.ToFloat64(lokiStaleLines) - before; n != 3 {
+		t.Errorf("got %v stale lines counted but want 3", n)
+	}
+}
+
+func Test_pipelineLatency(t *testing.T) {
+	// process stamps the lines it takes from the scan
+	input := &Input{forward: true, lineChan: make(chan *LogLine, 1), scanChan: make(chan [][]byte, 1)}
+	input.scanChan <- [][]byte{raw}
+	close(input.scanChan)
+	start := time.Now()
+	input.process()
+	if ll := <-input.lineChan; ll.Ingested.Before(start) || ll.Ingested.After(time.Now()) {
+		t.Errorf("got ingest time %v but want one during process", ll.Ingested)
+	}
+
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+	delayed := func(d time.Duration) *LogLine {
+		ll := testLogLine("msg")
+		ll.Ingested = time.Now().Add(-d)
+		return ll
+	}
+	count, sum := histogramSum(t, "fancy_pipeline_latency_seconds")
+	// a made up line without an ingest time isn't observed
+	push(l, delayed(2*time.Second), delayed(3*time.Second), testLogLine("summary"))
+	gotCount, gotSum := histogramSum(t, "fancy_pipeline_latency_seconds")
+	if gotCount-count != 2 || gotSum-sum < 5 || gotSum-sum > 6 {
+		t.Errorf("got %d observations of %vs but want 2 of about 5s", gotCount-count, gotSum-sum)
+	}
+}
+
+func Test_lokiAdaptiveWait(t *testing.T) {
+	// firstPush returns how long after the first of lines, written every
+	// interval, a batch reached Loki and the entries of the batches.
+	firstPush := func(n int, interval time.Duration) (time.Duration, string) {
+		rec := &pushRecorder{}
+		l, srv := newTestLoki(t, rec, LokiConfig{BatchWait: 1, AdaptiveWait: true})
+		defer srv.Close()
+
+		lines := make(chan *LogLine, n)
+		done := make(chan struct{})
+		go func() {
+			l.Consume(lines)
+			close(done)
+		}()
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			lines <- testLogLine("msg")
+		}
+		deadline := start.Add(3 * time.Second)
+		for len(rec.batchLens(t)) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		latency := time.Since(start)
+		close(lines)
+		<-done
+		return latency, fmt.Sprint(rec.batchLens(t))
+	}
+
+	// a burst is sent once it stops instead of after batch-wait
+	if latency, got := firstPush(50, 0); latency > 500*time.Millisecond || got != "[50]" {
+		t.Errorf("burst: got batches of %s entries after %v but want [50] well before 1s", got, latency)
+	}
+	// lines coming steadily keep on filling the batch up to batch-wait
+	if latency, got := firstPush(7, 100*time.Millisecond); latency < 900*time.Millisecond || got != "[7]" {
+		t.Errorf("steady: got batches of %s entries after %v but want [7] after 1s", got, latency)
+	}
+}
+
+// histogramCount returns the number of observations of a histogram in the
+// default registry, optionally only the series with the status label.
+func histogramCount(t *testing.T, name, status string) uint64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "status" && lp.GetValue() != status {
+					continue metrics
+				}
+			}
+			n += m.GetHistogram().GetSampleCount()
+		}
+	}
+	return n
+}
+
+func Test_lokiPushHistograms(t *testing.T) {
+	h := &failingHandler{fails: 1, status: http.StatusServiceUnavailable}
+	l, srv := newTestLoki(t, h, LokiConfig{MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer srv.Close()
+
+	ok, failed := histogramCount(t, "fancy_loki_push_duration_seconds", "2xx"), histogramCount(t, "fancy_loki_push_duration_seconds", "5xx")
+	batches := histogramCount(t, "fancy_loki_batch_bytes", "")
+	push(l, testLogLine("msg"))
+
+	if got := histogramCount(t, "fancy_loki_push_duration_seconds", "2xx") - ok; got != 1 {
+		t.Errorf("got %d successful push durations but want 1", got)
+	}
+	if got := histogramCount(t, "fancy_loki_push_duration_seconds", "5xx") - failed; got != 1 {
+		t.Errorf("got %d failed push durations but want 1", got)
+	}
+	// the retry sends the same batch again
+	if got := histogramCount(t, "fancy_loki_batch_bytes", "") - batches; got != 1 {
+		t.Errorf("got %d batch sizes but want 1", got)
+	}
+}
+
+func Test_lokiBackoff(t *testing.T) {
+	l := &Loki{minWait: 100 * time.Millisecond, maxWait: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if d := l.backoff(attempt); d < max/2 || d > max {
+			t.Errorf("attempt %d: got %v but want between %v and %v", attempt, d, max/2, max)
+		}
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("7"); d != 7*time.Second {
+		t.Errorf("got %v but want 7s", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 50*time.Second || d > time.Minute {
+		t.Errorf("got %v for %q", d, date)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("got %v but want 0", d)
+	}
+}
+
+func Test_lokiLineLabels(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{})
+	defer srv.Close()
+
+	ll := testLogLine("msg")
+	// reserved label names are left to fancy
+	ll.Labels = map[string]string{"origin_ip": "10.0.0.1", "job": "other", "program": "other"}
+	push(l, ll)
+
+	want := `{hostname="pad", job="fancy", level="info", origin_ip="10.0.0.1", program="fancy"}`
+	if got := decodePush(t, rec.body[0]).Streams[0].Labels; got != want {
+		t.Errorf("got labels %s but want %s", got, want)
+	}
+}
+
+func Test_lokiStaticLabels(t *testing.T) {
+	rec := &pushRecorder{}
+	labels := labelFlag{}
+	for _, s := range []string{"cluster=eu-1", "env=prod"} {
+		if err := labels.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, srv := newTestLoki(t, rec, LokiConfig{Labels: labels})
+	defer srv.Close()
+
+	other := testLogLine("msg")
+	other.Hostname = "other"
+	push(l, testLogLine("msg"), other)
+
+	req := decodePush(t, rec.body[0])
+	got := map[string]bool{}
+	for _, s := range req.Streams {
+		got[s.Labels] = true
+	}
+	for _, want := range []string{
+		`{cluster="eu-1", env="prod", hostname="pad", job="fancy", level="info", program="fancy"}`,
+		`{cluster="eu-1", env="prod", hostname="other", job="fancy", level="info", program="fancy"}`,
+	} {
+		if !got[want] {
+			t.Errorf("got streams %v but want %s", got, want)
+		}
+	}
+}
+
+func Test_labelFlag(t *testing.T) {
+	for _, s := range []string{"cluster", "=eu", "1cluster=eu", "__name__=x", "hostname=x", "env=\xff"} {
+		if err := (labelFlag{}).Set(s); err == nil {
+			t.Errorf("got no error for %q", s)
+		}
+	}
+	f := labelFlag{}
+	f.Set("env=prod")
+	f.Set("dc=a=b")
+	if got := f.String(); got != "dc=a=b,env=prod" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func Test_lokiLabelsFromEnv(t *testing.T) {
+	os.Setenv("FANCY_TEST_POD", "web-0")
+	os.Setenv("FANCY_TEST_NS", "shop")
+	os.Unsetenv("FANCY_TEST_NODE")
+	defer os.Unsetenv("FANCY_TEST_POD")
+	defer os.Unsetenv("FANCY_TEST_NS")
+
+	labels := labelFlag{}
+	labels.Set("namespace=default")
+	spec := "pod=FANCY_TEST_POD, namespace=FANCY_TEST_NS,node=FANCY_TEST_NODE"
+	if err := labels.setFromEnv(spec, os.LookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{Labels: labels})
+	defer srv.Close()
+	push(l, testLogLine("msg"))
+
+	// the missing node is skipped and -label wins over the environment
+	req := decodePush(t, rec.body[0])
+	want := `{hostname="pad", job="fancy", level="info", namespace="default", pod="web-0", program="fancy"}`
+	if len(req.Streams) != 1 || req.Streams[0].Labels != want {
+		t.Errorf("got streams %v but want %s", req.Streams, want)
+	}
+
+	for _, spec := range []string{"pod", "pod=", "=FANCY_TEST_POD", "job=FANCY_TEST_POD", "1pod=FANCY_TEST_POD"} {
+		if err := (labelFlag{}).setFromEnv(spec, os.LookupEnv); err == nil {
+			t.Errorf("got no error for %q", spec)
+		}
+	}
+}
+
+func Test_lokiStreamLabels(t *testing.T) {
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{StreamLabels: []string{"program"}})
+	defer srv.Close()
+
+	ll := testLogLine("msg")
+	ll.StaticTag = "hit"
+	push(l, ll)
+
+	s := decodePush(t, rec.body[0]).Streams[0]
+	if want := `{job="fancy", program="fancy"}`; s.Labels != want {
+		t.Errorf("got labels %s but want %s", s.Labels, want)
+	}
+	if want := "hostname=pad level=info static_tag=hit msg"; s.Entries[0].Line != want {
+		t.Errorf("got line %q but want %q", s.Entries[0].Line, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	lokiBufferedLines = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fancy_loki_buffered_lines",
+		Help: "Number of lines in batches held back until Loki is reachable again"})
+	lokiEvictedLines = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_loki_evicted_lines_total",
+		Help: "Total number of buffered lines evicted because the buffer was full"})
+)
+
+// batchQueue holds encoded batches which failed to push, oldest first.
+type batchQueue interface {
+	add(buf []byte, lines int)
+	first() ([]byte, bool)
+	remove()
+}
+
+// lokiBuffer is a bounded queue of encoded batches. Adding a batch evicts
+// the oldest ones until all of them fit into max lines.
+type lokiBuffer struct {
+	max     int
+	lines   int
+	batches []heldBatch
+}
+
+type heldBatch struct {
+	buf   []byte
+	lines int
+}
+
+func newLokiBuffer(max int) *lokiBuffer {
+	return &lokiBuffer{max: max}
+}
+
+func (b *lokiBuffer) add(buf []byte, lines int) {
+	b.batches = append(b.batches, heldBatch{buf, lines})
+	b.lines += lines
+	for b.lines > b.max {
+		lokiEvictedLines.Add(float64(b.batches[0].lines))
+		b.remove()
+	}
+	lokiBufferedLines.Set(float64(b.lines))
+}
+
+// first returns the oldest batch.
+func (b *lokiBuffer) first() ([]byte, bool) {
+	if len(b.batches) == 0 {
+		return nil, false
+	}
+	return b.batches[0].buf, true
+}
+
+// remove drops the oldest batch.
+func (b *lokiBuffer) remove() {
+	b.lines -= b.batches[0].lines
+	b.batches[0] = heldBatch{}
+	b.batches = b.batches[1:]
+	lokiBufferedLines.Set(float64(b.lines))
+}
+
+// batchLines returns the number of entries of batch.
+func batchLines(batch map[model.Fingerprint]*stream) int {
+	n := 0
+	for _, s := range batch {
+		n += len(s.Entries)
+	}
+	return n
+}
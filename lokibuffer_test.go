@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// outageHandler answers 503 while down.
+type outageHandler struct {
+	pushRecorder
+	mu    sync.Mutex
+	down  bool
+	fails int
+}
+
+func (h *outageHandler) setDown(down bool) {
+	h.mu.Lock()
+	h.down = down
+	h.mu.Unlock()
+}
+
+func (h *outageHandler) failed() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fails
+}
+
+func (h *outageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	down := h.down
+	if down {
+		h.fails++
+	}
+	h.mu.Unlock()
+	if down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	h.pushRecorder.ServeHTTP(w, r)
+}
+
+func Test_lokiBufferRecovery(t *testing.T) {
+	h := &outageHandler{down: true}
+	l, srv := newTestLoki(t, h, LokiConfig{BatchCount: 1, BufferLines: 2})
+	defer srv.Close()
+	evicted := testutil.ToFloat64(lokiEvictedLines)
+
+	lines := make(chan *LogLine)
+	done := make(chan struct{})
+	go func() {
+		l.Consume(lines)
+		l.Flush()
+		close(done)
+	}()
+	for _, msg := range []string{"msg 1", "msg 2", "msg 3"} {
+		lines <- testLogLine(msg)
+	}
+	// msg 1 and the replays before msg 2 and msg 3 failed
+	for h.failed() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	h.setDown(false)
+	lines <- testLogLine("msg 4")
+	close(lines)
+	<-done
+
+	var got []string
+	for _, e := range h.entries(t) {
+		got = append(got, e.Line)
+	}
+	if len(got) != 3 || got[0] != "msg 2" || got[1] != "msg 3" || got[2] != "msg 4" {
+		t.Errorf("got %q but want the buffered lines in order before msg 4", got)
+	}
+	if got := testutil.ToFloat64(lokiEvictedLines) - evicted; got != 1 {
+		t.Errorf("got %v evicted lines but want 1", got)
+	}
+	if got := testutil.ToFloat64(lokiBufferedLines); got != 0 {
+		t.Errorf("got %v buffered lines after recovery", got)
+	}
+}
+
+func Test_lokiBufferEvict(t *testing.T) {
+	b := newLokiBuffer(5)
+	b.add([]byte("a"), 2)
+	b.add([]byte("b"), 2)
+	b.add([]byte("c"), 3)
+	if buf, _ := b.first(); string(buf) != "b" || b.lines != 5 {
+		t.Errorf("got first %q and %d lines but want b and 5", buf, b.lines)
+	}
+
+	// a batch larger than the whole buffer doesn't fit at all
+	b.add([]byte("d"), 6)
+	if _, ok := b.first(); ok || b.lines != 0 {
+		t.Errorf("got %d lines but want an empty buffer", b.lines)
+	}
+}
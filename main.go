@@ -2,182 +2,1402 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 )
 
 const version = "1.7"
-const scanSize = 24
+
+// defaultReadBuffer is the size of the bufio buffer of stdin, like the
+// default of bufio.NewReader.
+const defaultReadBuffer = 4096
+
+// scanSize is the number of lines batched into one send on scanChan.
+var scanSize = 24
+
+const quitWait = 100 * time.Millisecond
 
 func main() {
 	fs := flag.NewFlagSet("fancy", flag.ExitOnError)
 	var (
-		cmd             = fs.String("cmd", "", "Send input msg to external command and use it's output as new msg")
-		lokiURL         = fs.String("loki-url", "http://localhost:3100", "Loki Server URL")
+		cmd             = fs.String("cmd", "", "Send input msg to external command and use it's output as new msg, stages separated by | run as a pipeline")
+		cmdMode         = fs.String("cmd-mode", "spawn", "Run cmd once per msg (spawn) or keep it running and stream msgs line by line through it (pipe)")
+		cmdTimeout      = fs.Duration("cmd-timeout", 0, "Kill cmd when a msg takes longer and keep the original msg, 0 waits forever")
+		cmdMaxOutput    = fs.Int("cmd-max-output", 0, "Keep the original msg when cmd writes more than these bytes for it, 0 means no limit")
+		cmdInput        = fs.String("cmd-input", "msg", "What cmd gets on stdin: the msg, the whole raw line or all fields as json")
+		cmdOutput       = fs.String("cmd-output", "text", "How to use the output of cmd: as new msg (text) or as a json object whose host, program, level, msg and labels replace those of the log")
+		cmdKeepOnExit   = fs.Bool("cmd-keep-on-exit", false, "Forward the original msg when cmd exits nonzero instead of dropping it")
+		cmdMaxConc      = fs.Int("cmd-max-concurrent", 0, "Run at most this many cmd processes at once over all cmd-workers, 0 means no limit")
+		cmdOnBusy       = fs.String("cmd-on-busy", "block", "What to do with a msg while cmd-max-concurrent processes run: block until one ends or drop the log")
+		cmdWorkers      = fs.Int("cmd-workers", 8, "Run cmd in this many goroutines apart from parsing")
+		scanBatch       = fs.Int("scan-batch", scanSize, "Number of lines handed to the workers at once, more amortizes the channel sends")
+		workers         = fs.Int("workers", 8, "Parse logs in this many goroutines")
+		severities      = fs.String("severity-map", "", "Comma separated from=to pairs which rename severities case-insensitively before filtering, e.g. WARN=warning,ERR=error")
+		minSeverity     = fs.String("min-severity", "", "Drop logs less severe than this syslog severity, e.g. warning")
+		programAllow    = fs.String("program-allow", "", "Comma separated programs or globs like nginx-*, logs of other programs are dropped")
+		programDeny     = fs.String("program-deny", "", "Comma separated programs or globs whose logs are dropped, wins over program-allow")
+		hostAllow       = fs.String("host-allow", "", "Comma separated hostnames or globs like web-*, logs of other hosts are dropped")
+		hostDeny        = fs.String("host-deny", "", "Comma separated hostnames or globs whose logs are dropped, wins over host-allow")
+		noBody          = fs.Bool("no-body", false, "Forward logs with an empty msg, they keep their labels and Loki streams")
+		noBodyPrograms  = fs.String("no-body-programs", "", "Comma separated programs or globs whose logs are forwarded like with no-body")
+		noBodyKeep      = fs.Int("no-body-keep-bytes", 0, "Cut the msg of no-body logs down to this many bytes instead of emptying it")
+		match           = fs.String("match", "", "Drop logs whose msg doesn't match this regular expression")
+		exclude         = fs.String("exclude", "", "Drop logs whose msg matches this regular expression, wins over match")
+		utf8Mode        = fs.String("invalid-utf8", "drop", "What to do with invalid UTF-8 in msgs: drop, replace it with U+FFFD or escape it like \\xff")
+		readBuffer      = fs.Int("read-buffer-bytes", defaultReadBuffer, "Size of the read buffer of the input, a larger one needs fewer reads at a high throughput")
+		maxRead         = fs.Int("max-read-bytes", 0, "Cut lines longer than this many bytes while reading them, which bounds the memory a line without newline takes, 0 for no limit")
+		stripColors     = fs.Bool("strip-ansi", false, "Remove ANSI escape sequences like terminal colors from msgs")
+		maxLineBytes    = fs.Int("max-line-bytes", 0, "Truncate msgs longer than this many bytes before forwarding them, 0 for no limit")
+		redact          = fs.Bool("redact", false, "Mask emails, card numbers and bearer tokens in msgs before forwarding them")
+		redactPattern   = fs.String("redact-pattern", "", "Also mask the matches of this regular expression in msgs before forwarding them")
+		extract         = fs.String("extract", "", "Regular expression whose named capture groups in the msg become Loki labels, e.g. status=(?P<status>[0-9]+)")
+		logfmtLabels    = fs.String("logfmt-labels", "", "Comma separated keys of logfmt msgs like status=200 user=\"bob\" whose values become Loki labels, limited by extract-max-values")
+		extractMax      = fs.Int("extract-max-values", 100, "Drop new values of an extracted label once it had this many distinct ones, 0 for no limit")
+		multilineStart  = fs.String("multiline-start", "", "Msgs not matching this regular expression are appended to the previous log of their host and program, e.g. for stack traces")
+		multilineWait   = fs.Duration("multiline-timeout", time.Second, "Send a multiline log when no further msg arrived for it within this time")
+		dedupWindow     = fs.Duration("dedup-window", 0, "Collapse identical msgs of a host and program within this window into a repeat count, 0 disables it")
+		sampleRate      = fs.Float64("sample-rate", 1, "Forward only this fraction of the logs less severe than sample-below-severity")
+		sampleBelow     = fs.String("sample-below-severity", "notice", "Sample logs less severe than this syslog severity")
+		rateLimit       = fs.Float64("rate-limit", 0, "Forward at most this many logs per second and program, 0 disables the limit")
+		lokiURL         = fs.String("loki-url", "http://localhost:3100", "Loki Server URL, a base URL gets the push path appended and a URL ending in /push is used as is, unix:///path/to/socket pushes over a unix socket, Loki is only used next to other outputs when set explicitly")
 		lokiChanSize    = fs.Int("loki-chan-size", 10000, "Loki buffered channel capacity")
 		lokiBatchSize   = fs.Int("loki-batch-size", 1024*1024, "Loki will batch these bytes before sending them")
+		lokiBatchCount  = fs.Int("loki-batch-count", 0, "Loki will send logs after batching this many lines, 0 means no limit")
 		lokiBatchWait   = fs.Int("loki-batch-wait", 4, "Loki will send logs after these seconds")
+		lokiJitter      = fs.Float64("loki-batch-wait-jitter", 0, "Move every loki-batch-wait randomly by up to this fraction of it either way, so many instances don't push at the same time")
+		lokiMaxAge      = fs.Duration("loki-max-line-age", 0, "Loki will drop logs older than this when their batch is sent instead of pushing them, 0 keeps all")
+		lokiAdaptive    = fs.Bool("loki-adaptive-wait", false, "Loki will send logs before loki-batch-wait once the lines stop coming for a few of their average gaps")
+		lokiCompress    = fs.Bool("loki-compress", false, "Send gzip compressed JSON to Loki instead of snappy compressed protobuf")
+		lokiTenant      = fs.String("loki-tenant", "", "Loki tenant ID sent as X-Scope-OrgID header")
+		lokiUsername    = fs.String("loki-username", "", "Loki basic auth username, can't be used with loki-bearer-token")
+		lokiPassword    = fs.String("loki-password", "", "Loki basic auth password, can't be used with loki-bearer-token")
+		lokiBearerToken = fs.String("loki-bearer-token", "", "Loki bearer token, can't be used with loki-username/loki-password")
+		lokiCAFile      = fs.String("loki-ca-file", "", "Verify the Loki server with the PEM certificates in this file")
+		lokiCertFile    = fs.String("loki-cert-file", "", "PEM client certificate for mutual TLS with Loki, needs loki-key-file")
+		lokiKeyFile     = fs.String("loki-key-file", "", "PEM client key for mutual TLS with Loki, needs loki-cert-file")
+		lokiSkipVerify  = fs.Bool("loki-insecure-skip-verify", false, "Don't verify the certificate of the Loki server")
+		lokiLabels      = fs.String("loki-labels", strings.Join(streamLabelNames, ","), "Comma separated fields which become Loki stream labels, any of "+strings.Join(streamLabelNames, ", "))
+		lokiBufferLines = fs.Int("loki-buffer-lines", 0, "Hold up to this many lines of failed Loki batches in memory and send them when Loki is back, 0 disables it")
+		lokiSpoolDir    = fs.String("loki-spool-dir", "", "Spool failed Loki batches to this directory and send them when Loki is back, also after a restart")
+		lokiSpoolMax    = fs.Int64("loki-spool-max-bytes", 1024*1024*1024, "Evict the oldest spooled Loki batches beyond these bytes")
+		lokiReady       = fs.Bool("loki-require-ready", false, "Exit at startup unless the ready endpoint of Loki answers within loki-timeout")
+		lokiTimeout     = fs.Duration("loki-timeout", 5*time.Second, "Cancel a Loki push taking longer than this and retry it")
+		lokiIdleConns   = fs.Int("loki-max-idle-conns", 100, "Keep up to this many idle connections to Loki for reuse, 0 keeps Go's default of 100")
+		lokiIdlePerHost = fs.Int("loki-max-idle-conns-per-host", 16, "Keep up to this many idle connections per Loki host, 0 keeps Go's default of 2")
+		lokiIdleTimeout = fs.Duration("loki-idle-conn-timeout", 90*time.Second, "Close idle connections to Loki after this long, 0 keeps Go's default of 90s")
+		lokiMaxRetries  = fs.Int("loki-max-retries", 3, "Retry failed Loki pushes this many times with exponential backoff")
 		promOnly        = fs.Bool("prom-only", false, "Only metrics for Prometheus will be exposed")
+		check           = fs.Bool("check", false, "Parse the lines of stdin or input-file, print their fields or parse errors and exit, 1 if a line didn't parse")
+		dryRun          = fs.Bool("dry-run", false, "Parse and count logs but neither send them anywhere nor run cmd, print a summary at the end")
 		promAddr        = fs.String("prom-addr", ":9090", "Prometheus scrape endpoint address")
+		pprofAddr       = fs.String("pprof-addr", "", "Serve the pprof profiles under /debug/pprof/ on this address, empty disables them")
+		metricLabels    = fs.String("metric-labels", strings.Join(scanLabelNames, ","), "Comma separated labels of the input metrics, any of "+strings.Join(scanLabelNames, ", "))
+		noMetrics       = fs.Bool("no-metrics", false, "Don't serve metrics on prom-addr while forwarding logs")
 		staticTag       = fs.String("static-tag", "", "Will be used as a static label value with the name static_tag")
-		staticTagFilter = fs.String("static-tag-filter", "", "Set static-tag only when msg contains this string")
+		staticTagFilter = fs.String("static-tag-filter", "", "Set static-tag only when msg contains any of these comma separated strings")
+		staticTagRegex  = fs.String("static-tag-regex", "", "Set static-tag only when msg matches this regular expression, or contains one of static-tag-filter")
+		showVersion     = fs.Bool("version", false, "Print the version and exit")
+		esURL           = fs.String("es-url", "", "Send logs to this Elasticsearch/OpenSearch URL")
+		esIndex         = fs.String("es-index", "fancy-{program}-{yyyy.MM.dd}", "Elasticsearch index name template")
+		esBatchSize     = fs.Int("es-batch-size", 1024*1024, "Elasticsearch will batch these bytes before sending them")
+		esBatchWait     = fs.Int("es-batch-wait", 4, "Elasticsearch will send logs after these seconds")
+		webhookURL      = fs.String("webhook-url", "", "Post logs to this URL")
+		webhookTemplate = fs.String("webhook-template", defaultWebhookTemplate, "Go text/template for the webhook body, executed per log or per batch")
+		webhookBatch    = fs.Bool("webhook-batch", false, "Execute the webhook template over a list of logs instead of single logs")
+		webhookSize     = fs.Int("webhook-batch-size", 1000, "Webhook will batch this many logs before sending them")
+		webhookWait     = fs.Int("webhook-batch-wait", 4, "Webhook will send logs after these seconds")
+		kafkaBrokers    = fs.String("kafka-brokers", "", "Comma separated Kafka brokers, logs are produced to Kafka")
+		kafkaTopic      = fs.String("kafka-topic", "fancy", "Kafka topic")
+		filePath        = fs.String("file-path", "", "Write logs to this file")
+		fileTemplate    = fs.String("file-template", "", "Go text/template for each line in the file, JSON when empty")
+		fileMaxSize     = fs.Int64("file-max-size", 100*1024*1024, "Rotate the file when it grows beyond these bytes, 0 disables rotation")
+		fileMaxBackups  = fs.Int("file-max-backups", 5, "Keep this many rotated files")
+		outputJSON      = fs.Bool("output-json", false, "Write logs as JSON objects to stdout")
+		passthrough     = fs.Bool("passthrough", false, "Write logs to stdout like they came in, with the msg rewritten by cmd, redact and the other options, workers 1 keeps their order")
+		format          = fs.String("format", "fancy", "Input format: fancy, rfc5424, rfc3164 or json")
+		fieldSep        = fs.String("field-sep", " ", "Separator between the fields of the fancy template")
+		jsonLevelKey    = fs.String("json-level-key", "level", "JSON key used as level in json format")
+		jsonProgramKey  = fs.String("json-program-key", "service", "JSON key used as program in json format")
+		jsonHostKey     = fs.String("json-host-key", "host", "JSON key used as hostname in json format")
+		jsonTimeKey     = fs.String("json-time-key", "time", "JSON key used as timestamp in json format")
+		jsonLabelKeys   = fs.String("json-label-keys", "", "Comma separated JSON keys which become Loki labels in json format")
+		labelsFromEnv   = fs.String("labels-from-env", "", "Comma separated label=ENV_VAR pairs whose environment variable values are added to every Loki stream, e.g. pod=MY_POD_NAME")
+		onFull          = fs.String("on-full", "drop", "What to do when the Loki buffered channel is full: drop or block")
+		onFullTimeout   = fs.Duration("on-full-timeout", 0, "In block mode drop the log after waiting this long, 0 waits forever")
+		inputFile       = fs.String("input-file", "", "Read logs from this file or named pipe instead of stdin")
+		splitCR         = fs.Bool("split-cr", false, "Also end lines at a bare carriage return, CRLF line endings are always turned into LF")
+		inputGzip       = fs.Bool("input-gzip", false, "Decompress gzip input, input which starts like gzip is decompressed anyway unless tail is set")
+		syslogListen    = fs.String("syslog-listen", "", "Receive syslog on this TCP and UDP address like :514 instead of reading stdin, TCP messages are octet counted or end at a newline")
+		tail            = fs.Bool("tail", false, "Keep reading input-file as it grows and follow its truncation and rotation like tail -F")
+		configFile      = fs.String("config", "", "Load settings from this YAML file, explicit flags and FANCY_ environment variables take precedence, a SIGHUP reloads its match, exclude, label and labels-from-env")
+		logFormat       = fs.String("log-format", "text", "Format of fancy's own diagnostic output: text or json")
+		quiet           = fs.Bool("quiet", false, "Don't print the start and end lines with the flags")
+		logLevel        = fs.String("log-level", "info", "Drop fancy's own diagnostic output below this level: debug, info, warn or error")
 	)
+	labels := labelFlag{}
+	fs.Var(labels, "label", "Static key=value label added to every Loki stream, can be repeated")
+	var tagPats tagPatterns
+	fs.Var(&tagPats, "static-tag-pattern", "Named name=regex pattern, the name of the first one matching the msg becomes its static_tag instead of static-tag, can be repeated")
 	fs.Parse(os.Args[1:])
 
-	t := time.Now()
-	defer fmt.Fprintf(os.Stderr, "%v end fancy with flags %s\n", t, os.Args[1:])
+	if *showVersion {
+		fmt.Printf("fancy %s\n", version)
+		return
+	}
+
+	if err := applyEnv(fs, os.LookupEnv); err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+
+	var reload *reloader
+	var programSections map[string]map[string]string
+	if *configFile != "" {
+		reload = newReloader(*configFile, fs, labels)
+		c, err := loadConfig(*configFile)
+		if err == nil {
+			err = c.apply(fs)
+		}
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		programSections = c.Programs
+	}
+
+	if err := validateFlags(fs); err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+	if err := labels.setFromEnv(*labelsFromEnv, os.LookupEnv); err != nil {
+		logErrorf("invalid labels-from-env: %v", err)
+		os.Exit(1)
+	}
+	scanSize = *scanBatch
+	invalidUTF8 = *utf8Mode
+	logs.json = *logFormat == "json"
+	logs.level = logLevels[*logLevel]
+
+	if *fieldSep == "" {
+		logErrorf("field-sep must not be empty")
+		os.Exit(1)
+	}
+
+	parse, ok := parsers[*format]
+	if *format == "json" {
+		parse, ok = (&jsonParser{
+			levelKey:   *jsonLevelKey,
+			programKey: *jsonProgramKey,
+			hostKey:    *jsonHostKey,
+			timeKey:    *jsonTimeKey,
+			labelKeys:  splitList(*jsonLabelKeys),
+		}).parse, true
+	}
+	if *format == "fancy" && *fieldSep != " " {
+		parse = (&fancyParser{sep: []byte(*fieldSep)}).parse
+	}
+	if !ok {
+		logErrorf("invalid format %q, want fancy, rfc5424, rfc3164 or json", *format)
+		os.Exit(1)
+	}
+
+	severityNames, err := parseSeverityMap(*severities)
+	if err != nil {
+		logErrorf("invalid severity-map: %v", err)
+		os.Exit(1)
+	}
+
+	if _, ok := severityLevels[*minSeverity]; !ok && *minSeverity != "" {
+		logErrorf("invalid min-severity value %q, want a syslog severity like warning", *minSeverity)
+		os.Exit(1)
+	}
+
+	sources, err := newSourceFilter(*programAllow, *programDeny, *hostAllow, *hostDeny)
+	if err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+
+	programs, err := newProgramOverrides(programSections, func(name string) string {
+		return fs.Lookup(name).Value.String()
+	})
+	if err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+
+	dropBody, err := newBodyDropper(*noBody, *noBodyPrograms, *noBodyKeep)
+	if err != nil {
+		logErrorf("invalid no-body-programs: %v", err)
+		os.Exit(1)
+	}
+
+	matchRe, err := compileFilter(*match)
+	if err != nil {
+		logErrorf("invalid match: %v", err)
+		os.Exit(1)
+	}
+	excludeRe, err := compileFilter(*exclude)
+	if err != nil {
+		logErrorf("invalid exclude: %v", err)
+		os.Exit(1)
+	}
+
+	redactRules, err := newRedactor(*redact, *redactPattern)
+	if err != nil {
+		logErrorf("invalid redact-pattern: %v", err)
+		os.Exit(1)
+	}
+
+	var labelExtractor *extractor
+	if *extract != "" {
+		if labelExtractor, err = newExtractor(*extract, *extractMax); err != nil {
+			logErrorf("invalid extract: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var logfmt *logfmtExtractor
+	if *logfmtLabels != "" {
+		if logfmt, err = newLogfmtExtractor(*logfmtLabels, *extractMax); err != nil {
+			logErrorf("invalid logfmt-labels: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	staticTagRe, err := compileFilter(*staticTagRegex)
+	if err != nil {
+		logErrorf("invalid static-tag-regex: %v", err)
+		os.Exit(1)
+	}
+
+	multilineRe, err := compileFilter(*multilineStart)
+	if err != nil {
+		logErrorf("invalid multiline-start: %v", err)
+		os.Exit(1)
+	}
+
+	if _, ok := severityLevels[*sampleBelow]; !ok {
+		logErrorf("invalid sample-below-severity value %q, want a syslog severity like notice", *sampleBelow)
+		os.Exit(1)
+	}
+
+	if err := setScanLabels(splitList(*metricLabels)); err != nil {
+		logErrorf("invalid metric-labels: %v", err)
+		os.Exit(1)
+	}
+
+	streamLabels := splitList(*lokiLabels)
+	for _, name := range streamLabels {
+		if _, ok := scanLabelValue(name, &LogLine{}); !ok {
+			logErrorf("invalid loki-labels: unknown field %q", name)
+			os.Exit(1)
+		}
+	}
+	if streamLabels == nil {
+		streamLabels = []string{}
+	}
+
+	if *tail && *inputFile == "" {
+		logErrorf("tail needs an input-file")
+		os.Exit(1)
+	}
+	if *tail && *inputGzip {
+		logErrorf("tail can't follow gzip input")
+		os.Exit(1)
+	}
+	if *syslogListen != "" && (*inputFile != "" || *check) {
+		logErrorf("syslog-listen can't be combined with input-file or check")
+		os.Exit(1)
+	}
+	stdin, err := openInput(*inputFile, *tail)
+	if err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+	defer stdin.Close()
+	var src io.Reader = stdin
+	if !*tail {
+		src = newGunzipReader(src, !*inputGzip)
+	}
+	if *splitCR {
+		src = newCRReader(src)
+	}
+
+	// check neither needs the outputs nor the metrics server
+	if *check {
+		ok, err := checkLines(os.Stdout, src, parse)
+		if err != nil {
+			logErrorf("check: %v", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	args := redactArgs(os.Args[1:])
+	if !*quiet {
+		defer logInfof("end fancy with flags %s", args)
+	}
+	start := time.Now()
 
 	input := &Input{
-		cmd:             strings.Fields(*cmd),
+		parse:           parse,
 		promOnly:        *promOnly,
 		staticTag:       *staticTag,
-		staticTagFilter: []byte(*staticTagFilter),
-		scanChan:        make(chan [scanSize][]byte, 1000),
+		staticTagFilter: newTagFilter(*staticTagFilter, staticTagRe),
+		tagPatterns:     tagPats,
+		severities:      severityNames,
+		extract:         labelExtractor,
+		logfmt:          logfmt,
+		redact:          redactRules,
+		maxLineBytes:    *maxLineBytes,
+		stripANSI:       *stripColors,
+		maxRead:         *maxRead,
+		readBuffer:      *readBuffer,
+		sources:         sources,
+		dropBody:        dropBody,
+		programs:        programs,
+		minSeverity:     *minSeverity,
+		sampleRate:      *sampleRate,
+		sampleBelow:     *sampleBelow,
+		blockOnFull:     *onFull == "block",
+		blockTimeout:    *onFullTimeout,
+		scanChan:        make(chan [][]byte, 1000),
+		quit:            make(chan struct{}),
+	}
+
+	input.setFilters(&filters{match: matchRe, exclude: excludeRe})
+
+	// a pipe process runs for good, so every stage needs a slot of its own
+	if n := len(cmdStages(*cmd)); *cmdMode == "pipe" && *cmdMaxConc > 0 && n > *cmdMaxConc {
+		logErrorf("invalid cmd-max-concurrent value %d, pipe mode runs a process for each of the %d stages", *cmdMaxConc, n)
+		os.Exit(1)
+	}
+	input.cmd = newCmd(*cmd, *cmdMode, CmdConfig{
+		Timeout:   *cmdTimeout,
+		MaxOutput: *cmdMaxOutput,
+		Limit:     newProcLimit(*cmdMaxConc, *cmdOnBusy == "drop"),
+	})
+	input.cmdKeepOnExit = *cmdKeepOnExit
+	input.cmdInput = *cmdInput
+	input.cmdOutput = *cmdOutput
+
+	defer func() { logInfof("%s", input.counts.summary(time.Since(start))) }()
+
+	if *dryRun {
+		input.stats = newDryRunStats()
+		defer func() { logInfof("%s", input.stats.summary()) }()
+	}
+
+	if *rateLimit > 0 {
+		input.limiter = newRateLimiter(*rateLimit)
 	}
 
-	if *promOnly {
+	if *promOnly || !*noMetrics {
 		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			err := http.ListenAndServe(*promAddr, nil)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v ERROR: %v\n", t, err)
+			err := http.ListenAndServe(*promAddr, metricsMux())
+			if err != nil && *promOnly {
+				logErrorf("%v", err)
 				os.Exit(1)
 			}
+			// don't give up forwarding, e.g. when several instances run on one host
+			logErrorf("metrics disabled: %v", err)
 		}()
-	} else if len(*lokiURL) > 3 {
-		input.useLoki = true
-		input.lineChan = make(chan *LogLine, *lokiChanSize)
-		defer close(input.lineChan)
-		l, err := NewLoki(input.lineChan, *lokiURL, *lokiBatchSize, *lokiBatchWait)
+	}
+
+	if *pprofAddr != "" {
+		go func() {
+			// a separate listener keeps the profiles off the scrape endpoint
+			logErrorf("pprof disabled: %v", http.ListenAndServe(*pprofAddr, pprofMux()))
+		}()
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	// dry-run and prom-only don't forward logs
+	noOutput := *promOnly || *dryRun
+	sinks := map[string]Sink{}
+	if *outputJSON && *passthrough {
+		logErrorf("output-json and passthrough can't both write to stdout")
+		os.Exit(1)
+	}
+	if !noOutput && *outputJSON {
+		sinks["stdout"] = NewJSONWriter(os.Stdout)
+	}
+	if !noOutput && *passthrough {
+		input.passthrough = true
+		sinks["stdout"] = NewPassthroughWriter(os.Stdout)
+	}
+	if !noOutput && *filePath != "" {
+		f, err := NewFileSink(FileConfig{
+			Path:       *filePath,
+			Template:   *fileTemplate,
+			MaxSize:    *fileMaxSize,
+			MaxBackups: *fileMaxBackups,
+		})
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		sinks["file"] = f
+	}
+	if !noOutput && *kafkaBrokers != "" {
+		p := newKafkaProducer(splitList(*kafkaBrokers), *kafkaTopic)
+		sinks["kafka"] = NewKafkaSink(p, KafkaConfig{
+			BatchSize: *lokiBatchSize,
+			BatchWait: *lokiBatchWait,
+		})
+	}
+	if !noOutput && *webhookURL != "" {
+		w, err := NewWebhook(WebhookConfig{
+			URL:       *webhookURL,
+			Template:  *webhookTemplate,
+			Batch:     *webhookBatch,
+			BatchSize: *webhookSize,
+			BatchWait: *webhookWait,
+		})
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		sinks["webhook"] = w
+	}
+	if !noOutput && *esURL != "" {
+		e, err := NewESClient(ESConfig{
+			URL:       *esURL,
+			Index:     *esIndex,
+			BatchSize: *esBatchSize,
+			BatchWait: *esBatchWait,
+		})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v ERROR: %v\n", t, err)
+			logErrorf("%v", err)
 			os.Exit(1)
 		}
-		go l.Run()
+		sinks["es"] = e
+	}
+	// Loki stays the default output, next to the others only on request
+	if !noOutput && len(*lokiURL) > 3 && (len(sinks) == 0 || explicit["loki-url"]) {
+		l, err := NewLoki(LokiConfig{
+			URL:           *lokiURL,
+			BatchSize:     *lokiBatchSize,
+			BatchWait:     *lokiBatchWait,
+			BatchJitter:   *lokiJitter,
+			BatchCount:    *lokiBatchCount,
+			AdaptiveWait:  *lokiAdaptive,
+			Compress:      *lokiCompress,
+			Tenant:        *lokiTenant,
+			Username:      *lokiUsername,
+			Password:      *lokiPassword,
+			BearerToken:   *lokiBearerToken,
+			MaxRetries:    *lokiMaxRetries,
+			Timeout:       *lokiTimeout,
+			MaxLineAge:    *lokiMaxAge,
+			BufferLines:   *lokiBufferLines,
+			SpoolDir:      *lokiSpoolDir,
+			SpoolMaxBytes: *lokiSpoolMax,
+			Labels:        labels,
+			StreamLabels:  streamLabels,
+			TLS: TLSConfig{
+				CAFile:             *lokiCAFile,
+				CertFile:           *lokiCertFile,
+				KeyFile:            *lokiKeyFile,
+				InsecureSkipVerify: *lokiSkipVerify,
+			},
+			Pool: PoolConfig{
+				MaxIdleConns:        *lokiIdleConns,
+				MaxIdleConnsPerHost: *lokiIdlePerHost,
+				IdleConnTimeout:     *lokiIdleTimeout,
+			},
+		})
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if *lokiReady {
+			if err := l.ready(); err != nil {
+				logErrorf("Loki is not ready: %v", err)
+				os.Exit(1)
+			}
+		}
+		sinks["loki"] = l
+	}
+
+	var sinkDone chan struct{}
+	if len(sinks) > 0 {
+		input.forward = true
+		input.lineChan = make(chan *LogLine, *lokiChanSize)
+		go sampleChannel(input.lineChan, time.Second)
+		sinkDone = runSinks(input.lineChan, sinks, *lokiChanSize, input.blockOnFull)
 	}
 
-	fmt.Fprintf(os.Stderr, "%v run fancy v.%s with flags %s\n", time.Now(), version, os.Args[1:])
-	for i := 0; i < 8; i++ {
-		go input.process()
+	if input.cmd != nil && input.forward {
+		input.startCmdWorkers(*cmdWorkers)
 	}
 
-	input.scan(os.Stderr, os.Stdin)
+	if *dedupWindow > 0 && input.forward {
+		input.dedup = newDeduper(*dedupWindow)
+		go func() {
+			t := time.Now()
+			input.dedup.run(func(ll *LogLine) { input.send(ll, &t) })
+		}()
+	}
+
+	if multilineRe != nil && input.forward {
+		input.stitch = newStitcher(multilineRe, *multilineWait)
+		go func() {
+			t := time.Now()
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+			input.stitch.run(func(ll *LogLine) { input.handle(ll, rnd, &t) })
+		}()
+		if *workers > 1 {
+			// the msgs of a stack trace must be stitched in order
+			logInfof("multiline-start is set, parsing in a single worker")
+			*workers = 1
+		}
+	}
+
+	if !*quiet {
+		logInfof("run fancy v.%s with flags %s", version, args)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		health.addWorkers(1)
+		go func() {
+			input.process()
+			health.addWorkers(-1)
+			wg.Done()
+		}()
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if reload != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reload.run(hup, input, sinks)
+	}
+	var listener *syslogListener
+	if *syslogListen != "" {
+		if listener, err = listenSyslog(*syslogListen); err != nil {
+			logErrorf("syslog-listen: %v", err)
+			os.Exit(1)
+		}
+		logInfof("receiving syslog on %s", listener.tcp.Addr())
+	}
+	scanDone := make(chan struct{})
+	health.setScanning(true)
+	go func() {
+		if listener != nil {
+			input.serveSyslog(listener)
+		} else {
+			input.scan(os.Stderr, src)
+		}
+		health.setScanning(false)
+		close(scanDone)
+	}()
+
+	select {
+	case <-scanDone:
+	case sig := <-sigChan:
+		logInfof("received %v, shutting down", sig)
+		input.stop()
+	}
+	input.shutdown(scanDone, &wg, sinkDone)
 }
 
 var (
-	logScanNumber = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "fancy_input_scan_total",
-		Help: "Total number of logs received from rsyslog fancy template"},
-		[]string{"hostname", "program", "level", "static_tag"})
-	logScanSize = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "fancy_input_raw_bytes_total",
-		Help: "Total number of bytes received from rsyslog fancy template"},
-		[]string{"hostname", "program"})
+	lokiChanUsage = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fancy_loki_channel_usage",
+		Help: "Number of logs waiting in the Loki buffered channel"})
+	lokiChanCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fancy_loki_channel_capacity",
+		Help: "Capacity of the Loki buffered channel"})
+	lokiDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_loki_dropped_total",
+		Help: "Total number of logs dropped because the Loki buffered channel was full"},
+		[]string{"program", "level"})
+	severityFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_severity_filtered_total",
+		Help: "Total number of logs dropped because they were less severe than min-severity"},
+		[]string{"level"})
+	regexFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_regex_filtered_total",
+		Help: "Total number of logs dropped by the match or exclude regular expression"},
+		[]string{"filter"})
+	scannerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_scanner_errors_total",
+		Help: "Total number of errors other than EOF reading the input by action: retry or stop"},
+		[]string{"action"})
+	activeWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fancy_active_workers",
+		Help: "Number of workers handling a batch of lines right now instead of waiting for one, a stuck cmd or output keeps them busy"})
+	oversizedLines = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_oversized_lines_total",
+		Help: "Total number of lines cut to max-read-bytes while reading them"})
+	truncatedLines = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_truncated_lines_total",
+		Help: "Total number of msgs truncated to max-line-bytes"})
+	sampledOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_sampled_out_total",
+		Help: "Total number of logs dropped by sampling"},
+		[]string{"level"})
 )
 
+// secretFlags hold credentials, which must not show up in the logs.
+var secretFlags = map[string]bool{
+	"loki-password":     true,
+	"loki-bearer-token": true,
+}
+
+// redactArgs returns a copy of args with the values of secretFlags masked.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		name := strings.TrimLeft(out[i], "-")
+		if name == out[i] || name == "" {
+			continue
+		}
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			if secretFlags[name[:j]] {
+				out[i] = out[i][:len(out[i])-len(name)+j+1] + redactMask
+			}
+			continue
+		}
+		if secretFlags[name] && i+1 < len(out) {
+			i++
+			out[i] = redactMask
+		}
+	}
+	return out
+}
+
+// splitList splits a comma separated flag value and drops empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// labelFlag collects repeated key=value flags as static Loki labels.
+type labelFlag map[string]string
+
+func (f labelFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return fmt.Errorf("label %q is not key=value", s)
+	}
+	k, v := s[:i], s[i+1:]
+	if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+		return fmt.Errorf("invalid label name %q", k)
+	}
+	if reservedLabel(k) {
+		return fmt.Errorf("label %q is set by fancy itself", k)
+	}
+	if !model.LabelValue(v).IsValid() {
+		return fmt.Errorf("invalid value of label %q", k)
+	}
+	f[k] = v
+	return nil
+}
+
+// setFromEnv adds the labels of the comma separated label=ENV_VAR pairs of
+// spec with the values of their environment variables. Missing variables
+// are skipped with a warning and labels set with -label are kept.
+func (f labelFlag) setFromEnv(spec string, lookup func(string) (string, bool)) error {
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i < 1 || i == len(pair)-1 {
+			return fmt.Errorf("%q is not label=ENV_VAR", pair)
+		}
+		k, name := pair[:i], pair[i+1:]
+		if _, ok := f[k]; ok {
+			continue
+		}
+		v, ok := lookup(name)
+		if !ok {
+			logWarnf("labels-from-env: %s is not set, skipping label %s", name, k)
+			continue
+		}
+		if err := f.Set(k + "=" + v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reservedLabel reports whether fancy sets the label k itself.
+func reservedLabel(k string) bool {
+	switch k {
+	case "job", "level", "hostname", "program", "static_tag":
+		return true
+	}
+	return false
+}
+
+// sampleChannel updates the Loki channel gauges every interval.
+func sampleChannel(c chan *LogLine, interval time.Duration) {
+	for range time.Tick(interval) {
+		updateChannelGauges(c)
+	}
+}
+
+func updateChannelGauges(c chan *LogLine) {
+	lokiChanUsage.Set(float64(len(c)))
+	lokiChanCapacity.Set(float64(cap(c)))
+}
+
 type Input struct {
-	cmd             []string
+	// counts comes first to keep its counters 64-bit aligned
+	counts          throughput
+	cmd             commander
+	cmdKeepOnExit   bool
+	cmdInput        string
+	cmdOutput       string
+	cmdChan         chan *LogLine
+	cmdWorkers      sync.WaitGroup
+	parse           parser
 	cache           Cache
-	useLoki         bool
-	scanChan        chan [scanSize][]byte
+	forward         bool
+	scanChan        chan [][]byte
 	lineChan        chan *LogLine
 	promOnly        bool
 	staticTag       string
-	staticTagFilter []byte
+	staticTagFilter *tagFilter
+	tagPatterns     tagPatterns
+	severities      severityMap
+	extract         *extractor
+	logfmt          *logfmtExtractor
+	redact          redactor
+	maxLineBytes    int
+	stripANSI       bool
+	maxRead         int
+	readBuffer      int
+	sources         *sourceFilter
+	dropBody        *bodyDropper
+	programs        *programOverrides
+	passthrough     bool
+	minSeverity     string
+	sampleRate      float64
+	sampleBelow     string
+	filters         atomic.Value // *filters, swapped by a reload
+	limiter         *rateLimiter
+	dedup           *deduper
+	stitch          *stitcher
+	stats           *dryRunStats
+	blockOnFull     bool
+	blockTimeout    time.Duration
+	quit            chan struct{}
+	quitOnce        sync.Once
 }
 
 type Cache struct {
-	buf [scanSize][]byte
-	pos int
+	buf [][]byte
 }
 
-func batchScan(c chan [scanSize][]byte, cache *Cache, value []byte) {
-	cache.buf[cache.pos] = value
-	cache.pos++
-	if cache.pos == scanSize {
+// batchPool holds batches process is done with. A batch keeps the buffers
+// of its lines, so refilling it doesn't allocate once they are big enough.
+var batchPool = sync.Pool{
+	New: func() interface{} { return make([][]byte, 0, scanSize) },
+}
+
+// releaseBatch hands a batch back to batchPool. Its lines must not be used
+// afterwards.
+func releaseBatch(b [][]byte) {
+	if cap(b) == scanSize {
+		batchPool.Put(b[:0])
+	}
+}
+
+// batchScan copies a line into the current batch and hands the batch over to
+// process once it holds scanSize lines. The batch comes from batchPool, since
+// the receiver keeps a reference to it until it releases it.
+func batchScan(c chan [][]byte, cache *Cache, value []byte) {
+	if cache.buf == nil {
+		cache.buf = batchPool.Get().([][]byte)
+		if cap(cache.buf) != scanSize {
+			cache.buf = make([][]byte, 0, scanSize)
+		}
+	}
+	// reuse the buffer the slot held in an earlier round
+	n := len(cache.buf)
+	cache.buf = cache.buf[:n+1]
+	cache.buf[n] = append(cache.buf[n][:0], value...)
+	if len(cache.buf) == scanSize {
 		c <- cache.buf
-		cache.pos = 0
+		cache.buf = nil
 	}
 }
 
+// flush sends the partially filled buffer so lines left over when the
+// input ends are not lost.
+func (cache *Cache) flush(c chan [][]byte) {
+	if len(cache.buf) == 0 {
+		return
+	}
+	c <- cache.buf
+	cache.buf = nil
+}
+
+// scan reads stdin until EOF or until stop is called. The reading itself
+// happens in its own goroutine, so a stop does not have to wait for the
+// next line when stdin sits idle.
 func (in *Input) scan(stderr io.Writer, stdin io.Reader) {
-	var err error
-	r := bufio.NewReader(stdin)
-	line := make([]byte, 0, 8192)
 	defer close(in.scanChan)
+	batches := make(chan [][]byte)
+	go in.read(stderr, stdin, batches)
 	for {
-		line, err = r.ReadBytes('\n')
+		select {
+		case b, ok := <-batches:
+			if !ok {
+				return
+			}
+			in.scanChan <- b
+		case <-in.quit:
+			// pick up lines the reader is still batching
+			for {
+				select {
+				case b, ok := <-batches:
+					if !ok {
+						return
+					}
+					in.scanChan <- b
+				case <-time.After(quitWait):
+					return
+				}
+			}
+		}
+	}
+}
+
+func (in *Input) read(stderr io.Writer, stdin io.Reader, batches chan [][]byte) {
+	size := in.readBuffer
+	if size == 0 {
+		size = defaultReadBuffer
+	}
+	r := bufio.NewReaderSize(stdin, size)
+	line := make([]byte, 0, 8192)
+	skip := false
+	retries := 0
+	defer close(batches)
+	for {
+		// don't hold back a partial batch while waiting for more input
+		if r.Buffered() == 0 {
+			in.cache.flush(batches)
+		}
+		b, err := r.ReadSlice('\n')
+		if !skip {
+			line = append(line, b...)
+		}
+		if in.maxRead > 0 && len(line) > in.maxRead {
+			// keep the head with the fields and skip the rest of the line
+			line = line[:in.maxRead]
+			if !skip {
+				skip = true
+				oversizedLines.Inc()
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF && transientReadError(err) && retries < maxReadRetries {
+			// the line read so far stays, the next read continues it
+			scannerErrors.WithLabelValues("retry").Inc()
+			logs.printf(stderr, "warn", "%v, reading again", err)
+			retries++
+			time.Sleep(time.Duration(retries) * quitWait)
+			continue
+		}
 		if err != nil {
+			if err != io.EOF {
+				scannerErrors.WithLabelValues("stop").Inc()
+			}
+			if line = trimCR(line); len(line) > 0 {
+				batchScan(batches, &in.cache, line)
+				in.counts.scan(len(line))
+			}
+			in.cache.flush(batches)
 			if err == io.EOF {
-				fmt.Fprintf(stderr, "%v INFO: %v\n", time.Now(), err)
+				logs.printf(stderr, "info", "%v", err)
 				break
 			}
-			fmt.Fprintf(stderr, "%v ERROR: %v\n", time.Now(), err)
+			logs.printf(stderr, "error", "%v", err)
 			break
 		}
-		batchScan(in.scanChan, &in.cache, line)
+		line = trimCR(line)
+		batchScan(batches, &in.cache, line)
+		in.counts.scan(len(line))
+		line = line[:0]
+		skip = false
+		retries = 0
+	}
+}
+
+// maxReadRetries is how often read tries again after transient errors in a
+// row before it gives up.
+const maxReadRetries = 3
+
+// transientReadError reports whether reading may work again after err, like
+// after an interrupted system call.
+func transientReadError(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// stop makes scan return without waiting for further input.
+func (in *Input) stop() {
+	in.quitOnce.Do(func() {
+		close(in.quit)
+	})
+}
+
+// shutdown waits for scan to return, then for the process workers to drain
+// scanChan and finally for the output, e.g. Loki, to send its last batch.
+func (in *Input) shutdown(scanDone <-chan struct{}, workers *sync.WaitGroup, sinkDone <-chan struct{}) {
+	<-scanDone
+	workers.Wait()
+	if in.stitch != nil {
+		t := time.Now()
+		rnd := rand.New(rand.NewSource(t.UnixNano()))
+		for _, ll := range in.stitch.stop() {
+			in.handle(ll, rnd, &t)
+		}
+	}
+	if in.cmdChan != nil {
+		close(in.cmdChan)
+		in.cmdWorkers.Wait()
+	}
+	if in.cmd != nil {
+		in.cmd.close()
+	}
+	if in.dedup != nil {
+		t := time.Now()
+		for _, ll := range in.dedup.stop() {
+			in.send(ll, &t)
+		}
+	}
+	if sinkDone != nil {
+		close(in.lineChan)
+		<-sinkDone
+	}
+}
+
+// openInput opens the file to read logs from, stdin if path is empty. A
+// regular file is read until EOF like a closed stdin unless tail is set, a
+// named pipe just like stdin.
+func openInput(path string, tail bool) (io.ReadCloser, error) {
+	if path == "" {
+		return os.Stdin, nil
+	}
+	if tail {
+		return newTailReader(path)
+	}
+	return os.Open(path)
+}
+
+// metricsMux serves the Prometheus metrics and the health endpoints.
+func metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.healthz)
+	mux.HandleFunc("/readyz", health.readyz)
+	return mux
+}
+
+// pprofMux serves the runtime profiles of net/http/pprof.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// compileFilter compiles a match or exclude expression, an empty one is nil.
+func compileFilter(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// filter returns the name of the expression which drops ll, or an empty
+// string when ll passes. exclude takes precedence over match, a programs
+// section of the config may set them for the program of ll.
+func (in *Input) filter(ll *LogLine) string {
+	msg := ll.Raw[ll.MsgPos:]
+	var match, exclude *regexp.Regexp
+	if f, _ := in.filters.Load().(*filters); f != nil {
+		match, exclude = f.match, f.exclude
+	}
+	if o := in.programs.lookup(ll.Program); o != nil {
+		if o.setMatch {
+			match = o.match
+		}
+		if o.setExclude {
+			exclude = o.exclude
+		}
+	}
+	if exclude != nil && exclude.Match(msg) {
+		return "exclude"
+	}
+	if match != nil && !match.Match(msg) {
+		return "match"
+	}
+	return ""
+}
+
+// resolveStaticTag returns the static tag for a single line. It must not
+// touch shared Input state since process runs in several goroutines.
+func (in *Input) resolveStaticTag(ll *LogLine) string {
+	if name := in.tagPatterns.match(ll.Raw[ll.MsgPos:]); name != "" {
+		return name
+	}
+	if in.staticTagFilter != nil && !in.staticTagFilter.match(ll.Raw[ll.MsgPos:]) {
+		return ""
+	}
+	return in.staticTag
+}
+
+// sendBlocking waits until lineChan has room for ll. With a blockTimeout it
+// gives up after that duration and reports false.
+func (in *Input) sendBlocking(ll *LogLine) bool {
+	if in.blockTimeout <= 0 {
+		in.lineChan <- ll
+		return true
+	}
+	timer := time.NewTimer(in.blockTimeout)
+	defer timer.Stop()
+	select {
+	case in.lineChan <- ll:
+		return true
+	case <-timer.C:
+		return false
 	}
 }
 
 func (in *Input) process() {
 	t := time.Now()
-	staticTag := in.staticTag
+	parse := in.parse
+	if parse == nil {
+		parse = parseLine
+	}
+	// every worker has its own source, so sampling needs no locking
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for s := range in.scanChan {
+		// per batch instead of per line keeps the gauge off the hot path
+		activeWorkers.Inc()
+		// the batches carry no time, one per batch is close enough
+		ingested := time.Now()
 		for i := 0; i < len(s); i++ {
-			ll, err := parseLine(s[i], in.promOnly)
+			ll, err := parse(s[i], in.promOnly)
+			if err == nil {
+				ll.Ingested = ingested
+			}
+			if err == nil && len(in.severities) > 0 {
+				ll.Severity = in.severities.apply(ll.Severity)
+			}
+			if err == nil && in.stripANSI && !in.promOnly {
+				ll.Msg = stripANSI(ll.Msg)
+			}
+			if err == nil && in.maxLineBytes > 0 && !in.promOnly && ll.truncate(in.maxLineBytes) > 0 {
+				truncatedLines.Inc()
+			}
+			if in.stats != nil {
+				in.stats.add(ll, err)
+			}
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v ERROR: %v\n", time.Now(), err)
+				parseErrors.WithLabelValues(parseErrorReason(err)).Inc()
+				logErrorf("%v", err)
 				continue
 			}
 
-			if len(in.staticTagFilter) > 0 {
-				staticTag = ""
-				if bytes.Contains(ll.Raw[ll.MsgPos:], in.staticTagFilter) {
-					staticTag = in.staticTag
+			if in.stitch != nil {
+				if ll = in.stitch.add(ll); ll == nil {
+					continue
 				}
 			}
+			in.handle(ll, rnd, &t)
+		}
+		in.counts.process(len(s))
+		releaseBatch(s)
+		activeWorkers.Dec()
+	}
+}
 
-			ll.StaticTag = staticTag
+// handle filters a parsed line, counts it and hands it on to cmd or the
+// outputs.
+func (in *Input) handle(ll *LogLine, rnd *rand.Rand, t *time.Time) {
+	o := in.programs.lookup(ll.Program)
+	minSeverity := in.minSeverity
+	if o != nil {
+		minSeverity = o.minSeverity
+	}
+	if belowSeverity(ll.Severity, minSeverity) {
+		severityFiltered.WithLabelValues(ll.Severity).Inc()
+		return
+	}
 
-			if in.promOnly {
-				rawSize := float64(len(ll.Raw))
-				logScanNumber.WithLabelValues(ll.Hostname, ll.Program, ll.Severity, staticTag).Inc()
-				logScanSize.WithLabelValues(ll.Hostname, ll.Program).Add(rawSize)
-				continue
-			}
+	if in.sources != nil {
+		if field, list := in.sources.filter(ll); field != "" {
+			sourceFiltered.WithLabelValues(field, list).Inc()
+			return
+		}
+	}
 
-			if len(in.cmd) > 0 && in.useLoki {
-				c := exec.Command(in.cmd[0], in.cmd[1:]...)
-				c.Stdin = bytes.NewReader(ll.Raw[ll.MsgPos:])
-				out, err := c.Output()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "%v ERROR: %v\n", time.Now(), err)
-					continue
-				}
-				ll.Msg = string(out)
-			}
+	if reason := in.filter(ll); reason != "" {
+		regexFiltered.WithLabelValues(reason).Inc()
+		return
+	}
 
-			if in.useLoki {
-				select {
-				case in.lineChan <- ll:
-				default:
-					if time.Since(t) > 1e9 {
-						fmt.Fprintf(os.Stderr, "%v ERROR: overflowing Loki buffered channel capacity\n", t)
-					}
-					t = time.Now()
+	ll.StaticTag = in.resolveStaticTag(ll)
+	// dedup holds on to lines beyond their batch, so take the head now
+	if in.passthrough && ll.MsgPos <= len(ll.Raw) {
+		ll.Head = string(ll.Raw[:ll.MsgPos])
+	}
+
+	countScan(ll)
+	if in.promOnly {
+		return
+	}
+
+	if in.extract != nil {
+		in.extract.apply(ll)
+	}
+	if in.logfmt != nil {
+		in.logfmt.apply(ll)
+	}
+
+	if in.sampleRate < 1 && belowSeverity(ll.Severity, in.sampleBelow) && rnd.Float64() >= in.sampleRate {
+		sampledOut.WithLabelValues(ll.Severity).Inc()
+		return
+	}
+
+	if in.dedup != nil {
+		summary, ok := in.dedup.add(ll)
+		if summary != nil {
+			in.send(summary, t)
+		}
+		if !ok {
+			return
+		}
+	}
+
+	limiter := in.limiter
+	if o != nil {
+		limiter = o.limiter
+	}
+	if limiter != nil && !limiter.allow(ll.Program) {
+		rateLimited.WithLabelValues(ll.Program).Inc()
+		return
+	}
+
+	if in.cmdChan != nil {
+		// the cmd workers outlive the batch holding Raw
+		ll.Raw = append([]byte(nil), ll.Raw...)
+		in.cmdChan <- ll
+		return
+	}
+	if in.cmd != nil && in.forward && !in.rewrite(ll) {
+		return
+	}
+	if in.forward {
+		in.send(ll, t)
+	}
+}
+
+// rewrite replaces the msg of ll with the output of cmd. It reports false
+// when the line should be dropped. A timeout or too much output keeps the
+// original msg, so does a nonzero exit with cmdKeepOnExit.
+func (in *Input) rewrite(ll *LogLine) bool {
+	start := time.Now()
+	out, err := in.cmd.run(in.cmdPayload(ll))
+	cmdDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		cmdErrors.WithLabelValues(cmdErrorReason(err)).Inc()
+	}
+	switch err.(type) {
+	case nil:
+		in.applyCmdOutput(ll, out)
+		return true
+	case *cmdStderrError:
+		logWarnf("%v", err)
+		in.applyCmdOutput(ll, out)
+		return true
+	case *cmdExitError:
+		logWarnf("%v", err)
+		return in.cmdKeepOnExit
+	}
+	if err == errCmdTimeout || err == errCmdOutput {
+		return true
+	}
+	if err == errCmdBusy {
+		// counted above, a log per msg would flood the logs
+		return false
+	}
+	logErrorf("%v", err)
+	return false
+}
+
+// cmdPayload returns what cmd gets on stdin for ll: the msg, the whole raw
+// line or all fields as a JSON object, depending on cmdInput.
+func (in *Input) cmdPayload(ll *LogLine) []byte {
+	switch in.cmdInput {
+	case "raw":
+		return ll.Raw
+	case "json":
+		b, err := json.Marshal(newJSONLine(ll))
+		if err != nil {
+			logErrorf("encode cmd input: %v", err)
+			return ll.Raw[ll.MsgPos:]
+		}
+		return append(b, '\n')
+	}
+	return ll.Raw[ll.MsgPos:]
+}
+
+// cmdResult holds the fields a JSON cmd output may replace, absent ones
+// are left alone.
+type cmdResult struct {
+	Host    *string           `json:"host"`
+	Program *string           `json:"program"`
+	Level   *string           `json:"level"`
+	Msg     *string           `json:"msg"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// applyCmdOutput sets the msg of ll to the output of cmd or, with cmdOutput
+// json, the fields and labels of the JSON object it wrote. Output which is
+// no JSON object keeps the original line.
+func (in *Input) applyCmdOutput(ll *LogLine, out string) {
+	if in.cmdOutput != "json" {
+		ll.Msg = out
+		return
+	}
+	var r cmdResult
+	if err := json.Unmarshal([]byte(out), &r); err != nil {
+		cmdErrors.WithLabelValues(cmdErrorReason(errCmdJSON)).Inc()
+		logWarnf("%v: %v", errCmdJSON, err)
+		return
+	}
+	if r.Host != nil {
+		ll.Hostname = *r.Host
+	}
+	if r.Program != nil {
+		ll.Program = *r.Program
+	}
+	if r.Level != nil {
+		ll.Severity = normalizeSeverity(*r.Level)
+	}
+	if r.Msg != nil {
+		ll.Msg = *r.Msg
+	}
+	for k, v := range r.Labels {
+		if k = labelName(k); reservedLabel(k) || strings.HasPrefix(k, "__") {
+			continue
+		}
+		if ll.Labels == nil {
+			ll.Labels = map[string]string{}
+		}
+		ll.Labels[k] = v
+	}
+}
+
+// send hands ll over to the sinks, t rate limits the overflow message.
+func (in *Input) send(ll *LogLine, t *time.Time) {
+	// the sinks don't need Raw, which may belong to a released batch
+	ll.Raw = nil
+	r := in.redact
+	if o := in.programs.lookup(ll.Program); o != nil {
+		r = o.redact
+	}
+	if len(r) > 0 {
+		ll.Msg = r.apply(ll.Msg)
+	}
+	if in.dropBody != nil {
+		in.dropBody.apply(ll)
+	}
+	if in.blockOnFull {
+		if !in.sendBlocking(ll) {
+			lokiDropped.WithLabelValues(ll.Program, ll.Severity).Inc()
+			health.dropped()
+			logErrorf("Loki buffered channel stayed full for %v", in.blockTimeout)
+		}
+		return
+	}
+	select {
+	case in.lineChan <- ll:
+	default:
+		lokiDropped.WithLabelValues(ll.Program, ll.Severity).Inc()
+		health.dropped()
+		if time.Since(*t) > 1e9 {
+			logErrorf("overflowing Loki buffered channel capacity")
+		}
+		*t = time.Now()
+	}
+}
+
+// startCmdWorkers runs cmd in n goroutines of its own, so a slow command
+// doesn't hold up parsing. process blocks once all of them are busy and
+// cmdChan is full.
+func (in *Input) startCmdWorkers(n int) {
+	in.cmdChan = make(chan *LogLine, n)
+	for i := 0; i < n; i++ {
+		in.cmdWorkers.Add(1)
+		go func() {
+			defer in.cmdWorkers.Done()
+			t := time.Now()
+			for ll := range in.cmdChan {
+				if in.rewrite(ll) {
+					in.send(ll, &t)
 				}
 			}
-		}
+		}()
 	}
 }
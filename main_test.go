@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testLines(n int) *bytes.Buffer {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "2019-10-29T16:21:22.230666+01:00 6 pad fancy line %d\n", i)
+	}
+	return &buf
+}
+
+func Test_scanFlush(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 100),
+		scanChan: make(chan [][]byte, 100),
+	}
+
+	var stderr bytes.Buffer
+	input.scan(&stderr, testLines(23))
+	input.process()
+	close(input.lineChan)
+
+	seen := map[string]bool{}
+	for ll := range input.lineChan {
+		seen[ll.Msg] = true
+	}
+	if len(seen) != 23 {
+		t.Fatalf("got %d lines but want 23", len(seen))
+	}
+	for i := 0; i < 23; i++ {
+		if msg := fmt.Sprintf("line %d\n", i); !seen[msg] {
+			t.Errorf("missing %q", msg)
+		}
+	}
+}
+
+func Test_scanNoTrailingNewline(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 10),
+		scanChan: make(chan [][]byte, 10),
+	}
+
+	var stderr bytes.Buffer
+	input.scan(&stderr, bytes.NewBufferString(string(raw[:len(raw)-1])))
+	go input.process()
+
+	select {
+	case ll := <-input.lineChan:
+		if ll.Msg != "{\"key1\":\"val1\", \"key2\":\"val2\"}" {
+			t.Errorf("got %q", ll.Msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("last line without newline was lost")
+	}
+}
+
+func Test_scanPartialBatchNoStale(t *testing.T) {
+	n := 2*scanSize + 5
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 2*n),
+		scanChan: make(chan [][]byte, 10),
+	}
+
+	var stderr bytes.Buffer
+	input.scan(&stderr, testLines(n))
+
+	var batches []int
+	for s := range input.scanChan {
+		batches = append(batches, len(s))
+	}
+	if len(batches) != 3 || batches[2] != 5 {
+		t.Fatalf("got batch sizes %v but want [%d %d 5]", batches, scanSize, scanSize)
+	}
+
+	input.scanChan = make(chan [][]byte, 10)
+	input.scan(&stderr, testLines(n))
+	input.process()
+	close(input.lineChan)
+
+	count := map[string]int{}
+	for ll := range input.lineChan {
+		count[ll.Msg]++
+	}
+	if len(count) != n {
+		t.Fatalf("got %d distinct lines but want %d", len(count), n)
+	}
+	for msg, c := range count {
+		if c != 1 {
+			t.Errorf("%q parsed %d times", msg, c)
+		}
+	}
+}
+
+func Test_processStaticTagConcurrent(t *testing.T) {
+	tagged := logScanNumber.WithLabelValues("pad", "fancy", "info", "hit")
+	for _, promOnly := range []bool{false, true} {
+		before := testutil.ToFloat64(tagged)
+		input := &Input{
+			forward:         !promOnly,
+			promOnly:        promOnly,
+			staticTag:       "hit",
+			staticTagFilter: newTagFilter("line 1", nil),
+			lineChan:        make(chan *LogLine, 1000),
+			scanChan:        make(chan [][]byte, 100),
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				input.process()
+				wg.Done()
+			}()
+		}
+
+		var stderr bytes.Buffer
+		input.scan(&stderr, testLines(1000))
+		wg.Wait()
+		close(input.lineChan)
+
+		if promOnly {
+			// lines 1, 10-19 and 100-199 contain the filter
+			got := testutil.ToFloat64(tagged) - before
+			if got != 111 {
+				t.Errorf("got %v tagged lines in prom-only mode but want 111", got)
+			}
+			continue
+		}
+
+		for ll := range input.lineChan {
+			want := ""
+			if strings.Contains(ll.Msg, "line 1") {
+				want = "hit"
+			}
+			if ll.StaticTag != want {
+				t.Errorf("got tag %q for %q but want %q", ll.StaticTag, ll.Msg, want)
+			}
+		}
+	}
+}
+
+func Test_scanMaxRead(t *testing.T) {
+	input := &Input{
+		maxRead:  1024,
+		scanChan: make(chan [][]byte, 10),
+	}
+	// 8MiB without a newline in the middle of two normal lines
+	var in bytes.Buffer
+	in.WriteString("2019-10-29T16:21:22.230666+01:00 6 pad fancy before\n")
+	in.WriteString("2019-10-29T16:21:22.230666+01:00 6 pad fancy ")
+	in.Write(bytes.Repeat([]byte("x"), 8<<20))
+	in.WriteString("\n2019-10-29T16:21:22.230666+01:00 6 pad fancy after\n")
+	before := testutil.ToFloat64(oversizedLines)
+	input.scan(&bytes.Buffer{}, &in)
+
+	var lines []string
+	for s := range input.scanChan {
+		for _, l := range s {
+			lines = append(lines, string(l))
+		}
+	}
+	if len(lines) != 3 || len(lines[1]) != 1024 || !strings.HasSuffix(lines[2], "after\n") {
+		t.Fatalf("got %d lines but want before, 1024 bytes of the long one and after", len(lines))
+	}
+	if _, err := parseLine([]byte(lines[1]), false); err != nil {
+		t.Errorf("the cut line does not parse: %v", err)
+	}
+	if got := testutil.ToFloat64(oversizedLines) - before; got != 1 {
+		t.Errorf("got %v oversized lines but want 1", got)
+	}
+}
+
+// errReader returns the reads in order, then io.EOF.
+type errReader []struct {
+	data string
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	next := (*r)[0]
+	*r = (*r)[1:]
+	return copy(p, next.data), next.err
+}
+
+func Test_scanReadErrors(t *testing.T) {
+	line := "2019-10-29T16:21:22.230666+01:00 6 pad fancy msg\n"
+	cases := []struct {
+		reads       errReader
+		want        []string
+		retry, stop float64
+	}{
+		// a broken pipe ends the scan, what was read before it is kept
+		{errReader{{line, nil}, {line[:20], syscall.EPIPE}, {line, nil}}, []string{line, line[:20]}, 0, 1},
+		// an interrupted read continues the line
+		{errReader{{line[:20], syscall.EINTR}, {line[20:], nil}, {line, nil}}, []string{line, line}, 1, 0},
+	}
+	for i, c := range cases {
+		retry := testutil.ToFloat64(scannerErrors.WithLabelValues("retry"))
+		stop := testutil.ToFloat64(scannerErrors.WithLabelValues("stop"))
+		var stderr bytes.Buffer
+		var got []string
+		input := &Input{scanChan: make(chan [][]byte, 10)}
+		input.scan(&stderr, &c.reads)
+		for s := range input.scanChan {
+			for _, l := range s {
+				got = append(got, string(l))
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("case %d: got lines %q but want %q", i, got, c.want)
+		}
+		if d := testutil.ToFloat64(scannerErrors.WithLabelValues("retry")) - retry; d != c.retry {
+			t.Errorf("case %d: got %v retries but want %v", i, d, c.retry)
+		}
+		if d := testutil.ToFloat64(scannerErrors.WithLabelValues("stop")) - stop; d != c.stop {
+			t.Errorf("case %d: got %v stops but want %v", i, d, c.stop)
+		}
+	}
+}
+
+func Test_scanStop(t *testing.T) {
+	input := &Input{
+		scanChan: make(chan [][]byte, 10),
+		quit:     make(chan struct{}),
+	}
+
+	// the writer stays open, so scan only returns because of stop
+	r, w := io.Pipe()
+	defer w.Close()
+	done := make(chan struct{})
+	go func() {
+		var stderr bytes.Buffer
+		input.scan(&stderr, r)
+		close(done)
+	}()
+
+	w.Write(testLines(3).Bytes())
+	input.stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scan did not stop")
+	}
+
+	n := 0
+	for s := range input.scanChan {
+		n += len(s)
+	}
+	if n != 3 {
+		t.Errorf("got %d lines but want 3", n)
+	}
+}
+
+func Test_channelMetrics(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 4),
+		scanChan: make(chan [][]byte, 10),
+	}
+
+	dropped := testutil.ToFloat64(lokiDropped.WithLabelValues("fancy", "info"))
+	var stderr bytes.Buffer
+	input.scan(&stderr, testLines(10))
+	input.process()
+
+	updateChannelGauges(input.lineChan)
+	if got := testutil.ToFloat64(lokiChanUsage); got != 4 {
+		t.Errorf("got channel usage %v but want 4", got)
+	}
+	if got := testutil.ToFloat64(lokiChanCapacity); got != 4 {
+		t.Errorf("got channel capacity %v but want 4", got)
+	}
+	if got := testutil.ToFloat64(lokiDropped.WithLabelValues("fancy", "info")) - dropped; got != 6 {
+		t.Errorf("got %v dropped lines but want 6", got)
+	}
+}
+
+func Test_processOnFull(t *testing.T) {
+	cases := []struct {
+		block   bool
+		timeout time.Duration
+		want    int
+		dropped float64
+	}{
+		{false, 0, 4, 6},
+		{true, 0, 10, 0},
+		{true, 10 * time.Millisecond, 4, 6},
+	}
+
+	for _, c := range cases {
+		input := &Input{
+			forward:      true,
+			blockOnFull:  c.block,
+			blockTimeout: c.timeout,
+			lineChan:     make(chan *LogLine, 4),
+			scanChan:     make(chan [][]byte, 10),
+		}
+
+		dropped := testutil.ToFloat64(lokiDropped.WithLabelValues("fancy", "info"))
+		var stderr bytes.Buffer
+		input.scan(&stderr, testLines(10))
+		done := make(chan struct{})
+		go func() {
+			input.process()
+			close(done)
+		}()
+
+		got := 0
+		if c.block && c.timeout == 0 {
+			// process only finishes when somebody drains the channel
+			for got < c.want {
+				<-input.lineChan
+				got++
+			}
+			<-done
+		} else {
+			<-done
+			got = len(input.lineChan)
+		}
+
+		if got != c.want {
+			t.Errorf("block=%v timeout=%v: got %d lines but want %d", c.block, c.timeout, got, c.want)
+		}
+		if d := testutil.ToFloat64(lokiDropped.WithLabelValues("fancy", "info")) - dropped; d != c.dropped {
+			t.Errorf("block=%v timeout=%v: got %v dropped but want %v", c.block, c.timeout, d, c.dropped)
+		}
+	}
+}
+
+// benchmarkWorkers parses and forwards b.N lines with the given number of
+// process goroutines.
+func benchmarkWorkers(b *testing.B, workers int) {
+	input := &Input{
+		forward:  true,
+		scanChan: make(chan [][]byte, 1000),
+		lineChan: make(chan *LogLine, 1000),
+	}
+	go func() {
+		for range input.lineChan {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			input.process()
+			wg.Done()
+		}()
+	}
+
+	stdin := bytes.NewBuffer(bytes.Repeat(raw, b.N))
+	b.ResetTimer()
+	input.scan(&bytes.Buffer{}, stdin)
+	wg.Wait()
+	close(input.lineChan)
+}
+
+// benchmarkScanBatch runs the pipeline with batches of width lines.
+func benchmarkScanBatch(b *testing.B, width int) {
+	defer func(size int) { scanSize = size }(scanSize)
+	scanSize = width
+	benchmarkWorkers(b, 8)
+}
+
+func Benchmark_scanBatch1(b *testing.B)  { benchmarkScanBatch(b, 1) }
+func Benchmark_scanBatch8(b *testing.B)  { benchmarkScanBatch(b, 8) }
+func Benchmark_scanBatch24(b *testing.B) { benchmarkScanBatch(b, 24) }
+func Benchmark_scanBatch96(b *testing.B) { benchmarkScanBatch(b, 96) }
+
+// countingReader counts the reads, on a pipe every one is a syscall.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+// benchmarkReadBuffer scans b.N lines from a pipe with a read buffer of
+// size bytes.
+func benchmarkReadBuffer(b *testing.B, size int) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pr.Close()
+	go func() {
+		chunk := bytes.Repeat(raw, 1000)
+		for n := 0; n < b.N; n += 1000 {
+			pw.Write(chunk)
+		}
+		pw.Close()
+	}()
+	input := &Input{readBuffer: size, scanChan: make(chan [][]byte, 1000)}
+	go func() {
+		for s := range input.scanChan {
+			releaseBatch(s)
+		}
+	}()
+
+	src := &countingReader{r: pr}
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	input.scan(&bytes.Buffer{}, src)
+	b.ReportMetric(float64(src.reads)/float64(b.N), "reads/op")
+}
+
+func Benchmark_readBuffer4K(b *testing.B)  { benchmarkReadBuffer(b, 4096) }
+func Benchmark_readBuffer64K(b *testing.B) { benchmarkReadBuffer(b, 64*1024) }
+func Benchmark_readBuffer1M(b *testing.B)  { benchmarkReadBuffer(b, 1024*1024) }
+
+func Test_scanReusesBatches(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 1000),
+		scanChan: make(chan [][]byte, 100),
+	}
+	// lines longer than the bufio buffer next to short ones, so a reused
+	// slot has to grow and shrink
+	var buf bytes.Buffer
+	var want []string
+	for i := 0; i < 200; i++ {
+		msg := fmt.Sprintf("line %d\n", i)
+		if i%7 == 0 {
+			msg = strings.Repeat("x", 10000) + msg
+		}
+		want = append(want, msg)
+		buf.WriteString("2019-10-29T16:21:22.230666+01:00 6 pad fancy " + msg)
+	}
+	input.scan(&bytes.Buffer{}, &buf)
+	input.process()
+
+	if len(input.lineChan) != len(want) {
+		t.Fatalf("got %d lines but want %d", len(input.lineChan), len(want))
+	}
+	for i, msg := range want {
+		ll := <-input.lineChan
+		if ll.Msg != msg {
+			t.Fatalf("line %d: got %q but want %q", i, ll.Msg, msg)
+		}
+	}
+}
+
+// Benchmark_scan reads b.N lines into batches, the receiver hands every
+// batch back right away like process does.
+func Benchmark_scan(b *testing.B) {
+	input := &Input{scanChan: make(chan [][]byte, 1000)}
+	done := make(chan struct{})
+	go func() {
+		for b := range input.scanChan {
+			releaseBatch(b)
+		}
+		close(done)
+	}()
+
+	stdin := bytes.NewBuffer(bytes.Repeat(raw, b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+	input.scan(&bytes.Buffer{}, stdin)
+	<-done
+}
+
+// Benchmark_process parses b.N scanned lines in a single worker.
+func Benchmark_process(b *testing.B) {
+	input := &Input{scanChan: make(chan [][]byte, b.N/scanSize+1)}
+	var cache Cache
+	for i := 0; i < b.N; i++ {
+		batchScan(input.scanChan, &cache, raw)
+	}
+	cache.flush(input.scanChan)
+	close(input.scanChan)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	input.process()
+}
+
+func Benchmark_workers1(b *testing.B)  { benchmarkWorkers(b, 1) }
+func Benchmark_workers4(b *testing.B)  { benchmarkWorkers(b, 4) }
+func Benchmark_workers8(b *testing.B)  { benchmarkWorkers(b, 8) }
+func Benchmark_workers16(b *testing.B) { benchmarkWorkers(b, 16) }
+
+func Test_processMinSeverity(t *testing.T) {
+	var buf bytes.Buffer
+	for level := '0'; level <= '7'; level++ {
+		fmt.Fprintf(&buf, "2019-10-29T16:21:22.230666+01:00 %c pad minsev msg\n", level)
+	}
+
+	for _, promOnly := range []bool{false, true} {
+		input := &Input{
+			forward:     !promOnly,
+			promOnly:    promOnly,
+			minSeverity: "warning",
+			scanChan:    make(chan [][]byte, 1),
+			lineChan:    make(chan *LogLine, 10),
+		}
+		before := testutil.ToFloat64(severityFiltered.WithLabelValues("debug"))
+		input.scanChan <- bytes.SplitAfter(buf.Bytes(), []byte("\n"))[:8]
+		close(input.scanChan)
+		input.process()
+
+		if got := testutil.ToFloat64(severityFiltered.WithLabelValues("debug")) - before; got != 1 {
+			t.Errorf("promOnly %v: got %v filtered debug logs but want 1", promOnly, got)
+		}
+		if !promOnly && len(input.lineChan) != 5 {
+			t.Errorf("got %d forwarded logs but want 5", len(input.lineChan))
+		}
+		if got := testutil.ToFloat64(logScanNumber.WithLabelValues("pad", "minsev", "info", "")); promOnly && got != 0 {
+			t.Errorf("got %v info logs in the metrics but want 0", got)
+		}
+	}
+}
+
+func Test_processSeverityMap(t *testing.T) {
+	severities, _ := parseSeverityMap("NOTICE=warning")
+	input := &Input{
+		forward:     true,
+		severities:  severities,
+		minSeverity: "warning",
+		scanChan:    make(chan [][]byte, 1),
+		lineChan:    make(chan *LogLine, 10),
+	}
+	input.scanChan <- [][]byte{
+		[]byte("2019-10-29T16:21:22.230666+01:00 5 pad sevmap notice msg\n"),
+		[]byte("2019-10-29T16:21:22.230666+01:00 7 pad sevmap debug msg\n"),
+	}
+	close(input.scanChan)
+	input.process()
+
+	// the mapping happens before min-severity drops the debug log
+	if len(input.lineChan) != 1 {
+		t.Fatalf("got %d forwarded logs but want 1", len(input.lineChan))
+	}
+	if ll := <-input.lineChan; ll.Severity != "warning" {
+		t.Errorf("got severity %q but want warning", ll.Severity)
+	}
+}
+
+func Test_processMaxLineBytes(t *testing.T) {
+	input := &Input{
+		forward:      true,
+		maxLineBytes: 100,
+		scanChan:     make(chan [][]byte, 1),
+		lineChan:     make(chan *LogLine, 2),
+	}
+	prefix := "2019-10-29T16:21:22.230666+01:00 6 pad truncate "
+	// the cut falls into the two byte ü, which must not be split
+	long := prefix + strings.Repeat("x", 99) + "ü" + strings.Repeat("y", 4900)
+	input.scanChan <- [][]byte{[]byte(long), []byte(prefix + "short msg")}
+	close(input.scanChan)
+	before := testutil.ToFloat64(truncatedLines)
+	input.process()
+
+	ll := <-input.lineChan
+	if want := strings.Repeat("x", 99) + "…(truncated 4902 bytes)"; ll.Msg != want {
+		t.Errorf("got msg %q but want %q", ll.Msg, want)
+	}
+	if ll := <-input.lineChan; ll.Msg != "short msg" {
+		t.Errorf("got msg %q but want it untouched", ll.Msg)
+	}
+	if got := testutil.ToFloat64(truncatedLines) - before; got != 1 {
+		t.Errorf("got %v truncated lines but want 1", got)
+	}
+}
+
+func Test_filter(t *testing.T) {
+	cases := []struct {
+		match   string
+		exclude string
+		msg     string
+		want    string
+	}{
+		{msg: "GET /health 200", want: ""},
+		{match: "ERROR", msg: "ERROR: disk full", want: ""},
+		{match: "ERROR", msg: "INFO: all good", want: "match"},
+		{exclude: "/health", msg: "GET /health 200", want: "exclude"},
+		{exclude: "/health", msg: "GET /users 200", want: ""},
+		{match: "GET", exclude: "/health", msg: "GET /health 200", want: "exclude"},
+		{match: "GET", exclude: "/health", msg: "GET /users 200", want: ""},
+		{match: "GET", exclude: "/health", msg: "POST /users 200", want: "match"},
+		// the header is not part of the msg
+		{match: "pad", msg: "GET /users 200", want: "match"},
+	}
+
+	for _, c := range cases {
+		matchRe, err := compileFilter(c.match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		excludeRe, err := compileFilter(c.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := &Input{}
+		in.setFilters(&filters{match: matchRe, exclude: excludeRe})
+		ll, err := parseLine([]byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy "+c.msg+"\n"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := in.filter(ll); got != c.want {
+			t.Errorf("match %q exclude %q msg %q: got %q but want %q", c.match, c.exclude, c.msg, got, c.want)
+		}
+	}
+
+	if _, err := compileFilter("("); err == nil {
+		t.Error("got no error for an invalid expression")
+	}
+}
+
+func Test_processSampling(t *testing.T) {
+	const n = 10000
+	input := &Input{
+		forward:     true,
+		sampleRate:  0.3,
+		sampleBelow: "notice",
+		scanChan:    make(chan [][]byte, 2*n/scanSize+1),
+		lineChan:    make(chan *LogLine, 2*n),
+	}
+	var cache Cache
+	for i := 0; i < n; i++ {
+		batchScan(input.scanChan, &cache, []byte("2019-10-29T16:21:22.230666+01:00 6 pad sampled info msg\n"))
+		batchScan(input.scanChan, &cache, []byte("2019-10-29T16:21:22.230666+01:00 4 pad sampled warning msg\n"))
+	}
+	cache.flush(input.scanChan)
+	close(input.scanChan)
+	input.process()
+
+	levels := map[string]int{}
+	for len(input.lineChan) > 0 {
+		levels[(<-input.lineChan).Severity]++
+	}
+	if levels["warning"] != n {
+		t.Errorf("got %d warnings but want all %d", levels["warning"], n)
+	}
+	// the standard deviation is about 46 lines
+	if got := levels["info"]; got < 2700 || got > 3300 {
+		t.Errorf("got %d info logs but want about %d", got, 3*n/10)
+	}
+}
+
+func Test_processParseErrors(t *testing.T) {
+	cases := []struct {
+		format string
+		line   string
+		reason string
+	}{
+		{"fancy", "2019-10-29T16:21:22.230666+01:00 6 pad\n", "too_short"},
+		{"fancy", "2019-10-29T16:21:22.230666+01:00 9 pad fancy some msg\n", "bad_severity"},
+		{"fancy", "2019-10-29T16:21:22.230666+01:00 6 pad_fancy_some_msg_without_blanks\n", "missing_field"},
+		{"fancy", "2019-10-29T16:21:22.230666+01:00 6 pad fancy_msg_without_blanks_after_host\n", "missing_field"},
+		{"rfc5424", "165>1 2003-10-11T22:14:15.003Z host app - - - msg\n", "bad_priority"},
+		{"rfc5424", "<165>1 2003-10-11T22:14:15.003Z host\n", "missing_field"},
+		{"rfc5424", "<165>1 2003-10-11T22:14:15.003Z host app - - [id msg\n", "bad_structured_data"},
+		{"rfc3164", "<34>Oct 11 22:14:1 host su: msg\n", "bad_time"},
+	}
+
+	for _, c := range cases {
+		before := testutil.ToFloat64(parseErrors.WithLabelValues(c.reason))
+		input := &Input{
+			parse:    parsers[c.format],
+			forward:  true,
+			scanChan: make(chan [][]byte, 1),
+			lineChan: make(chan *LogLine, 1),
+		}
+		input.scanChan <- [][]byte{[]byte(c.line)}
+		close(input.scanChan)
+		input.process()
+
+		if got := testutil.ToFloat64(parseErrors.WithLabelValues(c.reason)) - before; got != 1 {
+			t.Errorf("%s %q: got %v parse errors with reason %s but want 1", c.format, c.line, got, c.reason)
+		}
+		if len(input.lineChan) != 0 {
+			t.Errorf("%s %q: got a forwarded log", c.format, c.line)
+		}
+	}
+}
+
+func Test_inputFile(t *testing.T) {
+	f, err := openInput("testdata/fancy.log", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	input := &Input{
+		forward:  true,
+		scanChan: make(chan [][]byte, 10),
+		lineChan: make(chan *LogLine, 10),
+		quit:     make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		input.process()
+		wg.Done()
+	}()
+	scanDone := make(chan struct{})
+	input.scan(&bytes.Buffer{}, f)
+	close(scanDone)
+	input.shutdown(scanDone, &wg, nil)
+
+	var programs []string
+	for len(input.lineChan) > 0 {
+		programs = append(programs, (<-input.lineChan).Program)
+	}
+	if got := strings.Join(programs, " "); got != "fancy kernel sshd nginx cron" {
+		t.Errorf("got programs %s", got)
+	}
+
+	if _, err := openInput("testdata/missing.log", false); err == nil {
+		t.Error("got no error for a missing file")
+	}
+}
+
+func Test_redactArgs(t *testing.T) {
+	args := []string{"-loki-url", "http://loki:3100", "-loki-password", "hunter2", "--loki-bearer-token=s3cret", "-loki-username=admin"}
+	got := strings.Join(redactArgs(args), " ")
+	if strings.Contains(got, "hunter2") || strings.Contains(got, "s3cret") {
+		t.Errorf("got secrets in %q", got)
+	}
+	want := "-loki-url http://loki:3100 -loki-password [REDACTED] --loki-bearer-token=[REDACTED] -loki-username=admin"
+	if got != want {
+		t.Errorf("got %q but want %q", got, want)
+	}
+	if args[3] != "hunter2" {
+		t.Error("redactArgs changed its input")
+	}
+}
+
+// blockingCmd holds every msg until release is closed.
+type blockingCmd struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCmd) run(msg []byte) (string, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return string(msg), nil
+}
+
+func (c *blockingCmd) close() {}
+
+func Test_activeWorkers(t *testing.T) {
+	cmd := &blockingCmd{started: make(chan struct{}), release: make(chan struct{})}
+	input := &Input{
+		forward:  true,
+		cmd:      cmd,
+		lineChan: make(chan *LogLine, 10),
+		scanChan: make(chan [][]byte, 10),
+	}
+	before := testutil.ToFloat64(activeWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			input.process()
+			wg.Done()
+		}()
+	}
+	// three of the four workers hang on cmd, the fourth one waits
+	for i := 0; i < 3; i++ {
+		input.scanChan <- [][]byte{raw}
+	}
+	for i := 0; i < 3; i++ {
+		<-cmd.started
+	}
+	if n := testutil.ToFloat64(activeWorkers) - before; n != 3 {
+		t.Errorf("got %v active workers but want 3", n)
+	}
+
+	close(cmd.release)
+	close(input.scanChan)
+	wg.Wait()
+	if n := testutil.ToFloat64(activeWorkers) - before; n != 0 {
+		t.Errorf("got %v active workers after all of them ended", n)
+	}
+}
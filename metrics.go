@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// scanLabelNames are all labels of the input metrics.
+var scanLabelNames = []string{"hostname", "program", "level", "static_tag"}
+
+var (
+	logScanNumber = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_input_scan_total",
+		Help: "Total number of logs received from rsyslog fancy template"},
+		scanLabelNames)
+	logScanSize = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fancy_input_raw_bytes_total",
+		Help: "Total number of bytes received from rsyslog fancy template"},
+		[]string{"hostname", "program"})
+	logLineSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fancy_input_line_bytes",
+		Help:    "Size of the single logs received from rsyslog fancy template",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 7)},
+		[]string{"program"})
+)
+
+// keepScanLabels are the labels set by countScan, the others stay empty.
+// Prometheus doesn't store empty labels, so they are dropped from the
+// series while the metrics keep a fixed label set, which the registry
+// requires for the lifetime of the program.
+var keepScanLabels = map[string]bool{"hostname": true, "program": true, "level": true, "static_tag": true}
+
+// setScanLabels keeps only the given labels of the input metrics to cut
+// down the number of series. It must be called before any log is
+// processed.
+func setScanLabels(labels []string) error {
+	keep := map[string]bool{}
+	for _, l := range labels {
+		if _, ok := scanLabelValue(l, &LogLine{}); !ok {
+			return fmt.Errorf("unknown label %q", l)
+		}
+		keep[l] = true
+	}
+	keepScanLabels = keep
+	return nil
+}
+
+// countScan updates the input metrics for ll.
+func countScan(ll *LogLine) {
+	var values [4]string
+	for i, l := range scanLabelNames {
+		if keepScanLabels[l] {
+			values[i], _ = scanLabelValue(l, ll)
+		}
+	}
+	logScanNumber.WithLabelValues(values[:]...).Inc()
+	logScanSize.WithLabelValues(values[0], values[1]).Add(float64(len(ll.Raw)))
+	logLineSize.WithLabelValues(values[1]).Observe(float64(len(ll.Raw)))
+}
+
+func scanLabelValue(label string, ll *LogLine) (string, bool) {
+	switch label {
+	case "hostname":
+		return ll.Hostname, true
+	case "program":
+		return ll.Program, true
+	case "level":
+		return ll.Severity, true
+	case "static_tag":
+		return ll.StaticTag, true
+	}
+	return "", false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_setScanLabels(t *testing.T) {
+	defer setScanLabels(scanLabelNames)
+
+	if err := setScanLabels([]string{"program", "hostnmae"}); err == nil {
+		t.Error("got no error for an unknown label")
+	}
+
+	if err := setScanLabels([]string{"program", "level"}); err != nil {
+		t.Fatal(err)
+	}
+	input := &Input{
+		promOnly: true,
+		scanChan: make(chan [][]byte, 1),
+	}
+	lines := [][]byte{
+		[]byte("2019-10-29T16:21:22.230666+01:00 6 host1 lowcard msg\n"),
+		[]byte("2019-10-29T16:21:22.230666+01:00 6 host2 lowcard msg\n"),
+		[]byte("2019-10-29T16:21:22.230666+01:00 3 host3 lowcard msg\n"),
+	}
+	input.scanChan <- lines
+	close(input.scanChan)
+	input.process()
+
+	if got := testutil.ToFloat64(logScanNumber.WithLabelValues("", "lowcard", "info", "")); got != 2 {
+		t.Errorf("got %v info logs but want 2", got)
+	}
+	if got := testutil.ToFloat64(logScanNumber.WithLabelValues("", "lowcard", "error", "")); got != 1 {
+		t.Errorf("got %v error logs but want 1", got)
+	}
+	// the hosts share one series
+	if got, want := testutil.ToFloat64(logScanSize.WithLabelValues("", "lowcard")), float64(3*len(lines[0])); got != want {
+		t.Errorf("got %v bytes but want %v", got, want)
+	}
+}
+
+func Test_lineBytesHistogram(t *testing.T) {
+	input := &Input{
+		promOnly: true,
+		scanChan: make(chan [][]byte, 1),
+	}
+	header := "2019-10-29T16:21:22.230666+01:00 6 pad linesize "
+	var lines [][]byte
+	for _, n := range []int{10, 100, 1000, 1000, 20000} {
+		lines = append(lines, []byte(header+strings.Repeat("x", n)+"\n"))
+	}
+	input.scanChan <- lines
+	close(input.scanChan)
+	input.process()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := map[float64]uint64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "fancy_input_line_bytes" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() != "linesize" {
+				continue
+			}
+			for _, b := range m.GetHistogram().GetBucket() {
+				buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+			}
+		}
+	}
+	// the lines are 59, 149, 1049, 1049 and 20049 bytes long
+	want := map[float64]uint64{16: 0, 64: 1, 256: 2, 1024: 2, 4096: 4, 16384: 4, 65536: 5}
+	for le, n := range want {
+		if buckets[le] != n {
+			t.Errorf("got %d logs up to %v bytes but want %d", buckets[le], le, n)
+		}
+	}
+}
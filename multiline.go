@@ -0,0 +1,110 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var multilineStitched = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "fancy_multiline_stitched_total",
+	Help: "Total number of logs appended to the msg of a previous log"})
+
+// stitcher joins multiline msgs like stack traces into one log. A msg
+// matching start begins a new log, any other msg is appended to the log
+// buffered for the same host and program. A log is handed on when the next
+// start msg arrives or no msg arrived for it within timeout.
+type stitcher struct {
+	start   *regexp.Regexp
+	timeout time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[dedupKey]*stitchEntry
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+type stitchEntry struct {
+	ll   *LogLine
+	last time.Time
+}
+
+func newStitcher(start *regexp.Regexp, timeout time.Duration) *stitcher {
+	return &stitcher{
+		start:   start,
+		timeout: timeout,
+		now:     time.Now,
+		entries: map[dedupKey]*stitchEntry{},
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// add buffers ll and returns the previous log of its host and program if
+// ll starts a new one.
+func (s *stitcher) add(ll *LogLine) *LogLine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := dedupKey{ll.Hostname, ll.Program}
+	e, ok := s.entries[key]
+	now := s.now()
+	if ok && !s.start.MatchString(ll.Msg) {
+		e.ll.Msg += ll.Msg
+		e.ll.Raw = append(e.ll.Raw, ll.Raw[ll.MsgPos:]...)
+		e.last = now
+		multilineStitched.Inc()
+		return nil
+	}
+	// the entry outlives the batch holding Raw
+	ll.Raw = append([]byte(nil), ll.Raw...)
+	s.entries[key] = &stitchEntry{ll: ll, last: now}
+	if ok {
+		return e.ll
+	}
+	return nil
+}
+
+// expire removes the entries without a msg since timeout and returns their
+// logs. A zero time expires all of them.
+func (s *stitcher) expire(now time.Time) []*LogLine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*LogLine
+	for key, e := range s.entries {
+		if !now.IsZero() && now.Sub(e.last) < s.timeout {
+			continue
+		}
+		out = append(out, e.ll)
+		delete(s.entries, key)
+	}
+	return out
+}
+
+// run hands the logs of expired entries to send until stop is called.
+func (s *stitcher) run(send func(*LogLine)) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, ll := range s.expire(now) {
+				send(ll)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// stop ends run and returns the logs of all remaining entries.
+func (s *stitcher) stop() []*LogLine {
+	close(s.quit)
+	<-s.done
+	return s.expire(time.Time{})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var javaStart = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} `)
+
+func Test_stitchJavaTraceback(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		stitch:   newStitcher(javaStart, time.Hour),
+		scanChan: make(chan [][]byte, 10),
+		lineChan: make(chan *LogLine, 10),
+	}
+	var cache Cache
+	for _, line := range []string{
+		"2019-10-29T16:21:22.230666+01:00 3 pad app 2019-10-29 16:21:22 ERROR request failed\n",
+		"2019-10-29T16:21:22.230666+01:00 3 pad app java.lang.NullPointerException: user is null\n",
+		"2019-10-29T16:21:22.230666+01:00 3 pad app \tat com.example.UserService.load(UserService.java:42)\n",
+		// another program in between must not end up in the trace
+		"2019-10-29T16:21:22.230666+01:00 6 pad sshd accepted publickey for root\n",
+		"2019-10-29T16:21:22.230666+01:00 3 pad app \tat com.example.Handler.serve(Handler.java:17)\n",
+		"2019-10-29T16:21:22.230666+01:00 3 pad app Caused by: java.io.IOException: closed\n",
+		"2019-10-29T16:21:22.230666+01:00 3 pad app \t... 12 more\n",
+		"2019-10-29T16:21:23.230666+01:00 6 pad app 2019-10-29 16:21:23 INFO recovered\n",
+	} {
+		batchScan(input.scanChan, &cache, []byte(line))
+	}
+	cache.flush(input.scanChan)
+	close(input.scanChan)
+	input.process()
+
+	trace := "2019-10-29 16:21:22 ERROR request failed\n" +
+		"java.lang.NullPointerException: user is null\n" +
+		"\tat com.example.UserService.load(UserService.java:42)\n" +
+		"\tat com.example.Handler.serve(Handler.java:17)\n" +
+		"Caused by: java.io.IOException: closed\n" +
+		"\t... 12 more\n"
+	if len(input.lineChan) != 1 {
+		t.Fatalf("got %d logs but want only the trace before the next start msg", len(input.lineChan))
+	}
+	if got := (<-input.lineChan).Msg; got != trace {
+		t.Errorf("got trace %q but want %q", got, trace)
+	}
+
+	tm := time.Now()
+	rnd := rand.New(rand.NewSource(1))
+	for _, ll := range input.stitch.expire(time.Time{}) {
+		input.handle(ll, rnd, &tm)
+	}
+	got := map[string]string{}
+	for len(input.lineChan) > 0 {
+		ll := <-input.lineChan
+		got[ll.Program] = ll.Msg
+	}
+	if len(got) != 2 || got["sshd"] != "accepted publickey for root\n" || got["app"] != "2019-10-29 16:21:23 INFO recovered\n" {
+		t.Errorf("got %q but want the buffered sshd and app logs on stop", got)
+	}
+}
+
+func Test_stitchRaw(t *testing.T) {
+	s := newStitcher(javaStart, time.Hour)
+	// both lines share one array like lines read into a single buffer
+	buf := []byte("2019-10-29T16:21:22.230666+01:00 3 pad app 2019-10-29 16:21:22 ERROR failed\n" +
+		"2019-10-29T16:21:22.230666+01:00 3 pad app \tat Main.main(Main.java:3)\n")
+	orig := string(buf)
+	n := bytes.IndexByte(buf, '\n') + 1
+	first, next := buf[:n:len(buf)], buf[n:]
+	for _, raw := range [][]byte{first, next} {
+		ll, err := parseLine(raw, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.add(ll)
+	}
+
+	got := s.expire(time.Time{})
+	want := orig[:n] + "\tat Main.main(Main.java:3)\n"
+	if len(got) != 1 || string(got[0].Raw) != want {
+		t.Fatalf("got %v but want one log with raw %q", got, want)
+	}
+	if string(buf) != orig {
+		t.Errorf("stitching overwrote the next line in the shared buffer: %q", buf)
+	}
+}
+
+func Test_stitchTimeout(t *testing.T) {
+	now := time.Unix(1572362482, 0)
+	s := newStitcher(javaStart, time.Second)
+	s.now = func() time.Time { return now }
+
+	s.add(testLogLine("2019-10-29 16:21:22 ERROR failed\n"))
+	now = now.Add(500 * time.Millisecond)
+	s.add(testLogLine("\tat Main.main(Main.java:3)\n"))
+
+	if got := s.expire(now.Add(900 * time.Millisecond)); len(got) != 0 {
+		t.Errorf("got %d logs before the timeout since the last msg", len(got))
+	}
+	got := s.expire(now.Add(time.Second))
+	if len(got) != 1 || got[0].Msg != "2019-10-29 16:21:22 ERROR failed\n\tat Main.main(Main.java:3)\n" {
+		t.Errorf("got %v but want the stitched log after the timeout", got)
+	}
+}
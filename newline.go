@@ -0,0 +1,52 @@
+package main
+
+import "io"
+
+// trimCR turns a CRLF line ending into LF and drops a CR at the very end.
+func trimCR(line []byte) []byte {
+	n := len(line)
+	switch {
+	case n > 1 && line[n-2] == '\r' && line[n-1] == '\n':
+		line[n-2] = '\n'
+		return line[:n-1]
+	case n > 0 && line[n-1] == '\r':
+		return line[:n-1]
+	}
+	return line
+}
+
+// crReader ends lines at a bare CR as well. It replaces every CR with a LF
+// and drops the LF of a CRLF, also when the pair is split across reads.
+type crReader struct {
+	r  io.Reader
+	cr bool
+}
+
+func newCRReader(r io.Reader) *crReader {
+	return &crReader{r: r}
+}
+
+func (c *crReader) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		w := 0
+		for _, b := range p[:n] {
+			switch {
+			case b == '\r':
+				b = '\n'
+				c.cr = true
+			case b == '\n' && c.cr:
+				c.cr = false
+				continue
+			default:
+				c.cr = false
+			}
+			p[w] = b
+			w++
+		}
+		// a read of nothing but the LF of a CRLF must not look like 0, nil
+		if w > 0 || n == 0 || err != nil {
+			return w, err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// scanLines scans r and returns the lines of all batches.
+func scanLines(r io.Reader) []string {
+	input := &Input{scanChan: make(chan [][]byte, 10)}
+	input.scan(&bytes.Buffer{}, r)
+	var lines []string
+	for s := range input.scanChan {
+		for _, l := range s {
+			lines = append(lines, string(l))
+		}
+	}
+	return lines
+}
+
+func Test_scanCRLF(t *testing.T) {
+	in := "2019-10-29T16:21:22.230666+01:00 6 pad fancy first\r\n" +
+		"2019-10-29T16:21:22.230666+01:00 6 pad fancy second\r"
+	lines := scanLines(strings.NewReader(in))
+	if len(lines) != 2 {
+		t.Fatalf("got %q but want 2 lines", lines)
+	}
+	ll, err := parseLine([]byte(lines[0]), false)
+	if err != nil || ll.Msg != "first\n" {
+		t.Errorf("got %v,%v but want msg first without CR", ll, err)
+	}
+	ll, err = parseLine([]byte(lines[1]), false)
+	if err != nil || ll.Msg != "second" {
+		t.Errorf("got %v,%v but want msg second without CR", ll, err)
+	}
+}
+
+func Test_scanSplitCR(t *testing.T) {
+	in := "a\rb\r\nc\nd\r\re\r"
+	want := []string{"a\n", "b\n", "c\n", "d\n", "\n", "e\n"}
+	// one byte at a time splits every CRLF across two reads
+	for _, r := range []io.Reader{strings.NewReader(in), iotest.OneByteReader(strings.NewReader(in))} {
+		lines := scanLines(newCRReader(r))
+		if strings.Join(lines, "|") != strings.Join(want, "|") {
+			t.Errorf("got %q but want %q", lines, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+type jsonLine struct {
+	Host    string            `json:"host"`
+	Program string            `json:"program"`
+	Level   string            `json:"level"`
+	Msg     string            `json:"msg"`
+	Ts      time.Time         `json:"ts"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func newJSONLine(ll *LogLine) *jsonLine {
+	return &jsonLine{
+		Host:    ll.Hostname,
+		Program: ll.Program,
+		Level:   ll.Severity,
+		Msg:     strings.TrimRight(ll.Msg, "\r\n"),
+		Ts:      ll.Timestamp,
+		Labels:  ll.Labels,
+	}
+}
+
+// JSONWriter writes every log line as JSON object to w, one per line.
+type JSONWriter struct {
+	w *bufio.Writer
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{
+		w: bufio.NewWriterSize(w, 64*1024),
+	}
+}
+
+// Consume writes lines until the channel is closed.
+func (j *JSONWriter) Consume(lines <-chan *LogLine) {
+	enc := json.NewEncoder(j.w)
+	for ll := range lines {
+		if err := enc.Encode(newJSONLine(ll)); err != nil {
+			logErrorf("json output: %v", err)
+		}
+		// keep the latency low when there is nothing else to write
+		if len(lines) == 0 {
+			j.Flush()
+		}
+	}
+}
+
+// Flush writes buffered lines to the underlying writer.
+func (j *JSONWriter) Flush() {
+	if err := j.w.Flush(); err != nil {
+		logErrorf("json output: %v", err)
+	}
+}
+
+// PassthroughWriter writes every log line to w like it came in, only with
+// the msg as cmd and the other rewrites left it, so fancy can be a filter
+// in a pipe.
+type PassthroughWriter struct {
+	w *bufio.Writer
+}
+
+func NewPassthroughWriter(w io.Writer) *PassthroughWriter {
+	return &PassthroughWriter{
+		w: bufio.NewWriterSize(w, 64*1024),
+	}
+}
+
+// Consume writes lines until the channel is closed.
+func (p *PassthroughWriter) Consume(lines <-chan *LogLine) {
+	for ll := range lines {
+		p.w.WriteString(ll.Head)
+		p.w.WriteString(strings.TrimRight(ll.Msg, "\r\n"))
+		p.w.WriteByte('\n')
+		// keep the latency low when there is nothing else to write
+		if len(lines) == 0 {
+			p.Flush()
+		}
+	}
+}
+
+// Flush writes buffered lines to the underlying writer.
+func (p *PassthroughWriter) Flush() {
+	if err := p.w.Flush(); err != nil {
+		logErrorf("passthrough output: %v", err)
+	}
+}
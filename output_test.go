@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_jsonWriter(t *testing.T) {
+	var out bytes.Buffer
+	consume(NewJSONWriter(&out), &LogLine{
+		Timestamp: time.Date(2019, 10, 29, 15, 21, 22, 230666000, time.UTC),
+		Severity:  "info",
+		Hostname:  "pad",
+		Program:   "fancy",
+		Msg:       "{\"key1\":\"val1\"}\n",
+	}, &LogLine{
+		Timestamp: time.Date(2019, 10, 29, 15, 21, 23, 0, time.UTC),
+		Severity:  "error",
+		Hostname:  "pad",
+		Program:   "kernel",
+		Msg:       "oops",
+		Labels:    map[string]string{"env": "prod"},
+	})
+
+	want := `{"host":"pad","program":"fancy","level":"info","msg":"{\"key1\":\"val1\"}","ts":"2019-10-29T15:21:22.230666Z"}` + "\n" +
+		`{"host":"pad","program":"kernel","level":"error","msg":"oops","ts":"2019-10-29T15:21:23Z","labels":{"env":"prod"}}` + "\n"
+	if out.String() != want {
+		t.Errorf("got %s but want %s", out.String(), want)
+	}
+}
+
+func Test_passthrough(t *testing.T) {
+	matchRe, _ := compileFilter("keep")
+	input := &Input{
+		forward:     true,
+		passthrough: true,
+		cmd:         newSpawnCmd(CmdConfig{Args: []string{"tr", "a-z", "A-Z"}}),
+		lineChan:    make(chan *LogLine, 10),
+		scanChan:    make(chan [][]byte, 10),
+	}
+	input.setFilters(&filters{match: matchRe})
+	in := "2019-10-29T16:21:22.230666+01:00 6 pad fancy keep first\n" +
+		"2019-10-29T16:21:23.230666+01:00 6 pad fancy drop second\n" +
+		"2019-10-29T16:21:24.230666+01:00 3 pad kernel keep third\r\n"
+	counted := logScanNumber.WithLabelValues("pad", "fancy", "info", "")
+	before := testutil.ToFloat64(counted)
+
+	input.scan(&bytes.Buffer{}, strings.NewReader(in))
+	input.process()
+	close(input.lineChan)
+	var out bytes.Buffer
+	w := NewPassthroughWriter(&out)
+	w.Consume(input.lineChan)
+	w.Flush()
+
+	want := "2019-10-29T16:21:22.230666+01:00 6 pad fancy KEEP FIRST\n" +
+		"2019-10-29T16:21:24.230666+01:00 3 pad kernel KEEP THIRD\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nbut want\n%s", out.String(), want)
+	}
+	if n := testutil.ToFloat64(counted) - before; n != 1 {
+		t.Errorf("got %v lines counted but want 1", n)
+	}
+}
+
+func Test_passthroughDedup(t *testing.T) {
+	input := &Input{
+		forward:     true,
+		passthrough: true,
+		dedup:       newDeduper(time.Hour),
+		lineChan:    make(chan *LogLine, 10*scanSize),
+		scanChan:    make(chan [][]byte, 10),
+	}
+	go input.process()
+	go input.dedup.run(func(*LogLine) {})
+	r, w := io.Pipe()
+	go input.scan(&bytes.Buffer{}, r)
+
+	collapsed := testutil.ToFloat64(dedupCollapsed)
+	for i := 0; i < 3; i++ {
+		fmt.Fprint(w, "2019-10-29T16:21:22.230666+01:00 6 pad fancy again\n")
+	}
+	for testutil.ToFloat64(dedupCollapsed)-collapsed < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// the lines of other hosts refill the batches of the repeats while
+	// their summary is sent
+	go func() {
+		for i := 0; i < 4*scanSize; i++ {
+			fmt.Fprintf(w, "2019-10-29T16:21:23.230666+01:00 3 host%04d kernel other\n", i)
+		}
+		w.Close()
+	}()
+	t0 := time.Now()
+	for _, ll := range input.dedup.stop() {
+		input.send(ll, &t0)
+	}
+
+	head := "2019-10-29T16:21:22.230666+01:00 6 pad fancy "
+	for i := 0; i < 1+4*scanSize+1; i++ {
+		ll := <-input.lineChan
+		if ll.Hostname == "pad" && ll.Head != head {
+			t.Errorf("got head %q for %q but want %q", ll.Head, ll.Msg, head)
+		}
+	}
+}
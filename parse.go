@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const seperator = ' '
@@ -16,57 +20,144 @@ var (
 	errLength   = fmt.Errorf("Unexpected rsyslog message length")
 )
 
+var parseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_parse_errors_total",
+	Help: "Total number of logs which could not be parsed by reason"},
+	[]string{"reason"})
+
+var invalidUTF8Msgs = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "fancy_invalid_utf8_total",
+	Help: "Total number of msgs with invalid UTF-8 which were sanitized"})
+
+// invalidUTF8 is what sanitizeMsg does with invalid UTF-8: drop, replace
+// or escape it.
+var invalidUTF8 = "drop"
+
+// sanitizeMsg makes s valid UTF-8, so JSON encoders and Loki don't garble
+// it. A run of invalid bytes is dropped, replaced by one U+FFFD or every
+// byte of it escaped like \xff.
+func sanitizeMsg(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	invalidUTF8Msgs.Inc()
+	switch invalidUTF8 {
+	case "replace":
+		return strings.ToValidUTF8(s, "\uFFFD")
+	case "escape":
+		var b strings.Builder
+		for i := 0; i < len(s); {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				fmt.Fprintf(&b, "\\x%02x", s[i])
+			} else {
+				b.WriteString(s[i : i+size])
+			}
+			i += size
+		}
+		return b.String()
+	}
+	return strings.ToValidUTF8(s, "")
+}
+
+// parseErrorReason returns the reason label of a parser error.
+func parseErrorReason(err error) string {
+	switch err {
+	case errTemplate, errHeader:
+		return "missing_field"
+	case errLength:
+		return "too_short"
+	case errLevel:
+		return "bad_severity"
+	case errPriority:
+		return "bad_priority"
+	case errTime:
+		return "bad_time"
+	case errSD:
+		return "bad_structured_data"
+	}
+	return "other"
+}
+
+// fancyParser parses the rsyslog fancy template with sep between the
+// fields.
+type fancyParser struct {
+	sep []byte
+}
+
+var defaultFancyParser = &fancyParser{sep: []byte{seperator}}
+
 func parseLine(raw []byte, promOnly bool) (*LogLine, error) {
+	return defaultFancyParser.parse(raw, promOnly)
+}
+
+func (p *fancyParser) parse(raw []byte, promOnly bool) (*LogLine, error) {
 	var err error
 	ll := &LogLine{
 		Raw: raw,
 	}
 
-	if len(ll.Raw) < 46 {
+	l := len(p.sep)
+	if len(ll.Raw) < 42+4*l {
 		return nil, errLength
 	}
 
 	if !promOnly {
-		ll.Timestamp, err = time.Parse((time.RFC3339), string(ll.Raw[:32]))
-		if err != nil {
-			return nil, errTime
-		}
+		ll.Timestamp = parseTimestamp(string(ll.Raw[:32]))
 	}
 
-	if ll.Severity, err = getSeverity(ll.Raw[33]); err != nil {
+	if ll.Severity, err = getSeverity(ll.Raw[32+l]); err != nil {
 		return nil, err
 	}
 
-	var curPos, endPos = 35, 35
-	endPos = bytes.IndexRune(ll.Raw[curPos:], seperator)
+	var curPos, endPos = 33 + 2*l, 33 + 2*l
+	endPos = bytes.Index(ll.Raw[curPos:], p.sep)
 	if endPos == -1 {
-
+		return nil, errTemplate
 	}
 	endPos += curPos
 	ll.Hostname = string(ll.Raw[curPos:endPos])
-	curPos = endPos + 1
+	curPos = endPos + l
 
-	endPos = bytes.IndexRune(ll.Raw[curPos:], seperator)
+	endPos = bytes.Index(ll.Raw[curPos:], p.sep)
 	if endPos == -1 {
 		return nil, errTemplate
 	}
 	endPos += curPos
 	ll.Program = string(ll.Raw[curPos:endPos])
-	curPos = endPos + 1
+	curPos = endPos + l
 	ll.MsgPos = curPos
 
-	if !ll.Valid() {
+	if !ll.Valid(p.sep) {
 		return nil, errTemplate
 	}
 
 	if !promOnly {
 		ll.Msg = string(ll.Raw[ll.MsgPos:])
-		ll.Msg = strings.ToValidUTF8(ll.Msg, "")
+		ll.Msg = sanitizeMsg(ll.Msg)
 	}
 
 	return ll, nil
 }
 
+var timeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseTimestamp returns the event time of a log line. If the timestamp is
+// in none of the known formats the current time is used instead.
+func parseTimestamp(s string) time.Time {
+	for _, f := range timeFormats {
+		if t, err := time.ParseInLocation(f, s, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
 func getSeverity(in byte) (out string, err error) {
 	switch in {
 	case 48: // 0
@@ -90,3 +181,52 @@ func getSeverity(in byte) (out string, err error) {
 	}
 	return out, nil
 }
+
+// severityLevels maps the severity names to their syslog level, lower is
+// more severe.
+var severityLevels = map[string]int{
+	"emergency": 0,
+	"alert":     1,
+	"critical":  2,
+	"error":     3,
+	"warning":   4,
+	"notice":    5,
+	"info":      6,
+	"debug":     7,
+}
+
+// belowSeverity reports whether severity is less severe than min. Unknown
+// severities are never below and an empty min disables the check.
+func belowSeverity(severity, min string) bool {
+	if min == "" {
+		return false
+	}
+	level, ok := severityLevels[severity]
+	return ok && level > severityLevels[min]
+}
+
+// severityMap renames severities, the keys are lower case.
+type severityMap map[string]string
+
+// parseSeverityMap parses comma separated from=to pairs like
+// WARN=warning,ERR=error.
+func parseSeverityMap(s string) (severityMap, error) {
+	m := severityMap{}
+	for _, pair := range splitList(s) {
+		i := strings.IndexByte(pair, '=')
+		if i < 1 || i == len(pair)-1 {
+			return nil, fmt.Errorf("%q is not from=to", pair)
+		}
+		m[strings.ToLower(strings.TrimSpace(pair[:i]))] = strings.TrimSpace(pair[i+1:])
+	}
+	return m, nil
+}
+
+// apply returns the new name of severity, matched case-insensitively. An
+// unmapped severity is returned unchanged.
+func (m severityMap) apply(severity string) string {
+	if to, ok := m[strings.ToLower(severity)]; ok {
+		return to
+	}
+	return severity
+}
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"log"
 	"log/syslog"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var raw = []byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy {\"key1\":\"val1\", \"key2\":\"val2\"}\n")
@@ -52,9 +58,9 @@ func Benchmark_parseLine(b *testing.B) {
 	input := &Input{
 		//cmd:        []string{"tr", "[a-z]", "[A-Z]"},
 		promOnly:        true,
-		staticTagFilter: []byte("val1"),
+		staticTagFilter: newTagFilter("val1", nil),
 		lineChan:        make(chan *LogLine, 1000),
-		scanChan:        make(chan [scanSize][]byte, 1000),
+		scanChan:        make(chan [][]byte, 1000),
 	}
 
 	var stdout bytes.Buffer
@@ -84,3 +90,226 @@ func ping() {
 	}
 	w.Info("ping fancy!")
 }
+
+func Test_parsers(t *testing.T) {
+	cases := []struct {
+		format string
+		input  string
+		want   LogLine
+		err    error
+	}{
+		{
+			format: "rfc5424",
+			input:  "<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"Application\"] An application event\n",
+			want: LogLine{
+				Severity: "notice",
+				Hostname: "mymachine.example.com",
+				Program:  "evntslog",
+				Msg:      "An application event\n",
+				Labels: map[string]string{
+					"exampleSDID_32473_iut":         "3",
+					"exampleSDID_32473_eventSource": "Application",
+				},
+			},
+		},
+		{
+			format: "rfc5424",
+			input:  "<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - 'su root' failed\n",
+			want: LogLine{
+				Severity: "critical",
+				Hostname: "mymachine",
+				Program:  "su",
+				Msg:      "'su root' failed\n",
+			},
+		},
+		{
+			format: "rfc5424",
+			input:  "<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 [broken\n",
+			err:    errSD,
+		},
+		{
+			format: "rfc5424",
+			input:  "34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - msg\n",
+			err:    errPriority,
+		},
+		{
+			format: "rfc3164",
+			input:  "<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed\n",
+			want: LogLine{
+				Severity: "critical",
+				Hostname: "mymachine",
+				Program:  "su",
+				Msg:      "'su root' failed\n",
+			},
+		},
+		{
+			format: "rfc3164",
+			input:  "<13>Feb  5 17:32:18 10.0.0.99 kernel: link up\n",
+			want: LogLine{
+				Severity: "notice",
+				Hostname: "10.0.0.99",
+				Program:  "kernel",
+				Msg:      "link up\n",
+			},
+		},
+		{
+			format: "rfc3164",
+			input:  "<13>2019-10-29 10.0.0.99 kernel: link up\n",
+			err:    errTime,
+		},
+		{
+			format: "fancy",
+			input:  string(raw),
+			want: LogLine{
+				Severity: "info",
+				Hostname: "pad",
+				Program:  "fancy",
+				Msg:      "{\"key1\":\"val1\", \"key2\":\"val2\"}\n",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		got, err := parsers[c.format]([]byte(c.input), false)
+		if err != c.err {
+			t.Errorf("%s %q: got error %v but want %v", c.format, c.input, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Severity != c.want.Severity || got.Hostname != c.want.Hostname ||
+			got.Program != c.want.Program || got.Msg != c.want.Msg ||
+			!reflect.DeepEqual(got.Labels, c.want.Labels) {
+			t.Errorf("%s %q: got %+v but want %+v", c.format, c.input, got, c.want)
+		}
+	}
+}
+
+func Test_parseTimestamp(t *testing.T) {
+	want := time.Date(2019, 10, 29, 15, 21, 22, 230666000, time.UTC)
+	cases := []string{
+		"2019-10-29T16:21:22.230666+01:00",
+		"2019-10-29T15:21:22.230666Z",
+		"2019-10-29 16:21:22.230666+01:00",
+	}
+	for _, c := range cases {
+		if got := parseTimestamp(c); !got.Equal(want) {
+			t.Errorf("got %v for %q but want %v", got, c, want)
+		}
+	}
+
+	if got := parseTimestamp("2019-10-29T16:21:22+01:00"); !got.Equal(want.Truncate(time.Second)) {
+		t.Errorf("got %v for a timestamp without fraction", got)
+	}
+
+	before := time.Now()
+	for _, c := range []string{"", "-", "yesterday at noon"} {
+		if got := parseTimestamp(c); got.Before(before) || got.After(time.Now()) {
+			t.Errorf("got %v for %q but want the current time", got, c)
+		}
+	}
+
+	ll, err := parseLine([]byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy msg of some length\n"), false)
+	if err != nil || !ll.Timestamp.Equal(want) {
+		t.Errorf("got %v,%v but want the event time %v", ll, err, want)
+	}
+}
+
+func Test_belowSeverity(t *testing.T) {
+	names := []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+	for min, minName := range names {
+		for level, name := range names {
+			if got, want := belowSeverity(name, minName), level > min; got != want {
+				t.Errorf("belowSeverity(%s, %s) = %v but want %v", name, minName, got, want)
+			}
+		}
+		if belowSeverity("custom", minName) {
+			t.Errorf("unknown severity was below %s", minName)
+		}
+	}
+	for _, name := range names {
+		if belowSeverity(name, "") {
+			t.Errorf("%s was below an empty min-severity", name)
+		}
+	}
+}
+
+func Test_sanitizeMsg(t *testing.T) {
+	defer func(mode string) { invalidUTF8 = mode }(invalidUTF8)
+	raw := "2019-10-29T16:21:22.230666+01:00 6 pad fancy ok \xff\xfe bytes ü\xc3\n"
+	cases := map[string]string{
+		"drop":    "ok  bytes ü\n",
+		"replace": "ok \uFFFD bytes ü\uFFFD\n",
+		"escape":  `ok \xff\xfe bytes ü\xc3` + "\n",
+	}
+	for mode, want := range cases {
+		invalidUTF8 = mode
+		before := testutil.ToFloat64(invalidUTF8Msgs)
+		ll, err := parseLine([]byte(raw), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ll.Msg != want || !utf8.ValidString(ll.Msg) {
+			t.Errorf("%s: got %q but want %q", mode, ll.Msg, want)
+		}
+		if got := testutil.ToFloat64(invalidUTF8Msgs) - before; got != 1 {
+			t.Errorf("%s: got %v invalid msgs but want 1", mode, got)
+		}
+	}
+
+	before := testutil.ToFloat64(invalidUTF8Msgs)
+	if got := sanitizeMsg("valid ü"); got != "valid ü" || testutil.ToFloat64(invalidUTF8Msgs) != before {
+		t.Errorf("got %q for a valid msg and counted it", got)
+	}
+}
+
+func Test_severityMap(t *testing.T) {
+	m, err := parseSeverityMap("WARN=warning, ERR=error,Fatal=critical,4=warning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"WARN":    "warning",
+		"warn":    "warning",
+		"Err":     "error",
+		"FATAL":   "critical",
+		"4":       "warning",
+		"info":    "info",
+		"Audit":   "Audit",
+		"warning": "warning",
+	}
+	for in, want := range cases {
+		if got := m.apply(in); got != want {
+			t.Errorf("got %q for %q but want %q", got, in, want)
+		}
+	}
+
+	for _, s := range []string{"WARN", "=warning", "WARN=", "WARN=warning,ERR"} {
+		if _, err := parseSeverityMap(s); err == nil {
+			t.Errorf("got no error for %q", s)
+		}
+	}
+	if m, err := parseSeverityMap(""); err != nil || len(m) != 0 {
+		t.Errorf("got %v,%v for an empty severity-map", m, err)
+	}
+}
+
+func Test_fancyParserSeparator(t *testing.T) {
+	for _, sep := range []string{"|", "\t", " | "} {
+		p := &fancyParser{sep: []byte(sep)}
+		input := strings.Join([]string{"2019-10-29T16:21:22.230666+01:00", "3", "pad", "kernel", "oops in module xyz\n"}, sep)
+		ll, err := p.parse([]byte(input), false)
+		if err != nil {
+			t.Fatalf("%q: %v", sep, err)
+		}
+		if ll.Severity != "error" || ll.Hostname != "pad" || ll.Program != "kernel" || ll.Msg != "oops in module xyz\n" {
+			t.Errorf("%q: got %+v", sep, ll)
+		}
+
+		// the default separator doesn't split this line
+		if _, err := p.parse([]byte("2019-10-29T16:21:22.230666+01:00 3 pad kernel oops in module xyz\n"), false); err == nil {
+			t.Errorf("%q: got no error for a line with blanks", sep)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// PoolConfig tunes the reuse of the connections of an HTTP client. Zero
+// values keep the settings of http.DefaultTransport.
+type PoolConfig struct {
+	// MaxIdleConns bounds the idle connections over all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost bounds them per host. The default of 2 has
+	// parallel pushes to a load balanced Loki dial again and again.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes idle connections after this long.
+	IdleConnTimeout time.Duration
+}
+
+// poolClient returns a copy of c whose transport applies p, c itself when p
+// is empty.
+func poolClient(c *http.Client, p PoolConfig) *http.Client {
+	if p == (PoolConfig{}) {
+		return c
+	}
+	t, ok := c.Transport.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	if p.MaxIdleConns > 0 {
+		t.MaxIdleConns = p.MaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+	}
+	if p.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = p.IdleConnTimeout
+	}
+	return &http.Client{Transport: t, Timeout: c.Timeout}
+}
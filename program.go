@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// programSettings are the settings a programs section of the config file
+// can override.
+var programSettings = map[string]bool{
+	"min-severity":   true,
+	"match":          true,
+	"exclude":        true,
+	"rate-limit":     true,
+	"redact":         true,
+	"redact-pattern": true,
+}
+
+// programOverride holds the settings of one programs section. The settings
+// it doesn't set are the global ones.
+type programOverride struct {
+	glob        string
+	minSeverity string
+	limiter     *rateLimiter
+	redact      redactor
+	// match and exclude only replace the global filters when set, which a
+	// reload may change.
+	match, exclude       *regexp.Regexp
+	setMatch, setExclude bool
+}
+
+// programOverrides picks the section for the logs of a program. The most
+// specific glob matching the program wins: an exact name before any glob,
+// then the glob with the most literal characters, see globSpecificity.
+type programOverrides struct {
+	list []*programOverride
+	// cache maps a program to its section, nil when none matches
+	cache sync.Map
+}
+
+// newProgramOverrides builds the sections of the config file keyed by glob.
+// global returns the value of a global setting. It returns nil without
+// sections.
+func newProgramOverrides(sections map[string]map[string]string, global func(name string) string) (*programOverrides, error) {
+	if len(sections) == 0 {
+		return nil, nil
+	}
+	p := &programOverrides{}
+	for glob, s := range sections {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("programs: invalid glob %q", glob)
+		}
+		o, err := newProgramOverride(glob, s, global)
+		if err != nil {
+			return nil, fmt.Errorf("programs: %s: %v", glob, err)
+		}
+		p.list = append(p.list, o)
+	}
+	sort.Slice(p.list, func(i, j int) bool {
+		a, b := globSpecificity(p.list[i].glob), globSpecificity(p.list[j].glob)
+		if a != b {
+			return a > b
+		}
+		return p.list[i].glob < p.list[j].glob
+	})
+	return p, nil
+}
+
+func newProgramOverride(glob string, s map[string]string, global func(name string) string) (*programOverride, error) {
+	value := func(name string) string {
+		if v, ok := s[name]; ok {
+			return v
+		}
+		return global(name)
+	}
+	for name, v := range s {
+		if !programSettings[name] {
+			return nil, fmt.Errorf("unknown setting %q", name)
+		}
+		if rule, ok := flagRules[name]; ok {
+			if want := rule(v); want != "" {
+				return nil, fmt.Errorf("invalid %s value %q, want %s", name, v, want)
+			}
+		}
+	}
+
+	o := &programOverride{glob: glob, minSeverity: value("min-severity")}
+	if _, ok := severityLevels[o.minSeverity]; !ok && o.minSeverity != "" {
+		return nil, fmt.Errorf("invalid min-severity value %q, want a syslog severity like warning", o.minSeverity)
+	}
+	rate, err := strconv.ParseFloat(value("rate-limit"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate-limit: %v", err)
+	}
+	if rate > 0 {
+		o.limiter = newRateLimiter(rate)
+	}
+	redact, err := strconv.ParseBool(value("redact"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid redact: %v", err)
+	}
+	if o.redact, err = newRedactor(redact, value("redact-pattern")); err != nil {
+		return nil, fmt.Errorf("invalid redact-pattern: %v", err)
+	}
+	if v, ok := s["match"]; ok {
+		if o.match, err = compileFilter(v); err != nil {
+			return nil, fmt.Errorf("invalid match: %v", err)
+		}
+		o.setMatch = true
+	}
+	if v, ok := s["exclude"]; ok {
+		if o.exclude, err = compileFilter(v); err != nil {
+			return nil, fmt.Errorf("invalid exclude: %v", err)
+		}
+		o.setExclude = true
+	}
+	return o, nil
+}
+
+// lookup returns the section for program, nil when none matches.
+func (p *programOverrides) lookup(program string) *programOverride {
+	if p == nil {
+		return nil
+	}
+	if o, ok := p.cache.Load(program); ok {
+		return o.(*programOverride)
+	}
+	var match *programOverride
+	for _, o := range p.list {
+		if ok, _ := path.Match(o.glob, program); ok {
+			match = o
+			break
+		}
+	}
+	p.cache.Store(program, match)
+	return match
+}
+
+// globSpecificity ranks a glob by what it matches. A literal character
+// counts most, then a character class, then ?, while * doesn't count. A
+// name without any wildcard ranks above all globs.
+func globSpecificity(glob string) int {
+	n, wild := 0, false
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			wild = true
+		case '?':
+			wild = true
+			n++
+		case '[':
+			wild = true
+			n += 2
+			for i < len(glob) && glob[i] != ']' {
+				i++
+			}
+		case '\\':
+			i++
+			n += 3
+		default:
+			n += 3
+		}
+	}
+	if !wild {
+		return 1 << 30
+	}
+	return n
+}
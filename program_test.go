@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/rand"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testPrograms builds sections over the global settings of Test_programOverridesHandle.
+func testPrograms(t *testing.T, sections map[string]map[string]string) *programOverrides {
+	t.Helper()
+	global := map[string]string{"min-severity": "warning", "rate-limit": "0", "redact": "false", "redact-pattern": ""}
+	p, err := newProgramOverrides(sections, func(name string) string { return global[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_programOverridesLookup(t *testing.T) {
+	p := testPrograms(t, map[string]map[string]string{
+		"*":          {"min-severity": "error"},
+		"nginx*":     {"min-severity": "warning"},
+		"nginx-*":    {"min-severity": "notice"},
+		"nginx-lb?":  {"min-severity": "info"},
+		"nginx-lb":   {"min-severity": "debug"},
+		"nginx-[ab]": {"min-severity": "critical"},
+	})
+	cases := map[string]string{
+		"nginx-lb":  "nginx-lb",
+		"nginx-lb2": "nginx-lb?",
+		"nginx-a":   "nginx-[ab]",
+		"nginx-web": "nginx-*",
+		"nginx":     "nginx*",
+		"sshd":      "*",
+	}
+	for program, want := range cases {
+		// the second lookup comes from the cache
+		for i := 0; i < 2; i++ {
+			o := p.lookup(program)
+			if o == nil || o.glob != want {
+				t.Errorf("%s: got section %v but want %s", program, o, want)
+			}
+		}
+	}
+
+	p = testPrograms(t, map[string]map[string]string{"nginx-*": {}})
+	if o := p.lookup("sshd"); o != nil {
+		t.Errorf("got section %s for a program matching none", o.glob)
+	}
+	if o := (*programOverrides)(nil).lookup("sshd"); o != nil {
+		t.Errorf("got section %s without sections", o.glob)
+	}
+}
+
+func Test_programOverridesHandle(t *testing.T) {
+	input := &Input{
+		forward:     true,
+		minSeverity: "warning",
+		lineChan:    make(chan *LogLine, 100),
+		programs: testPrograms(t, map[string]map[string]string{
+			"nginx-*":  {"rate-limit": "2", "min-severity": "debug"},
+			"nginx-lb": {"exclude": "health"},
+			"sshd":     {"redact": "true"},
+		}),
+	}
+	input.setFilters(&filters{exclude: regexp.MustCompile("noise")})
+
+	send := func(program, severity, msg string) bool {
+		ll := testLogLine(msg)
+		ll.Program, ll.Severity, ll.Raw = program, severity, []byte(msg)
+		now := time.Now()
+		input.handle(ll, rand.New(rand.NewSource(1)), &now)
+		select {
+		case <-input.lineChan:
+			return true
+		default:
+			return false
+		}
+	}
+	cases := []struct {
+		program, severity, msg string
+		want                   bool
+	}{
+		// nginx-web takes the rate limit and logs below warning
+		{"nginx-web", "info", "a", true},
+		{"nginx-web", "info", "b", true},
+		{"nginx-web", "info", "c", false},
+		// nginx-lb takes only its exclude, the global min-severity stays
+		{"nginx-lb", "error", "health check", false},
+		{"nginx-lb", "error", "noise", true},
+		{"nginx-lb", "info", "request", false},
+		{"nginx-lb", "error", "request", true},
+		// the other programs keep the global settings
+		{"cron", "error", "noise", false},
+		{"cron", "info", "job", false},
+		{"cron", "error", "job", true},
+	}
+	for _, c := range cases {
+		if got := send(c.program, c.severity, c.msg); got != c.want {
+			t.Errorf("%s %s %q: got forwarded %v but want %v", c.program, c.severity, c.msg, got, c.want)
+		}
+	}
+
+	now := time.Now()
+	ll := testLogLine("mail bob@example.com")
+	ll.Program = "sshd"
+	input.send(ll, &now)
+	if got := (<-input.lineChan).Msg; got != "mail "+redactMask {
+		t.Errorf("got msg %q but want it redacted for sshd", got)
+	}
+}
+
+func Test_programOverridesErrors(t *testing.T) {
+	cases := []map[string]map[string]string{
+		{"[": {}},
+		{"nginx": {"loki-url": "http://loki"}},
+		{"nginx": {"rate-limit": "-1"}},
+		{"nginx": {"min-severity": "loud"}},
+		{"nginx": {"match": "("}},
+		{"nginx": {"redact": "maybe"}},
+	}
+	for _, c := range cases {
+		global := func(string) string { return "0" }
+		if _, err := newProgramOverrides(c, global); err == nil {
+			t.Errorf("got no error for %v", c)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	now := time.Unix(1572362482, 0)
+	r := newRateLimiter(10)
+	r.now = func() time.Time { return now }
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if r.allow("noisy") {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("got %d allowed logs of a burst but want 10", allowed)
+	}
+	for i := 0; i < 10; i++ {
+		if !r.allow("quiet") {
+			t.Fatalf("quiet program got limited after %d logs", i)
+		}
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	allowed = 0
+	for i := 0; i < 100; i++ {
+		if r.allow("noisy") {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("got %d allowed logs after half a second but want 5", allowed)
+	}
+}
+
+func Test_processRateLimit(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		limiter:  newRateLimiter(1),
+		scanChan: make(chan [][]byte, 1),
+		lineChan: make(chan *LogLine, 100),
+	}
+	var batch [][]byte
+	for i := 0; i < 20; i++ {
+		batch = append(batch, []byte("2019-10-29T16:21:22.230666+01:00 6 pad noisy msg\n"))
+	}
+	batch = append(batch, []byte("2019-10-29T16:21:22.230666+01:00 6 pad quiet msg\n"))
+	input.scanChan <- batch
+	close(input.scanChan)
+	input.process()
+
+	programs := map[string]int{}
+	for len(input.lineChan) > 0 {
+		programs[(<-input.lineChan).Program]++
+	}
+	if programs["noisy"] != 1 || programs["quiet"] != 1 {
+		t.Errorf("got forwarded logs %v but want one of each program", programs)
+	}
+}
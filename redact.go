@@ -0,0 +1,60 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var redactions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_redactions_total",
+	Help: "Total number of matches masked in msgs by pattern"},
+	[]string{"pattern"})
+
+const redactMask = "[REDACTED]"
+
+// redactRule masks the matches of re with repl, which may refer to the
+// groups of re.
+type redactRule struct {
+	name string
+	re   *regexp.Regexp
+	repl string
+}
+
+// builtinRedactRules catch the most common secrets and PII.
+var builtinRedactRules = []redactRule{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), redactMask},
+	{"card", regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), redactMask},
+	{"bearer", regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/-]+=*`), "${1}" + redactMask},
+}
+
+// redactor masks secrets and PII in msgs before they are forwarded.
+type redactor []redactRule
+
+// newRedactor returns the built-in rules when builtin is set and a custom
+// rule for pattern when it is not empty.
+func newRedactor(builtin bool, pattern string) (redactor, error) {
+	var r redactor
+	if builtin {
+		r = append(r, builtinRedactRules...)
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, redactRule{"custom", re, redactMask})
+	}
+	return r, nil
+}
+
+func (r redactor) apply(msg string) string {
+	for _, rule := range r {
+		if n := len(rule.re.FindAllStringIndex(msg, -1)); n > 0 {
+			redactions.WithLabelValues(rule.name).Add(float64(n))
+			msg = rule.re.ReplaceAllString(msg, rule.repl)
+		}
+	}
+	return msg
+}
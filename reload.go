@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// filters holds the match and exclude expressions of process.
+type filters struct {
+	match   *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// setFilters swaps the filters, the workers pick them up with the next line.
+func (in *Input) setFilters(f *filters) {
+	in.filters.Store(f)
+}
+
+// reloadFlags are the settings a reload takes from the -config file.
+var reloadFlags = []string{"match", "exclude", "label", "labels-from-env"}
+
+// reloader reads the filters and static labels from the -config file
+// again. Like at startup the file doesn't override settings given on the
+// command line or in the environment.
+type reloader struct {
+	path   string
+	fixed  map[string]string
+	labels labelFlag
+}
+
+// newReloader keeps the values of the reloadFlags which were set in fs
+// before the config file was applied, labels are the -label pairs.
+func newReloader(path string, fs *flag.FlagSet, labels labelFlag) *reloader {
+	r := &reloader{path: path, fixed: map[string]string{}, labels: labelFlag{}}
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range reloadFlags {
+			if f.Name == name {
+				r.fixed[name] = f.Value.String()
+			}
+		}
+	})
+	for k, v := range labels {
+		r.labels[k] = v
+	}
+	return r
+}
+
+// load returns the filters and static labels of the config file.
+func (r *reloader) load() (*filters, labelFlag, error) {
+	c, err := loadConfig(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	value := func(name string) string {
+		if v, ok := r.fixed[name]; ok {
+			return v
+		}
+		return c.Values[name]
+	}
+
+	f := &filters{}
+	if f.match, err = compileFilter(value("match")); err != nil {
+		return nil, nil, fmt.Errorf("invalid match: %v", err)
+	}
+	if f.exclude, err = compileFilter(value("exclude")); err != nil {
+		return nil, nil, fmt.Errorf("invalid exclude: %v", err)
+	}
+
+	labels := labelFlag{}
+	if _, ok := r.fixed["label"]; ok {
+		for k, v := range r.labels {
+			labels[k] = v
+		}
+	} else if v := c.Values["label"]; v != "" {
+		if err := labels.Set(v); err != nil {
+			return nil, nil, fmt.Errorf("invalid label: %v", err)
+		}
+	}
+	if err := labels.setFromEnv(value("labels-from-env"), os.LookupEnv); err != nil {
+		return nil, nil, fmt.Errorf("invalid labels-from-env: %v", err)
+	}
+	return f, labels, nil
+}
+
+// run applies the config file on every signal from hup. A config which
+// doesn't load keeps the previous settings.
+func (r *reloader) run(hup <-chan os.Signal, in *Input, sinks map[string]Sink) {
+	for range hup {
+		f, labels, err := r.load()
+		if err != nil {
+			logErrorf("reload %s: %v", r.path, err)
+			continue
+		}
+		in.setFilters(f)
+		if l, ok := sinks["loki"].(*Loki); ok {
+			l.setLabels(labels)
+		}
+		logInfof("reloaded filters and labels from %s", r.path)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fancy.yml")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("match: ERROR\nlabel: env=prod\n")
+
+	// exclude comes from the command line and wins over the file
+	fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+	for _, name := range []string{"match", "exclude", "labels-from-env"} {
+		fs.String(name, "", "")
+	}
+	labels := labelFlag{}
+	fs.Var(labels, "label", "")
+	fs.Set("exclude", "/health")
+	r := newReloader(path, fs, labels)
+
+	in := &Input{}
+	f, _, err := r.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.setFilters(f)
+	filter := func(msg string) string {
+		return in.filter(&LogLine{Raw: []byte(msg)})
+	}
+	if filter("ERROR disk full") != "" || filter("INFO all good") != "match" || filter("ERROR /health") != "exclude" {
+		t.Fatal("the filters of the config are not used")
+	}
+
+	rec := &pushRecorder{}
+	l, srv := newTestLoki(t, rec, LokiConfig{Labels: labels})
+	defer srv.Close()
+	hup := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		r.run(hup, in, map[string]Sink{"loki": l})
+		close(done)
+	}()
+
+	write("match: INFO\nexclude: debug\nlabel: env=staging\n")
+	hup <- syscall.SIGHUP
+	deadline := time.Now().Add(3 * time.Second)
+	for filter("INFO all good") != "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// a broken config keeps the settings of the last reload
+	write("match: \"(\"\n")
+	hup <- syscall.SIGHUP
+	close(hup)
+	<-done
+
+	if filter("ERROR disk full") != "match" || filter("INFO all good") != "" || filter("INFO /health") != "exclude" {
+		t.Error("new lines don't honor the reloaded filters")
+	}
+	push(l, testLogLine("msg"))
+	want := `{env="staging", hostname="pad", job="fancy", level="info", program="fancy"}`
+	if got := decodePush(t, rec.body[0]).Streams[0].Labels; got != want {
+		t.Errorf("got labels %s but want %s", got, want)
+	}
+}
+
+func Test_reloadKeepsLabelFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fancy.yml")
+	if err := ioutil.WriteFile(path, []byte("label: env=prod\nlabels-from-env: pod=FANCY_TEST_POD\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FANCY_TEST_POD", "web-1")
+	defer os.Unsetenv("FANCY_TEST_POD")
+
+	fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+	fs.String("labels-from-env", "", "")
+	labels := labelFlag{}
+	fs.Var(labels, "label", "")
+	fs.Set("label", "dc=a")
+	_, got, err := newReloader(path, fs, labels).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "dc=a,pod=web-1" {
+		t.Errorf("got labels %s but want dc=a,pod=web-1", got)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sinkDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_sink_dropped_total",
+	Help: "Total number of logs dropped because the buffered channel of one sink was full"},
+	[]string{"sink"})
+
+// Sink is an output for parsed log lines.
+type Sink interface {
+	// Consume reads lines until the channel is closed.
+	Consume(lines <-chan *LogLine)
+	// Flush sends whatever Consume still holds back. It is called once
+	// after Consume returned.
+	Flush()
+}
+
+// runSinks starts every sink in its own goroutine and returns a channel
+// which is closed when all of them are flushed. With more than one sink
+// each one gets its own buffered channel of the given size, so a slow sink
+// only drops its own lines unless block is set.
+func runSinks(lines <-chan *LogLine, sinks map[string]Sink, size int, block bool) chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(s Sink, c <-chan *LogLine) {
+		s.Consume(c)
+		s.Flush()
+		wg.Done()
+	}
+
+	if len(sinks) == 1 {
+		for _, s := range sinks {
+			wg.Add(1)
+			go run(s, lines)
+		}
+	} else {
+		chans := make(map[string]chan *LogLine, len(sinks))
+		for name, s := range sinks {
+			chans[name] = make(chan *LogLine, size)
+			wg.Add(1)
+			go run(s, chans[name])
+		}
+		go func() {
+			for ll := range lines {
+				for name, c := range chans {
+					if block {
+						c <- ll
+						continue
+					}
+					select {
+					case c <- ll:
+					default:
+						sinkDropped.WithLabelValues(name).Inc()
+					}
+				}
+			}
+			for _, c := range chans {
+				close(c)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
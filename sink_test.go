@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// consume runs s until all lines are read and flushes it.
+func consume(s Sink, lines ...*LogLine) {
+	c := make(chan *LogLine, len(lines))
+	for _, ll := range lines {
+		c <- ll
+	}
+	close(c)
+	s.Consume(c)
+	s.Flush()
+}
+
+type fakeSink struct {
+	sync.Mutex
+	lines   []*LogLine
+	flushed bool
+	delay   time.Duration
+}
+
+func (f *fakeSink) Consume(lines <-chan *LogLine) {
+	for ll := range lines {
+		time.Sleep(f.delay)
+		f.Lock()
+		f.lines = append(f.lines, ll)
+		f.Unlock()
+	}
+}
+
+func (f *fakeSink) Flush() {
+	f.Lock()
+	f.flushed = true
+	f.Unlock()
+}
+
+func Test_runSinks(t *testing.T) {
+	a, b := &fakeSink{}, &fakeSink{}
+	lines := make(chan *LogLine, 10)
+	done := runSinks(lines, map[string]Sink{"a": a, "b": b}, 10, false)
+	for i := 0; i < 5; i++ {
+		lines <- testLogLine("msg")
+	}
+	close(lines)
+	<-done
+
+	for name, s := range map[string]*fakeSink{"a": a, "b": b} {
+		if len(s.lines) != 5 || !s.flushed {
+			t.Errorf("sink %s got %d lines, flushed %v but want 5 lines and a flush", name, len(s.lines), s.flushed)
+		}
+	}
+}
+
+func Test_runSinksSlowSinkDrops(t *testing.T) {
+	fast, slow := &fakeSink{}, &fakeSink{delay: 10 * time.Millisecond}
+	lines := make(chan *LogLine, 100)
+	done := runSinks(lines, map[string]Sink{"fast": fast, "slow": slow}, 1, false)
+	for i := 0; i < 20; i++ {
+		lines <- testLogLine("msg")
+		time.Sleep(time.Millisecond)
+	}
+	close(lines)
+	<-done
+
+	if len(fast.lines) != 20 {
+		t.Errorf("fast sink got %d lines but want 20", len(fast.lines))
+	}
+	if len(slow.lines) >= 20 {
+		t.Errorf("slow sink got %d lines but want some dropped", len(slow.lines))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sourceFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fancy_source_filtered_total",
+	Help: "Total number of logs dropped by the allow and deny lists of hostname and program"},
+	[]string{"field", "list"})
+
+// sourceList holds names and globs like nginx-*.
+type sourceList []string
+
+// newSourceList takes the comma separated names and globs of s.
+func newSourceList(s string) (sourceList, error) {
+	l := sourceList(splitList(s))
+	for _, p := range l {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q", p)
+		}
+	}
+	return l, nil
+}
+
+func (l sourceList) match(v string) bool {
+	for _, p := range l {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceFilter drops logs by hostname and program. A deny list wins over
+// an allow list, an empty allow list allows every name.
+type sourceFilter struct {
+	allowProgram, denyProgram sourceList
+	allowHost, denyHost       sourceList
+}
+
+// newSourceFilter takes the lists of the flags, it returns nil when all of
+// them are empty.
+func newSourceFilter(allowProgram, denyProgram, allowHost, denyHost string) (*sourceFilter, error) {
+	f := &sourceFilter{}
+	for _, l := range []struct {
+		name string
+		list *sourceList
+		s    string
+	}{
+		{"program-allow", &f.allowProgram, allowProgram},
+		{"program-deny", &f.denyProgram, denyProgram},
+		{"host-allow", &f.allowHost, allowHost},
+		{"host-deny", &f.denyHost, denyHost},
+	} {
+		var err error
+		if *l.list, err = newSourceList(l.s); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", l.name, err)
+		}
+	}
+	if len(f.allowProgram)+len(f.denyProgram)+len(f.allowHost)+len(f.denyHost) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// filter returns the field and the list which drop ll, or empty strings
+// when ll passes.
+func (f *sourceFilter) filter(ll *LogLine) (string, string) {
+	switch {
+	case f.denyProgram.match(ll.Program):
+		return "program", "deny"
+	case f.denyHost.match(ll.Hostname):
+		return "hostname", "deny"
+	case len(f.allowProgram) > 0 && !f.allowProgram.match(ll.Program):
+		return "program", "allow"
+	case len(f.allowHost) > 0 && !f.allowHost.match(ll.Hostname):
+		return "hostname", "allow"
+	}
+	return "", ""
+}
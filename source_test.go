@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_sourceFilter(t *testing.T) {
+	cases := []struct {
+		programAllow, programDeny, hostAllow, hostDeny string
+		host, program                                  string
+		field, list                                    string
+	}{
+		{programAllow: "nginx,sshd", host: "web-1", program: "nginx"},
+		{programAllow: "nginx,sshd", host: "web-1", program: "cron", field: "program", list: "allow"},
+		{programAllow: "nginx-*", host: "web-1", program: "nginx-ingress"},
+		{programDeny: "cron", host: "web-1", program: "cron", field: "program", list: "deny"},
+		{programDeny: "cron", host: "web-1", program: "nginx"},
+		// deny wins over allow
+		{programAllow: "*", programDeny: "cron*", host: "web-1", program: "crond", field: "program", list: "deny"},
+		{hostAllow: "web-*", host: "db-1", program: "nginx", field: "hostname", list: "allow"},
+		{hostAllow: "web-*", hostDeny: "web-2", host: "web-2", program: "nginx", field: "hostname", list: "deny"},
+		{hostAllow: "web-*", hostDeny: "web-2", host: "web-1", program: "nginx"},
+		// a deny of one field wins over an allow of the other
+		{programAllow: "nginx", hostDeny: "web-2", host: "web-2", program: "nginx", field: "hostname", list: "deny"},
+		{programDeny: "cron", hostAllow: "db-*", host: "web-1", program: "cron", field: "program", list: "deny"},
+		{programAllow: "nginx", hostAllow: "web-*", host: "db-1", program: "cron", field: "program", list: "allow"},
+	}
+	for _, c := range cases {
+		f, err := newSourceFilter(c.programAllow, c.programDeny, c.hostAllow, c.hostDeny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		field, list := f.filter(&LogLine{Hostname: c.host, Program: c.program})
+		if field != c.field || list != c.list {
+			t.Errorf("%+v: got %q %q", c, field, list)
+		}
+	}
+
+	if f, err := newSourceFilter("", " , ", "", ""); f != nil || err != nil {
+		t.Errorf("got %v, %v but want no filter", f, err)
+	}
+	if _, err := newSourceFilter("", "", "web-[", ""); err == nil {
+		t.Error("got no error for a broken glob")
+	}
+}
+
+func Test_handleSourceFilter(t *testing.T) {
+	sources, _ := newSourceFilter("", "kernel", "", "")
+	input := &Input{sources: sources, scanChan: make(chan [][]byte, 1)}
+	dropped := sourceFiltered.WithLabelValues("program", "deny")
+	before := testutil.ToFloat64(dropped)
+	input.scanChan <- [][]byte{
+		[]byte("2019-10-29T16:21:22.230666+01:00 3 pad kernel oops\n"),
+		[]byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy msg\n"),
+	}
+	close(input.scanChan)
+	input.process()
+	if n := testutil.ToFloat64(dropped) - before; n != 1 {
+		t.Errorf("got %v logs dropped but want 1", n)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lokiSpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fancy_loki_spool_bytes",
+		Help: "Size of the batches spooled to disk until Loki is reachable again"})
+	lokiSpoolEvicted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fancy_loki_spool_evicted_bytes_total",
+		Help: "Total number of spooled bytes evicted because the spool was full"})
+)
+
+// diskSpool is a batchQueue with a file per batch in dir, so the batches
+// survive a restart. Adding a batch evicts the oldest ones until all of
+// them fit into max bytes. The file names hold a sequence number and the
+// encoding, files of another encoding are left alone.
+type diskSpool struct {
+	dir   string
+	ext   string
+	max   int64
+	size  int64
+	next  uint64
+	files []spoolFile
+}
+
+type spoolFile struct {
+	name string
+	size int64
+}
+
+// newDiskSpool picks up the batches a previous run left in dir.
+func newDiskSpool(dir, ext string, max int64) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &diskSpool{dir: dir, ext: ext, max: max}
+	for _, fi := range infos {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), ext), 10, 64)
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ext) || err != nil {
+			continue
+		}
+		s.files = append(s.files, spoolFile{fi.Name(), fi.Size()})
+		s.size += fi.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	// the zero padded names sort by sequence number
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	lokiSpoolBytes.Set(float64(s.size))
+	return s, nil
+}
+
+func (s *diskSpool) add(buf []byte, lines int) {
+	name := fmt.Sprintf("%020d%s", s.next, s.ext)
+	s.next++
+	if err := ioutil.WriteFile(filepath.Join(s.dir, name), buf, 0600); err != nil {
+		logErrorf("spool batch: %v", err)
+		return
+	}
+	s.files = append(s.files, spoolFile{name, int64(len(buf))})
+	s.size += int64(len(buf))
+	for s.size > s.max {
+		lokiSpoolEvicted.Add(float64(s.files[0].size))
+		s.remove()
+	}
+	lokiSpoolBytes.Set(float64(s.size))
+}
+
+// first reads the oldest batch, unreadable files are dropped.
+func (s *diskSpool) first() ([]byte, bool) {
+	for len(s.files) > 0 {
+		buf, err := ioutil.ReadFile(filepath.Join(s.dir, s.files[0].name))
+		if err == nil {
+			return buf, true
+		}
+		logErrorf("read spooled batch: %v", err)
+		s.remove()
+	}
+	return nil, false
+}
+
+// remove deletes the oldest batch.
+func (s *diskSpool) remove() {
+	f := s.files[0]
+	if err := os.Remove(filepath.Join(s.dir, f.name)); err != nil && !os.IsNotExist(err) {
+		logErrorf("remove spooled batch: %v", err)
+	}
+	s.size -= f.size
+	s.files = s.files[1:]
+	lokiSpoolBytes.Set(float64(s.size))
+}
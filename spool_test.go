@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_spoolReplayAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &outageHandler{down: true}
+	cfg := LokiConfig{BatchCount: 1, SpoolDir: dir, SpoolMaxBytes: 1024 * 1024}
+	l, srv := newTestLoki(t, h, cfg)
+	defer srv.Close()
+	push(l, testLogLine("msg 1"), testLogLine("msg 2"))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pb"))
+	if len(files) != 2 {
+		t.Fatalf("got %d spool files but want 2", len(files))
+	}
+
+	// a fresh client replays the spool of the previous one
+	h.setDown(false)
+	cfg.URL = srv.URL
+	l, err = NewLoki(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(l, testLogLine("msg 3"))
+
+	var got []string
+	for _, e := range h.entries(t) {
+		got = append(got, e.Line)
+	}
+	if len(got) != 3 || got[0] != "msg 1" || got[1] != "msg 2" || got[2] != "msg 3" {
+		t.Errorf("got %q but want the spooled lines in order before msg 3", got)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("got %v left in the spool after the replay", files)
+	}
+}
+
+func Test_spoolEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a batch of the other encoding is no concern of this spool
+	other := filepath.Join(dir, "00000000000000000000.json.gz")
+	if err := ioutil.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newDiskSpool(dir, ".pb", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.add([]byte("aaaa"), 1)
+	s.add([]byte("bbbb"), 1)
+	s.add([]byte("cccc"), 1)
+	if buf, _ := s.first(); string(buf) != "bbbb" || s.size != 8 {
+		t.Errorf("got first %q and %d bytes but want bbbb and 8", buf, s.size)
+	}
+
+	// the order survives a restart
+	s, err = newDiskSpool(dir, ".pb", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.add([]byte("dd"), 1)
+	var got []string
+	for buf, ok := s.first(); ok; buf, ok = s.first() {
+		got = append(got, string(buf))
+		s.remove()
+	}
+	if len(got) != 3 || got[0] != "bbbb" || got[1] != "cccc" || got[2] != "dd" {
+		t.Errorf("got %q but want bbbb, cccc and dd", got)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("the batch of the other encoding is gone: %v", err)
+	}
+}
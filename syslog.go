@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errPriority = fmt.Errorf("Unexpected syslog priority format")
+	errHeader   = fmt.Errorf("Unexpected syslog header format")
+	errSD       = fmt.Errorf("Unexpected syslog structured data format")
+)
+
+// parser turns a raw input line into a LogLine.
+type parser func(raw []byte, promOnly bool) (*LogLine, error)
+
+var parsers = map[string]parser{
+	"fancy":   parseLine,
+	"rfc5424": parseRFC5424,
+	"rfc3164": parseRFC3164,
+}
+
+// parsePriority reads the <PRI> part and returns the severity and the
+// position after the closing bracket.
+func parsePriority(raw []byte) (string, int, error) {
+	if len(raw) < 3 || raw[0] != '<' {
+		return "", 0, errPriority
+	}
+	end := bytes.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return "", 0, errPriority
+	}
+	pri, err := strconv.Atoi(string(raw[1:end]))
+	if err != nil || pri > 191 {
+		return "", 0, errPriority
+	}
+	severity, err := getSeverity(byte('0' + pri%8))
+	return severity, end + 1, err
+}
+
+// nextField returns the field starting at pos and the position after the
+// following separator.
+func nextField(raw []byte, pos int) (string, int, error) {
+	if pos >= len(raw) {
+		return "", 0, errHeader
+	}
+	end := bytes.IndexByte(raw[pos:], seperator)
+	if end == -1 {
+		return "", 0, errHeader
+	}
+	return string(raw[pos : pos+end]), pos + end + 1, nil
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// parseRFC5424 parses <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG.
+// Structured data params become labels named <SD-ID>_<PARAM-NAME>.
+func parseRFC5424(raw []byte, promOnly bool) (*LogLine, error) {
+	ll := &LogLine{
+		Raw: raw,
+	}
+
+	var (
+		err   error
+		field string
+		pos   int
+	)
+	if ll.Severity, pos, err = parsePriority(raw); err != nil {
+		return nil, err
+	}
+	if field, pos, err = nextField(raw, pos); err != nil || field != "1" {
+		return nil, errHeader
+	}
+	if field, pos, err = nextField(raw, pos); err != nil {
+		return nil, err
+	}
+	if !promOnly {
+		ll.Timestamp = parseTimestamp(field)
+	}
+	if field, pos, err = nextField(raw, pos); err != nil {
+		return nil, err
+	}
+	ll.Hostname = nilValue(field)
+	if field, pos, err = nextField(raw, pos); err != nil {
+		return nil, err
+	}
+	ll.Program = nilValue(field)
+	// PROCID and MSGID
+	for i := 0; i < 2; i++ {
+		if _, pos, err = nextField(raw, pos); err != nil {
+			return nil, err
+		}
+	}
+
+	if ll.Labels, pos, err = parseSD(raw, pos); err != nil {
+		return nil, err
+	}
+	if pos < len(raw) && raw[pos] == seperator {
+		pos++
+	}
+	ll.MsgPos = pos
+
+	if !promOnly {
+		ll.Msg = strings.TrimPrefix(string(ll.Raw[ll.MsgPos:]), "\xef\xbb\xbf")
+		ll.Msg = sanitizeMsg(ll.Msg)
+	}
+	return ll, nil
+}
+
+// parseSD reads the structured data starting at pos and returns the params
+// as labels and the position after it.
+func parseSD(raw []byte, pos int) (map[string]string, int, error) {
+	if pos >= len(raw) {
+		return nil, 0, errSD
+	}
+	if raw[pos] == '-' {
+		return nil, pos + 1, nil
+	}
+
+	labels := map[string]string{}
+	for pos < len(raw) && raw[pos] == '[' {
+		pos++
+		end := bytes.IndexAny(raw[pos:], " ]")
+		if end == -1 {
+			return nil, 0, errSD
+		}
+		id := string(raw[pos : pos+end])
+		pos += end
+		for pos < len(raw) && raw[pos] == seperator {
+			pos++
+			eq := bytes.IndexByte(raw[pos:], '=')
+			if eq == -1 || pos+eq+1 >= len(raw) || raw[pos+eq+1] != '"' {
+				return nil, 0, errSD
+			}
+			name := string(raw[pos : pos+eq])
+			pos += eq + 2
+
+			var value strings.Builder
+			for ; pos < len(raw) && raw[pos] != '"'; pos++ {
+				if raw[pos] == '\\' && pos+1 < len(raw) {
+					pos++
+				}
+				value.WriteByte(raw[pos])
+			}
+			if pos >= len(raw) {
+				return nil, 0, errSD
+			}
+			pos++
+			if k := labelName(id + "_" + name); !reservedLabel(k) {
+				labels[k] = value.String()
+			}
+		}
+		if pos >= len(raw) || raw[pos] != ']' {
+			return nil, 0, errSD
+		}
+		pos++
+	}
+	return labels, pos, nil
+}
+
+// labelName replaces characters which are not allowed in label names.
+func labelName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// parseRFC3164 parses <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG. The
+// timestamp has no year, so the current one is assumed.
+func parseRFC3164(raw []byte, promOnly bool) (*LogLine, error) {
+	ll := &LogLine{
+		Raw: raw,
+	}
+
+	var (
+		err error
+		pos int
+	)
+	if ll.Severity, pos, err = parsePriority(raw); err != nil {
+		return nil, err
+	}
+	if len(raw) < pos+len(time.Stamp)+1 || raw[pos+len(time.Stamp)] != seperator {
+		return nil, errTime
+	}
+	if !promOnly {
+		ts, err := time.ParseInLocation(time.Stamp, string(raw[pos:pos+len(time.Stamp)]), time.Local)
+		if err != nil {
+			return nil, errTime
+		}
+		now := time.Now()
+		ll.Timestamp = ts.AddDate(now.Year(), 0, 0)
+		// a December line read in January is from last year
+		if ll.Timestamp.After(now.Add(24 * time.Hour)) {
+			ll.Timestamp = ll.Timestamp.AddDate(-1, 0, 0)
+		}
+	}
+	pos += len(time.Stamp) + 1
+
+	if ll.Hostname, pos, err = nextField(raw, pos); err != nil {
+		return nil, err
+	}
+
+	end := bytes.IndexAny(raw[pos:], "[: ")
+	if end <= 0 {
+		return nil, errHeader
+	}
+	ll.Program = string(raw[pos : pos+end])
+	pos += end
+	if raw[pos] == '[' {
+		pid := bytes.IndexByte(raw[pos:], ']')
+		if pid == -1 {
+			return nil, errHeader
+		}
+		pos += pid + 1
+	}
+	if pos < len(raw) && raw[pos] == ':' {
+		pos++
+	}
+	if pos < len(raw) && raw[pos] == seperator {
+		pos++
+	}
+	ll.MsgPos = pos
+
+	if !promOnly {
+		ll.Msg = string(ll.Raw[ll.MsgPos:])
+		ll.Msg = sanitizeMsg(ll.Msg)
+	}
+	return ll, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// tagFilter picks the msgs which get the static tag, those containing any
+// of strs or matching re.
+type tagFilter struct {
+	strs [][]byte
+	re   *regexp.Regexp
+}
+
+// newTagFilter takes the comma separated strings of list. Without any of
+// them and without re it returns nil, which tags every msg.
+func newTagFilter(list string, re *regexp.Regexp) *tagFilter {
+	f := &tagFilter{re: re}
+	for _, s := range splitList(list) {
+		f.strs = append(f.strs, []byte(s))
+	}
+	if len(f.strs) == 0 && re == nil {
+		return nil
+	}
+	return f
+}
+
+func (f *tagFilter) match(msg []byte) bool {
+	for _, s := range f.strs {
+		if bytes.Contains(msg, s) {
+			return true
+		}
+	}
+	return f.re != nil && f.re.Match(msg)
+}
+
+// tagPattern names a regular expression, the name becomes the static tag
+// of the msgs it matches.
+type tagPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// tagPatterns collects repeated name=regex flags, the first matching
+// pattern wins.
+type tagPatterns []tagPattern
+
+func (p *tagPatterns) String() string {
+	if p == nil {
+		return ""
+	}
+	pairs := make([]string, len(*p))
+	for i, tp := range *p {
+		pairs[i] = tp.name + "=" + tp.re.String()
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p *tagPatterns) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 1 || i == len(s)-1 {
+		return fmt.Errorf("tag pattern %q is not name=regex", s)
+	}
+	if !model.LabelValue(s[:i]).IsValid() {
+		return fmt.Errorf("invalid tag name %q", s[:i])
+	}
+	re, err := regexp.Compile(s[i+1:])
+	if err != nil {
+		return err
+	}
+	*p = append(*p, tagPattern{s[:i], re})
+	return nil
+}
+
+// match returns the name of the first pattern matching msg, or "".
+func (p tagPatterns) match(msg []byte) string {
+	for _, tp := range p {
+		if tp.re.Match(msg) {
+			return tp.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_tagFilter(t *testing.T) {
+	if f := newTagFilter(" , ", nil); f != nil {
+		t.Errorf("got %v but want nil to tag every msg", f)
+	}
+	cases := []struct {
+		list, re, msg string
+		want          bool
+	}{
+		{"oom", "", "kernel: oom-killer invoked", true},
+		{"oom,panic", "", "panic: runtime error", true},
+		{"oom, panic", "", "timeout after 5s", false},
+		{"", `timeout after [0-9]+s`, "timeout after 5s", true},
+		{"", `timeout after [0-9]+s`, "timeout after a while", false},
+		{"oom", `^panic`, "panic: runtime error", true},
+		{"oom", `^panic`, "no panic here", false},
+	}
+	for _, c := range cases {
+		var re *regexp.Regexp
+		if c.re != "" {
+			re = regexp.MustCompile(c.re)
+		}
+		if got := newTagFilter(c.list, re).match([]byte(c.msg)); got != c.want {
+			t.Errorf("list %q re %q msg %q: got %v but want %v", c.list, c.re, c.msg, got, c.want)
+		}
+	}
+}
+
+func Test_resolveStaticTag(t *testing.T) {
+	in := &Input{staticTag: "hit", staticTagFilter: newTagFilter("oom,panic", regexp.MustCompile(`time(d )?out`))}
+	for msg, want := range map[string]string{
+		"pad oom-killer":      "hit",
+		"pad panic: nil map":  "hit",
+		"pad request timeout": "hit",
+		"pad all good":        "",
+	} {
+		ll := &LogLine{Raw: []byte(msg), MsgPos: 4}
+		if got := in.resolveStaticTag(ll); got != want {
+			t.Errorf("%q: got tag %q but want %q", msg, got, want)
+		}
+	}
+	// the tag only looks at the msg
+	if got := in.resolveStaticTag(&LogLine{Raw: []byte("oom all good"), MsgPos: 4}); got != "" {
+		t.Errorf("got tag %q for a match outside the msg", got)
+	}
+}
+
+func Test_tagPatterns(t *testing.T) {
+	for _, s := range []string{"oom", "=oom", "oom=", "bad=(", "\xff=x"} {
+		var p tagPatterns
+		if err := p.Set(s); err == nil {
+			t.Errorf("got no error for %q", s)
+		}
+	}
+	var p tagPatterns
+	for _, s := range []string{"oom=out of memory|oom-killer", "panic=^panic:", "timeout=time(d )?out"} {
+		if err := p.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := p.String(); got != "oom=out of memory|oom-killer,panic=^panic:,timeout=time(d )?out" {
+		t.Errorf("got %s", got)
+	}
+
+	input := &Input{
+		promOnly:    true,
+		staticTag:   "other",
+		tagPatterns: p,
+		scanChan:    make(chan [][]byte, 10),
+	}
+	tagged := func(tag string) float64 {
+		return testutil.ToFloat64(logScanNumber.WithLabelValues("pad", "fancy", "info", tag))
+	}
+	before := map[string]float64{}
+	for _, tag := range []string{"oom", "panic", "timeout", "other"} {
+		before[tag] = tagged(tag)
+	}
+	var cache Cache
+	for _, msg := range []string{
+		"oom-killer invoked",
+		"panic: nil map",
+		"panic: out of memory", // the first pattern wins
+		"request timed out",
+		"all good",
+	} {
+		batchScan(input.scanChan, &cache, []byte("2019-10-29T16:21:22.230666+01:00 6 pad fancy "+msg+"\n"))
+	}
+	cache.flush(input.scanChan)
+	close(input.scanChan)
+	input.process()
+
+	// a msg no pattern matches falls back to static-tag
+	for tag, want := range map[string]float64{"oom": 2, "panic": 1, "timeout": 1, "other": 1} {
+		if got := tagged(tag) - before[tag]; got != want {
+			t.Errorf("got %v lines tagged %s but want %v", got, tag, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// tailPoll is how often a tailReader at EOF looks for new data.
+var tailPoll = 250 * time.Millisecond
+
+// tailReader reads a file like tail -F. At EOF it waits for the file to
+// grow instead of returning io.EOF, starts over when the file gets
+// truncated and opens the new file once path gets rotated. Only Close
+// makes it return io.EOF.
+type tailReader struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	done chan struct{}
+	once sync.Once
+}
+
+func newTailReader(path string) (*tailReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tailReader{path: path, f: f, done: make(chan struct{})}, nil
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		select {
+		case <-t.done:
+			return 0, io.EOF
+		case <-time.After(tailPoll):
+		}
+	}
+}
+
+// read returns 0 and no error while there is nothing new to read.
+func (t *tailReader) read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		return 0, io.EOF
+	default:
+	}
+	n, err := t.f.Read(p)
+	if n > 0 || (err != nil && err != io.EOF) {
+		return n, err
+	}
+	return t.follow()
+}
+
+// follow reopens a rotated and rewinds a truncated file.
+func (t *tailReader) follow() (int, error) {
+	fi, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		// rotated, but the new file is not there yet
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cur, err := t.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !os.SameFile(fi, cur) {
+		f, err := os.Open(t.path)
+		if err != nil {
+			return 0, err
+		}
+		t.f.Close()
+		t.f = f
+		logInfof("follow rotated %s", t.path)
+		return 0, nil
+	}
+	off, err := t.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if cur.Size() < off {
+		logInfof("%s truncated, reading it from the start", t.path)
+		_, err = t.f.Seek(0, io.SeekStart)
+	}
+	return 0, err
+}
+
+// Close makes a pending Read return io.EOF.
+func (t *tailReader) Close() error {
+	t.once.Do(func() { close(t.done) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
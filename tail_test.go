@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_tailReader(t *testing.T) {
+	defer func(poll time.Duration) { tailPoll = poll }(tailPoll)
+	tailPoll = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "fancy-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fancy.log")
+	write := func(flag int, n int) {
+		f, err := os.OpenFile(path, flag|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(testLines(n).Bytes())
+		f.Close()
+	}
+	write(os.O_CREATE, 2)
+
+	r, err := newTailReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := &Input{scanChan: make(chan [][]byte, 10)}
+	done := make(chan struct{})
+	go func() {
+		input.scan(&bytes.Buffer{}, r)
+		close(done)
+	}()
+	expect := func(step string, want int) {
+		n := 0
+		for n < want {
+			select {
+			case s := <-input.scanChan:
+				n += len(s)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: got %d lines but want %d", step, n, want)
+			}
+		}
+	}
+
+	expect("initial", 2)
+	write(os.O_APPEND, 3)
+	expect("appended after EOF", 3)
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(os.O_CREATE|os.O_EXCL, 4)
+	expect("rotated", 4)
+
+	write(os.O_TRUNC, 1)
+	expect("truncated", 1)
+
+	r.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scan did not return after Close")
+	}
+	if n := input.counts.scanned; n != 10 {
+		t.Errorf("got %d scanned lines but want 10", n)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// throughput counts the lines and bytes fancy read and processed. The
+// counters are updated atomically and have to stay 64-bit aligned.
+type throughput struct {
+	scanned   uint64
+	bytes     uint64
+	processed uint64
+}
+
+func (t *throughput) scan(n int) {
+	atomic.AddUint64(&t.scanned, 1)
+	atomic.AddUint64(&t.bytes, uint64(n))
+}
+
+func (t *throughput) process(lines int) {
+	atomic.AddUint64(&t.processed, uint64(lines))
+}
+
+// summary returns the totals and rates over d.
+func (t *throughput) summary(d time.Duration) string {
+	scanned := atomic.LoadUint64(&t.scanned)
+	bytes := atomic.LoadUint64(&t.bytes)
+	processed := atomic.LoadUint64(&t.processed)
+	sec := d.Seconds()
+	if sec <= 0 {
+		sec = 1e-9
+	}
+	return fmt.Sprintf("scanned %d lines (%d bytes) and processed %d lines in %v, %.0f lines/s, %.0f bytes/s",
+		scanned, bytes, processed, d.Round(time.Millisecond), float64(scanned)/sec, float64(bytes)/sec)
+}
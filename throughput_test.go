@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_throughputSummary(t *testing.T) {
+	input := &Input{
+		forward:  true,
+		lineChan: make(chan *LogLine, 100),
+		scanChan: make(chan [][]byte, 100),
+	}
+	lines := testLines(50)
+	size := lines.Len()
+	// a parse error still counts as processed
+	lines.WriteString("2019-10-29T16:21:22.230666+01:00 6 pad\n")
+	size += len("2019-10-29T16:21:22.230666+01:00 6 pad\n")
+
+	input.scan(&bytes.Buffer{}, lines)
+	input.process()
+
+	c := &input.counts
+	if c.scanned != 51 || c.bytes != uint64(size) || c.processed != 51 {
+		t.Errorf("got %d scanned, %d bytes and %d processed but want 51, %d and 51", c.scanned, c.bytes, c.processed, size)
+	}
+	got := c.summary(2 * time.Second)
+	want := "scanned 51 lines (" + strconv.Itoa(size) + " bytes) and processed 51 lines in 2s, 26 lines/s"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got summary %q but want it to start with %q", got, want)
+	}
+}
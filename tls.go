@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+var errTLSKeyPair = fmt.Errorf("TLS cert file and key file must be set together")
+
+// TLSConfig holds the settings of a TLS client connection.
+type TLSConfig struct {
+	// CAFile holds PEM certificates trusted instead of the system pool.
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mutual TLS.
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+func (c TLSConfig) empty() bool {
+	return c == TLSConfig{}
+}
+
+// newTLSConfig loads the files of c into a *tls.Config.
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errTLSKeyPair
+	}
+	cfg := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// newHTTPClient returns http.DefaultClient unless c sets anything.
+func newHTTPClient(c TLSConfig) (*http.Client, error) {
+	if c.empty() {
+		return http.DefaultClient, nil
+	}
+	cfg, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return &http.Client{Transport: t}, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePEM writes the blocks into a file of dir.
+func writePEM(t *testing.T, dir, name string, blocks ...*pem.Block) string {
+	t.Helper()
+	var b []byte
+	for _, block := range blocks {
+		b = append(b, pem.EncodeToMemory(block)...)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_lokiTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fancy-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := &pushRecorder{}
+	srv := httptest.NewUnstartedServer(rec)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the test server's certificate doubles as client certificate
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := writePEM(t, dir, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	certFile := writePEM(t, dir, "cert.pem", &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyFile := writePEM(t, dir, "key.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: key})
+
+	cases := []struct {
+		name   string
+		tls    TLSConfig
+		pushes int
+	}{
+		{"system pool", TLSConfig{CertFile: certFile, KeyFile: keyFile}, 0},
+		{"no client cert", TLSConfig{CAFile: caFile}, 0},
+		{"custom CA", TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, 1},
+		{"skip verify", TLSConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}, 1},
+	}
+	for _, c := range cases {
+		rec.reqs, rec.body = nil, nil
+		l, err := NewLoki(LokiConfig{URL: srv.URL, BatchSize: 1024, BatchWait: 60, TLS: c.tls})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		push(l, testLogLine("msg"))
+		if len(rec.reqs) != c.pushes {
+			t.Errorf("%s: got %d pushes but want %d", c.name, len(rec.reqs), c.pushes)
+		}
+	}
+}
+
+func Test_newTLSConfig(t *testing.T) {
+	if _, err := newTLSConfig(TLSConfig{CertFile: "cert.pem"}); err != errTLSKeyPair {
+		t.Errorf("got %v for a cert without key but want %v", err, errTLSKeyPair)
+	}
+	if _, err := newTLSConfig(TLSConfig{KeyFile: "key.pem"}); err != errTLSKeyPair {
+		t.Errorf("got %v for a key without cert but want %v", err, errTLSKeyPair)
+	}
+	if _, err := NewLoki(LokiConfig{URL: "https://localhost:3100", TLS: TLSConfig{CertFile: "cert.pem"}}); err != errTLSKeyPair {
+		t.Errorf("NewLoki: got %v but want %v", err, errTLSKeyPair)
+	}
+}
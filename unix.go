@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// unixSocketURL splits a unix:///path/to/socket URL into the path of the
+// socket and the http URL, with the query of the unix URL, to request on it.
+func unixSocketURL(s string) (string, string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "unix" || u.Path == "" {
+		return "", "", false
+	}
+	socket := u.Path
+	u.Scheme, u.Host, u.Path = "http", "localhost", ""
+	return socket, u.String(), true
+}
+
+// unixClient returns a copy of c which dials socket for every request.
+func unixClient(c *http.Client, socket string) *http.Client {
+	t, ok := c.Transport.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	var d net.Dialer
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "unix", socket)
+	}
+	return &http.Client{Transport: t, Timeout: c.Timeout}
+}
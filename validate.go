@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flagRule checks a flag value and returns what it wants instead, or ""
+// when the value is fine.
+type flagRule func(v string) string
+
+// flagRules holds the range and syntax checks of the flags.
+var flagRules = map[string]flagRule{
+	"workers":                      atLeast(1),
+	"scan-batch":                   atLeast(1),
+	"cmd-workers":                  atLeast(1),
+	"cmd-mode":                     oneOf("spawn", "pipe"),
+	"cmd-input":                    oneOf("msg", "raw", "json"),
+	"cmd-output":                   oneOf("text", "json"),
+	"cmd-timeout":                  durationAtLeast(0),
+	"cmd-max-output":               atLeast(0),
+	"cmd-max-concurrent":           atLeast(0),
+	"cmd-on-busy":                  oneOf("block", "drop"),
+	"dedup-window":                 durationAtLeast(0),
+	"multiline-timeout":            durationAtLeast(time.Nanosecond),
+	"extract-max-values":           atLeast(0),
+	"max-line-bytes":               atLeast(0),
+	"no-body-keep-bytes":           atLeast(0),
+	"max-read-bytes":               atLeast(0),
+	"read-buffer-bytes":            atLeast(16),
+	"invalid-utf8":                 oneOf("drop", "replace", "escape"),
+	"sample-rate":                  between(0, 1),
+	"rate-limit":                   atLeast(0),
+	"loki-url":                     lokiPushURL,
+	"loki-chan-size":               atLeast(1),
+	"loki-batch-size":              atLeast(1),
+	"loki-batch-wait-jitter":       between(0, 1),
+	"loki-batch-count":             atLeast(0),
+	"loki-batch-wait":              atLeast(1),
+	"loki-max-retries":             atLeast(0),
+	"loki-buffer-lines":            atLeast(0),
+	"loki-spool-max-bytes":         atLeast(1),
+	"loki-timeout":                 durationAtLeast(time.Nanosecond),
+	"loki-max-idle-conns":          atLeast(0),
+	"loki-max-idle-conns-per-host": atLeast(0),
+	"loki-idle-conn-timeout":       durationAtLeast(0),
+	"loki-max-line-age":            durationAtLeast(0),
+	"prom-addr":                    listenAddr,
+	"pprof-addr":                   listenAddr,
+	"syslog-listen":                listenAddr,
+	"es-url":                       httpURL,
+	"es-batch-size":                atLeast(1),
+	"es-batch-wait":                atLeast(1),
+	"webhook-url":                  httpURL,
+	"webhook-batch-size":           atLeast(1),
+	"webhook-batch-wait":           atLeast(1),
+	"file-max-size":                atLeast(0),
+	"file-max-backups":             atLeast(0),
+	"on-full":                      oneOf("drop", "block"),
+	"on-full-timeout":              durationAtLeast(0),
+	"log-format":                   oneOf("text", "json"),
+	"log-level":                    oneOf("debug", "info", "warn", "error"),
+}
+
+// validateFlags applies flagRules to the flags of fs and returns the first
+// invalid one in alphabetical order.
+func validateFlags(fs *flag.FlagSet) error {
+	names := make([]string, 0, len(flagRules))
+	for name := range flagRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		v := f.Value.String()
+		if want := flagRules[name](v); want != "" {
+			return fmt.Errorf("invalid %s value %q, want %s", name, v, want)
+		}
+	}
+	return nil
+}
+
+func atLeast(min float64) flagRule {
+	return func(v string) string {
+		if n, err := strconv.ParseFloat(v, 64); err != nil || n < min {
+			return fmt.Sprintf("at least %v", min)
+		}
+		return ""
+	}
+}
+
+func between(min, max float64) flagRule {
+	return func(v string) string {
+		if n, err := strconv.ParseFloat(v, 64); err != nil || n < min || n > max {
+			return fmt.Sprintf("%v to %v", min, max)
+		}
+		return ""
+	}
+}
+
+func durationAtLeast(min time.Duration) flagRule {
+	return func(v string) string {
+		if d, err := time.ParseDuration(v); err != nil || d < min {
+			if min == 0 {
+				return "a duration like 5s, 0 or more"
+			}
+			return "a duration like 5s, more than 0"
+		}
+		return ""
+	}
+}
+
+func oneOf(values ...string) flagRule {
+	return func(v string) string {
+		for _, value := range values {
+			if v == value {
+				return ""
+			}
+		}
+		return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+	}
+}
+
+// httpURL accepts an empty value for optional URLs.
+func httpURL(v string) string {
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "an http or https URL"
+	}
+	return ""
+}
+
+// lokiPushURL accepts the short values which disable Loki and unix socket
+// URLs.
+func lokiPushURL(v string) string {
+	if len(v) <= 3 {
+		return ""
+	}
+	if strings.HasPrefix(v, "unix:") {
+		if _, _, ok := unixSocketURL(v); !ok {
+			return "a URL like unix:///path/to/socket"
+		}
+		return ""
+	}
+	return httpURL(v)
+}
+
+func listenAddr(v string) string {
+	if _, err := net.ResolveTCPAddr("tcp", v); err != nil {
+		return "a listen address like :9090"
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func Test_validateFlags(t *testing.T) {
+	cases := []struct {
+		name, value string
+		valid       bool
+	}{
+		{"loki-chan-size", "-1", false},
+		{"loki-chan-size", "0", false},
+		{"loki-chan-size", "10", true},
+		{"loki-batch-wait", "0", false},
+		{"loki-batch-count", "0", true},
+		{"loki-batch-count", "-5", false},
+		{"loki-url", "localhost:3100", false},
+		{"loki-url", "ftp://localhost:3100", false},
+		{"loki-url", "http://", false},
+		{"loki-url", "https://loki.example.com/loki/api/v1/push", true},
+		{"loki-url", "", true},
+		{"loki-url", "off", true},
+		{"loki-url", "unix:///run/loki.sock", true},
+		{"loki-url", "unix://loki.sock", false},
+		{"es-url", "es:9200", false},
+		{"es-url", "", true},
+		{"webhook-url", "http://%zz", false},
+		{"prom-addr", ":9090", true},
+		{"prom-addr", "127.0.0.1:0", true},
+		{"prom-addr", "9090", false},
+		{"prom-addr", ":99999", false},
+		{"pprof-addr", "", true},
+		{"pprof-addr", "localhost:6060", true},
+		{"pprof-addr", "6060", false},
+		{"loki-timeout", "0s", false},
+		{"loki-timeout", "5", false},
+		{"cmd-timeout", "0s", true},
+		{"cmd-timeout", "-1s", false},
+		{"sample-rate", "1.5", false},
+		{"sample-rate", "0.5", true},
+		{"workers", "0", false},
+		{"on-full", "wait", false},
+		{"log-level", "trace", false},
+		{"log-level", "debug", true},
+	}
+	for _, c := range cases {
+		fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+		fs.String(c.name, "", "")
+		fs.Set(c.name, c.value)
+
+		err := validateFlags(fs)
+		if c.valid && err != nil {
+			t.Errorf("%s=%q: got %v but want no error", c.name, c.value, err)
+		}
+		if !c.valid && (err == nil || !strings.Contains(err.Error(), "invalid "+c.name+" value")) {
+			t.Errorf("%s=%q: got %v but want an error naming the flag", c.name, c.value, err)
+		}
+	}
+}
+
+func Test_validateFlagsDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("fancy", flag.ContinueOnError)
+	fs.Int("loki-chan-size", 10000, "")
+	fs.Duration("loki-timeout", 5e9, "")
+	fs.String("prom-addr", ":9090", "")
+	fs.Float64("sample-rate", 1, "")
+	fs.Int("not-checked", -1, "")
+	if err := validateFlags(fs); err != nil {
+		t.Errorf("got %v for valid defaults", err)
+	}
+}
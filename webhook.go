@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const defaultWebhookTemplate = "{{json .}}"
+
+// WebhookConfig holds the settings of the webhook client.
+type WebhookConfig struct {
+	URL         string
+	ContentType string
+	// Template is a text/template executed for every log line, or for the
+	// list of log lines of a batch when Batch is set. The json function
+	// marshals lines the same way as -output-json does.
+	Template  string
+	Batch     bool
+	BatchSize int
+	BatchWait int
+}
+
+// Webhook posts logs rendered by a template to an arbitrary HTTP endpoint.
+type Webhook struct {
+	url         string
+	contentType string
+	tmpl        *template.Template
+	batch       bool
+	batchWait   time.Duration
+	batchSize   int
+	pending     []*LogLine
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		switch v := v.(type) {
+		case *LogLine:
+			b, err := json.Marshal(newJSONLine(v))
+			return string(b), err
+		case []*LogLine:
+			lines := make([]*jsonLine, 0, len(v))
+			for _, ll := range v {
+				lines = append(lines, newJSONLine(ll))
+			}
+			b, err := json.Marshal(lines)
+			return string(b), err
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if _, err := http.NewRequest("POST", cfg.URL, nil); err != nil {
+		return nil, err
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultWebhookTemplate
+	}
+	tmpl, err := template.New("webhook").Funcs(templateFuncs).Parse(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = contentTypeJSON
+	}
+	return &Webhook{
+		url:         cfg.URL,
+		contentType: cfg.ContentType,
+		tmpl:        tmpl,
+		batch:       cfg.Batch,
+		batchSize:   cfg.BatchSize,
+		batchWait:   time.Duration(cfg.BatchWait) * time.Second,
+	}, nil
+}
+
+// Consume sends single lines right away or batches them until the channel
+// is closed. A call to Flush afterwards sends the last batch.
+func (w *Webhook) Consume(lines <-chan *LogLine) {
+	maxWait := time.NewTimer(w.batchWait)
+	for {
+		select {
+		case ll, ok := <-lines:
+			if !ok {
+				return
+			}
+			if !w.batch {
+				if err := w.send(ll); err != nil {
+					logErrorf("webhook send: %v", err)
+				}
+				continue
+			}
+			w.pending = append(w.pending, ll)
+			if len(w.pending) >= w.batchSize {
+				if err := w.send(w.pending); err != nil {
+					logErrorf("webhook send size batch: %v", err)
+				}
+				w.pending = nil
+				maxWait.Reset(w.batchWait)
+			}
+
+		case <-maxWait.C:
+			if len(w.pending) > 0 {
+				if err := w.send(w.pending); err != nil {
+					logErrorf("webhook send time batch: %v", err)
+				}
+				w.pending = nil
+			}
+			maxWait.Reset(w.batchWait)
+		}
+	}
+}
+
+// Flush sends the pending batch.
+func (w *Webhook) Flush() {
+	if len(w.pending) > 0 {
+		if err := w.send(w.pending); err != nil {
+			logErrorf("webhook flush: %v", err)
+		}
+	}
+	w.pending = nil
+}
+
+// send renders data, a *LogLine or a []*LogLine, and posts it.
+func (w *Webhook) send(data interface{}) error {
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", w.url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+		line := ""
+		if scanner.Scan() {
+			line = scanner.Text()
+		}
+		return fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_webhook(t *testing.T) {
+	ts := time.Date(2019, 10, 29, 15, 21, 22, 0, time.UTC)
+	cases := []struct {
+		cfg  WebhookConfig
+		want []string
+	}{
+		{
+			cfg: WebhookConfig{},
+			want: []string{
+				`{"host":"pad","program":"fancy","level":"info","msg":"first","ts":"2019-10-29T15:21:22Z"}`,
+				`{"host":"pad","program":"fancy","level":"info","msg":"second","ts":"2019-10-29T15:21:22Z"}`,
+			},
+		},
+		{
+			cfg:  WebhookConfig{Template: "{{.Hostname}}/{{.Program}}: {{.Msg}}"},
+			want: []string{"pad/fancy: first", "pad/fancy: second"},
+		},
+		{
+			cfg:  WebhookConfig{Batch: true, BatchSize: 10, Template: `{{range .}}{{.Severity}} {{.Msg}};{{end}}`},
+			want: []string{"info first;info second;"},
+		},
+		{
+			cfg: WebhookConfig{Batch: true, BatchSize: 10},
+			want: []string{
+				`[{"host":"pad","program":"fancy","level":"info","msg":"first","ts":"2019-10-29T15:21:22Z"},` +
+					`{"host":"pad","program":"fancy","level":"info","msg":"second","ts":"2019-10-29T15:21:22Z"}]`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		rec := &pushRecorder{}
+		srv := httptest.NewServer(rec)
+		c.cfg.URL = srv.URL
+		c.cfg.BatchWait = 60
+		w, err := NewWebhook(c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var lines []*LogLine
+		for _, msg := range []string{"first", "second"} {
+			ll := testLogLine(msg)
+			ll.Timestamp = ts
+			lines = append(lines, ll)
+		}
+		consume(w, lines...)
+		srv.Close()
+
+		if len(rec.body) != len(c.want) {
+			t.Fatalf("%q: got %d requests but want %d", c.cfg.Template, len(rec.body), len(c.want))
+		}
+		for i, want := range c.want {
+			if got := string(rec.body[i]); got != want {
+				t.Errorf("%q: got %s but want %s", c.cfg.Template, got, want)
+			}
+		}
+	}
+}
+
+func Test_webhookBadTemplate(t *testing.T) {
+	if _, err := NewWebhook(WebhookConfig{URL: "http://localhost", Template: "{{.Msg"}); err == nil {
+		t.Error("got no error for an invalid template")
+	}
+}